@@ -59,16 +59,65 @@ func main() {
 	// Initialize sync engine
 	// Temporarily pass nil for roomMgr, will set it after roomMgr init
 	syncEngine := persistence.NewSyncEngine(database, redisCache, nil)
-	go syncEngine.Start(context.Background())
+	messageWriter.SetSyncEngine(syncEngine)
 
 	// Initialize room manager, passing syncEngine (as rooms.SyncEngineService)
 	roomMgr := rooms.NewManager(database, redisCache, syncEngine)
+	slowConsumerPolicy, err := rooms.ParseSlowConsumerPolicy(cfg.SlowConsumerPolicy)
+	if err != nil {
+		logger.Fatal(context.Background(), "Invalid slow consumer policy: %v", err)
+	}
+	roomPolicies, err := rooms.ParseRoomPolicies(cfg.SlowConsumerRoomPolicies)
+	if err != nil {
+		logger.Fatal(context.Background(), "Invalid slow consumer room policies: %v", err)
+	}
+	roomMgr.SetBackpressureConfig(rooms.BackpressureConfig{
+		Policy:       slowConsumerPolicy,
+		RoomPolicies: roomPolicies,
+		OverflowSize: cfg.SlowConsumerOverflowSize,
+	})
+	floodControl := rooms.DefaultFloodControlConfig()
+	floodControl.MaxViolations = cfg.WSRateLimitMaxViolations
+	if cfg.WSRateLimitsConnection != "" {
+		if floodControl.Connection, err = rooms.ParseFloodLimits(cfg.WSRateLimitsConnection); err != nil {
+			logger.Fatal(context.Background(), "Invalid WebSocket connection rate limits: %v", err)
+		}
+	}
+	if cfg.WSRateLimitsUser != "" {
+		if floodControl.User, err = rooms.ParseFloodLimits(cfg.WSRateLimitsUser); err != nil {
+			logger.Fatal(context.Background(), "Invalid WebSocket user rate limits: %v", err)
+		}
+	}
+	roomMgr.SetFloodControlConfig(floodControl)
+	roomMgr.SetDrainConfig(rooms.DrainConfig{
+		WaveSize:        cfg.WSDrainWaveSize,
+		WaveInterval:    time.Duration(cfg.WSDrainWaveIntervalMs) * time.Millisecond,
+		ReconnectWindow: time.Duration(cfg.WSDrainReconnectWindowMs) * time.Millisecond,
+	})
+	roomMgr.SetUndoSendWindow(time.Duration(cfg.UndoSendWindowSeconds) * time.Second)
 	go roomMgr.Start(context.Background())
 
 	// Now that roomMgr is initialized, set it in syncEngine
 	// This is effectively breaking the explicit circular dependency while maintaining interaction
 	syncEngine.SetRoomManager(roomMgr)
 
+	// Initialize receipt writer, which records deliveries and tells senders about them
+	receiptWriter := persistence.NewReceiptWriter(database, roomMgr)
+	receiptWriter.Start(context.Background())
+	roomMgr.SetReceiptRecorder(receiptWriter)
+
+	// Initialize scheduler, which sends scheduled messages and those past their undo send window
+	scheduler := persistence.NewScheduler(database, messageWriter)
+	scheduler.Start(context.Background())
+
+	// Initialize expirer, which deletes disappearing messages once they expire
+	expirer := persistence.NewExpirer(database, redisCache, roomMgr)
+	expirer.Start(context.Background())
+
+	// Initialize poll closer, which freezes the results of polls once their close time passes
+	pollCloser := persistence.NewPollCloser(database, roomMgr)
+	pollCloser.Start(context.Background())
+
 	// Start background jobs
 	syncEngine.RunCleanupJob(context.Background(), 24*time.Hour)     // Run daily
 	syncEngine.RunArchivingJob(context.Background(), 7*24*time.Hour) // Run weekly
@@ -99,6 +148,7 @@ func main() {
 	if err != nil {
 		logger.Fatal(context.Background(), "Failed to initialize JWT manager: %v", err)
 	}
+	roomMgr.SetTokenValidator(jwtManager)
 
 	// Setup HTTP router
 	router := api.NewRouter(database, redisCache, roomMgr, messageWriter, syncEngine, clamAVClient, localFileStore, cfg, jwtManager, logger)
@@ -128,53 +178,73 @@ func main() {
 	<-sigChan
 
 	// Centralized graceful shutdown function
-	gracefulShutdown(context.Background(), logger, server, database, redisCache, roomMgr, messageWriter, syncEngine, clamAVClient, otelCleanup)
+	gracefulShutdown(context.Background(), logger, server, database, redisCache, roomMgr, scheduler, expirer, pollCloser, messageWriter, receiptWriter, syncEngine, clamAVClient, otelCleanup)
 
 	logger.Info(context.Background(), "Application stopped.")
 }
 
 // gracefulShutdown handles the graceful shutdown of all components
-func gracefulShutdown(ctx context.Context, logger *utils.Logger, server *http.Server, db *db.Database, cache *cache.Cache, roomMgr *rooms.Manager, messageWriter rooms.MessageWriterService, syncEngine rooms.SyncEngineService, clamAVClient *filescan.ClamAVClient, otelCleanup func(context.Context) error) {
+func gracefulShutdown(ctx context.Context, logger *utils.Logger, server *http.Server, db *db.Database, cache *cache.Cache, roomMgr *rooms.Manager, scheduler *persistence.Scheduler, expirer *persistence.Expirer, pollCloser *persistence.PollCloser, messageWriter rooms.MessageWriterService, receiptWriter rooms.ReceiptRecorderService, syncEngine rooms.SyncEngineService, clamAVClient *filescan.ClamAVClient, otelCleanup func(context.Context) error) {
 	logger.Info(ctx, "Shutting down server...")
 
 	// Create a context with a timeout for shutdown operations
 	shutdownCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
 	defer cancel()
 
-	// 1. Shut down HTTP server
+	// 1. Drain client connections: refuse new ones, tell clients to reconnect elsewhere and close them in waves
+	roomMgr.Drain(shutdownCtx)
+	logger.Info(ctx, "Client connections drained.")
+
+	// 2. Stop Room Manager (unloads rooms, ending the remaining event streams)
+	roomMgr.Stop()
+	logger.Info(ctx, "Room Manager stopped.")
+
+	// 3. Shut down HTTP server
 	if err := server.Shutdown(shutdownCtx); err != nil {
 		logger.Error(ctx, "HTTP server shutdown error: %v", err)
 	} else {
 		logger.Info(ctx, "HTTP server stopped.")
 	}
 
-	// 2. Stop Room Manager (closes client connections)
-	roomMgr.Stop()
-	logger.Info(ctx, "Room Manager stopped.")
+	// 4. Stop Scheduler (before the Message Writer it queues messages to)
+	scheduler.Stop()
+	logger.Info(ctx, "Scheduler stopped.")
+
+	// 5. Stop Expirer (before the Sync Engine it publishes expired messages through)
+	expirer.Stop()
+	logger.Info(ctx, "Expirer stopped.")
 
-	// 3. Stop Message Writer (flushes remaining messages)
+	// 6. Stop Poll Closer (before the Sync Engine it publishes final results through)
+	pollCloser.Stop()
+	logger.Info(ctx, "Poll Closer stopped.")
+
+	// 7. Stop Message Writer (flushes remaining messages, which are still published to other nodes)
 	messageWriter.Stop()
 	logger.Info(ctx, "Message Writer stopped.")
 
-	// 4. Stop Sync Engine
+	// 8. Stop Receipt Writer (flushes remaining receipts)
+	receiptWriter.Stop()
+	logger.Info(ctx, "Receipt Writer stopped.")
+
+	// 9. Stop Sync Engine
 	syncEngine.Stop()
 	logger.Info(ctx, "Sync Engine stopped.")
 
-	// 5. Close Database connection
+	// 10. Close Database connection
 	if err := db.Close(); err != nil {
 		logger.Error(ctx, "Database close error: %v", err)
 	} else {
 		logger.Info(ctx, "Database connection closed.")
 	}
 
-	// 6. Close Redis cache connection
+	// 11. Close Redis cache connection
 	if err := cache.Close(); err != nil {
 		logger.Error(ctx, "Redis cache close error: %v", err)
 	} else {
 		logger.Info(ctx, "Redis cache connection closed.")
 	}
 
-	// 7. Shutdown OpenTelemetry
+	// 12. Shutdown OpenTelemetry
 	if otelCleanup != nil {
 		if err := otelCleanup(shutdownCtx); err != nil {
 			logger.Error(ctx, "OpenTelemetry shutdown error: %v", err)
@@ -0,0 +1,255 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dukepan/multi-rooms-chat-back/internal/rooms"
+	"github.com/google/uuid"
+)
+
+const (
+	// sseKeepAlivePeriod is how often an idle event stream sends a comment so that proxies keep it open.
+	sseKeepAlivePeriod = 25 * time.Second
+
+	// defaultPollTimeout and maxPollTimeout bound how long a long-poll request waits for an event.
+	defaultPollTimeout = 25 * time.Second
+	maxPollTimeout     = 55 * time.Second
+)
+
+// PollEventsResponse is the response of a long-poll request. LastEventID is passed as last_event_id
+// on the next request.
+type PollEventsResponse struct {
+	Events      []*rooms.ServerFrame `json:"events"`
+	LastEventID int64                `json:"last_event_id"`
+}
+
+// RoomEventsHandler streams the frames of a room as Server-Sent Events, for clients that cannot open
+// a WebSocket. Each event carries the frame type as its event name and the frame as its data; room
+// events also carry their event ID, so a reconnecting EventSource resumes through Last-Event-ID.
+func (r *Router) RoomEventsHandler(w http.ResponseWriter, req *http.Request) {
+	userID, err := getUserIDFromContext(req.Context())
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	roomID, err := uuid.Parse(req.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid room ID", http.StatusBadRequest)
+		return
+	}
+
+	// Browsers send Last-Event-ID when reconnecting; last_event_id lets a client resume its first connection
+	lastEventIDStr := req.Header.Get("Last-Event-ID")
+	if lastEventIDStr == "" {
+		lastEventIDStr = req.URL.Query().Get("last_event_id")
+	}
+	lastEventID, ok := parseLastEventID(w, lastEventIDStr)
+	if !ok {
+		return
+	}
+
+	stream, ok := r.openStream(w, req, roomID, userID, lastEventID)
+	if !ok {
+		return
+	}
+	defer stream.Close()
+
+	// The stream outlives the server's write timeout
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		r.logger.Error(req.Context(), "Failed to clear write deadline of event stream: %v", err)
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		r.logger.Error(req.Context(), "Event streaming not supported: %v", err)
+		return
+	}
+
+	ctx := req.Context()
+	for {
+		waitCtx, cancel := context.WithTimeout(ctx, sseKeepAlivePeriod)
+		frame, err := stream.Next(waitCtx)
+		cancel()
+
+		switch {
+		case err == nil:
+			if err := writeServerSentEvent(w, frame); err != nil {
+				r.logger.Error(ctx, "Failed to write event to stream of room %s: %v", roomID, err)
+				return
+			}
+			r.roomMgr.RecordDelivery(userID, frame)
+		case errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+		default:
+			// The client went away, or the stream was closed for falling behind or by a drain.
+			// Frames queued before the close, such as server_draining, are still sent.
+			for _, frame := range stream.Buffered() {
+				if err := writeServerSentEvent(w, frame); err != nil {
+					return
+				}
+			}
+			rc.Flush()
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// PollRoomEventsHandler is the long-poll fallback of RoomEventsHandler. It returns the frames of a room
+// after last_event_id, waiting up to timeout seconds for one if there are none yet. Frames without an
+// event ID, such as typing updates, are only seen while a request is waiting.
+func (r *Router) PollRoomEventsHandler(w http.ResponseWriter, req *http.Request) {
+	userID, err := getUserIDFromContext(req.Context())
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	roomID, err := uuid.Parse(req.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid room ID", http.StatusBadRequest)
+		return
+	}
+
+	lastEventIDStr := req.URL.Query().Get("last_event_id")
+	if lastEventIDStr == "" {
+		lastEventIDStr = req.Header.Get("Last-Event-ID")
+	}
+	lastEventID, ok := parseLastEventID(w, lastEventIDStr)
+	if !ok {
+		return
+	}
+
+	timeout := defaultPollTimeout
+	if timeoutStr := req.URL.Query().Get("timeout"); timeoutStr != "" {
+		seconds, err := strconv.Atoi(timeoutStr)
+		if err != nil || seconds < 0 {
+			http.Error(w, "Invalid timeout", http.StatusBadRequest)
+			return
+		}
+		timeout = min(time.Duration(seconds)*time.Second, maxPollTimeout)
+	}
+
+	stream, ok := r.openStream(w, req, roomID, userID, lastEventID)
+	if !ok {
+		return
+	}
+	defer stream.Close()
+
+	// Leave time to write the response after waiting
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Now().Add(timeout + 15*time.Second)); err != nil {
+		r.logger.Error(req.Context(), "Failed to extend write deadline of long-poll request: %v", err)
+	}
+
+	// Missed events are returned right away; otherwise wait for the next frame. A replay that found
+	// nothing missed is not worth returning, or resuming clients would never wait.
+	events := stream.Buffered()
+	if len(events) == 1 && isEmptyReplay(events[0]) {
+		events = nil
+	}
+	if len(events) == 0 && timeout > 0 {
+		waitCtx, cancel := context.WithTimeout(req.Context(), timeout)
+		frame, err := stream.Next(waitCtx)
+		cancel()
+		if err == nil {
+			events = append(events, frame)
+		}
+		events = append(events, stream.Buffered()...)
+	}
+
+	if events == nil {
+		events = []*rooms.ServerFrame{}
+	}
+	resumeFrom := stream.LastEventID()
+	if resumeFrom == 0 {
+		resumeFrom = lastEventID
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	if err := json.NewEncoder(w).Encode(PollEventsResponse{Events: events, LastEventID: resumeFrom}); err != nil {
+		return
+	}
+	for _, frame := range events {
+		r.roomMgr.RecordDelivery(userID, frame)
+	}
+}
+
+// isEmptyReplay reports whether frame is the replay_complete of a replay that missed no events.
+func isEmptyReplay(frame *rooms.ServerFrame) bool {
+	if frame.Type != rooms.FrameReplayComplete {
+		return false
+	}
+	payload, ok := frame.Payload.(rooms.ReplayCompletePayload)
+	return ok && payload.Replayed == 0 && !payload.Truncated
+}
+
+// openStream opens a stream of a room's frames, writing the error response if it cannot.
+func (r *Router) openStream(w http.ResponseWriter, req *http.Request, roomID, userID uuid.UUID, lastEventID int64) (*rooms.Stream, bool) {
+	stream, err := r.roomMgr.OpenStream(req.Context(), roomID, userID, lastEventID)
+	if err != nil {
+		if errors.Is(err, rooms.ErrNotRoomMember) {
+			http.Error(w, "Not a member of this room", http.StatusForbidden)
+			return nil, false
+		}
+		if errors.Is(err, rooms.ErrDraining) {
+			writeDraining(w)
+			return nil, false
+		}
+		r.logger.Error(req.Context(), "Failed to open event stream of room %s: %v", roomID, err)
+		http.Error(w, "Failed to open event stream", http.StatusInternalServerError)
+		return nil, false
+	}
+	return stream, true
+}
+
+// parseLastEventID parses an optional event ID to resume from, writing a 400 if it is invalid.
+func parseLastEventID(w http.ResponseWriter, s string) (int64, bool) {
+	if s == "" {
+		return 0, true
+	}
+	lastEventID, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || lastEventID < 0 {
+		http.Error(w, "Invalid last_event_id", http.StatusBadRequest)
+		return 0, false
+	}
+	return lastEventID, true
+}
+
+// writeServerSentEvent writes a frame as a Server-Sent Event. Frames without an event ID get no id
+// field, so that they do not change the client's Last-Event-ID. A server_draining frame sets the
+// EventSource reconnection delay to its hint.
+func writeServerSentEvent(w http.ResponseWriter, frame *rooms.ServerFrame) error {
+	data, err := json.Marshal(frame)
+	if err != nil {
+		return err
+	}
+	if draining, ok := frame.Payload.(rooms.DrainingPayload); ok {
+		if _, err := fmt.Fprintf(w, "retry: %d\n", draining.ReconnectAfterMs); err != nil {
+			return err
+		}
+	}
+	if frame.EventID != 0 {
+		if _, err := fmt.Fprintf(w, "id: %d\n", frame.EventID); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", frame.Type, data)
+	return err
+}
@@ -0,0 +1,107 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/dukepan/multi-rooms-chat-back/internal/models"
+	"github.com/dukepan/multi-rooms-chat-back/internal/rooms"
+)
+
+// SetMessageTTLRequest represents a request to make the new messages of a room disappear
+type SetMessageTTLRequest struct {
+	TTLSeconds *int   `json:"ttl_seconds"` // null turns disappearing messages off
+	After      string `json:"after"`       // sent (default), read
+}
+
+// MessageTTLEventContent is the content of the system message recording a change of a room's
+// disappearing messages in its history
+type MessageTTLEventContent struct {
+	Event      string `json:"event"` // message_ttl_updated
+	TTLSeconds *int   `json:"ttl_seconds"`
+	After      string `json:"after"`
+}
+
+// SetMessageTTLHandler sets how long the new messages of a room last, counted from when they are sent
+// or first read (admins and moderators). Messages already sent keep their lifetime.
+func (r *Router) SetMessageTTLHandler(w http.ResponseWriter, req *http.Request) {
+	userID, err := getUserIDFromContext(req.Context())
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	roomID, err := uuid.Parse(req.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid room ID", http.StatusBadRequest)
+		return
+	}
+
+	var body SetMessageTTLRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if body.After == "" {
+		body.After = models.MessageTTLAfterSent
+	}
+	if body.After != models.MessageTTLAfterSent && body.After != models.MessageTTLAfterRead {
+		http.Error(w, "after must be sent or read", http.StatusBadRequest)
+		return
+	}
+	if body.TTLSeconds != nil && !rooms.ValidMessageTTL(*body.TTLSeconds) {
+		http.Error(w, fmt.Sprintf("ttl_seconds must be between 1 and %d", rooms.MaxMessageTTLSeconds), http.StatusBadRequest)
+		return
+	}
+
+	if !r.authorizeModerator(w, req, roomID, userID, "change disappearing messages") {
+		return
+	}
+
+	if err := r.db.SetRoomMessageTTL(req.Context(), roomID, body.TTLSeconds, body.After); err != nil {
+		r.logger.Error(req.Context(), "Failed to set message TTL of room %s: %v", roomID, err)
+		http.Error(w, "Failed to update disappearing messages", http.StatusInternalServerError)
+		return
+	}
+	r.publishMessageTTLChange(req, roomID, userID, body.TTLSeconds, body.After)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message_ttl_seconds": body.TTLSeconds,
+		"message_ttl_after":   body.After,
+	})
+}
+
+// publishMessageTTLChange broadcasts a stored change of a room's disappearing messages to the room on
+// every node and records it in the room's history as a system message. The change is already stored,
+// so failures are only logged.
+func (r *Router) publishMessageTTLChange(req *http.Request, roomID, userID uuid.UUID, ttlSeconds *int, after string) {
+	err := r.syncEngine.PublishRoomEvent(req.Context(), roomID, rooms.FrameMessageTTLUpdated, map[string]interface{}{
+		"ttl_seconds": ttlSeconds,
+		"after":       after,
+		"user_id":     userID,
+	})
+	if err != nil {
+		r.logger.Error(req.Context(), "Failed to publish %s event for room %s: %v", rooms.FrameMessageTTLUpdated, roomID, err)
+	}
+
+	content, err := json.Marshal(MessageTTLEventContent{Event: rooms.FrameMessageTTLUpdated, TTLSeconds: ttlSeconds, After: after})
+	if err != nil {
+		r.logger.Error(req.Context(), "Failed to marshal %s event for room %s: %v", rooms.FrameMessageTTLUpdated, roomID, err)
+		return
+	}
+	msg := &models.Message{
+		RoomID:      roomID,
+		UserID:      userID,
+		Content:     string(content),
+		MessageType: models.MessageTypeSystem,
+		CreatedAt:   time.Now(),
+	}
+	if err := r.messageWriter.QueueMessage(msg); err != nil {
+		r.logger.Error(req.Context(), "Failed to record %s event in room %s: %v", rooms.FrameMessageTTLUpdated, roomID, err)
+	}
+}
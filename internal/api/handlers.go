@@ -3,6 +3,7 @@ package api
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"strings"
@@ -11,6 +12,7 @@ import (
 	"github.com/dukepan/multi-rooms-chat-back/internal/auth"
 	"github.com/dukepan/multi-rooms-chat-back/internal/contextkey"
 	"github.com/dukepan/multi-rooms-chat-back/internal/models"
+	"github.com/dukepan/multi-rooms-chat-back/internal/rooms"
 	"github.com/google/uuid"
 )
 
@@ -144,6 +146,55 @@ func (r *Router) LoginHandler(w http.ResponseWriter, req *http.Request) {
 	json.NewEncoder(w).Encode(LoginResponse{Token: token, Message: "Logged in successfully"})
 }
 
+// LogoutHandler revokes the token the request is authenticated with, closing the WebSocket
+// connections opened with it on every node
+func (r *Router) LogoutHandler(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	tokenString := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if tokenString == "" {
+		http.Error(w, "Authorization token required", http.StatusUnauthorized)
+		return
+	}
+	claims, err := r.authenticate(ctx, tokenString)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid token: %v", err), http.StatusUnauthorized)
+		return
+	}
+	if claims.ID == "" || claims.ExpiresAt == nil {
+		http.Error(w, "Token cannot be revoked", http.StatusBadRequest)
+		return
+	}
+
+	if err := r.cache.RevokeToken(ctx, claims.ID, claims.ExpiresAt.Time); err != nil {
+		r.logger.Error(ctx, "Failed to revoke token of user %s: %v", claims.UserID, err)
+		http.Error(w, "Failed to log out", http.StatusInternalServerError)
+		return
+	}
+	if err := r.roomMgr.PublishTokenRevocation(ctx, rooms.TokenRevocation{UserID: claims.UserID, TokenID: claims.ID}); err != nil {
+		r.logger.Error(ctx, "Failed to publish token revocation of user %s: %v", claims.UserID, err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Logged out successfully"})
+}
+
+// authenticate validates a JWT and checks that it has not been revoked
+func (r *Router) authenticate(ctx context.Context, tokenString string) (*auth.Claims, error) {
+	claims, err := r.jwtMgr.ValidateToken(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	revoked, err := r.cache.IsTokenRevoked(ctx, claims.ID)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, errors.New("token has been revoked")
+	}
+	return claims, nil
+}
+
 // AuthMiddleware validates JWT and extracts user from context
 func (r *Router) AuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
@@ -153,7 +204,7 @@ func (r *Router) AuthMiddleware(next http.Handler) http.Handler {
 			return
 		}
 
-		claims, err := r.jwtMgr.ValidateToken(tokenString)
+		claims, err := r.authenticate(req.Context(), tokenString)
 		if err != nil {
 			http.Error(w, fmt.Sprintf("Invalid token: %v", err), http.StatusUnauthorized)
 			return
@@ -161,6 +212,7 @@ func (r *Router) AuthMiddleware(next http.Handler) http.Handler {
 
 		// Store user ID in context
 		ctx := context.WithValue(req.Context(), contextkey.ContextKeyUserID, claims.UserID)
+		ctx = context.WithValue(ctx, contextkey.ContextKeyClaims, claims)
 		req = req.WithContext(ctx)
 		next.ServeHTTP(w, req)
 	})
@@ -2,9 +2,13 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+
+	"github.com/dukepan/multi-rooms-chat-back/internal/rooms"
 )
 
 // AddMemberRequest represents adding a member to a room
@@ -13,15 +17,19 @@ type AddMemberRequest struct {
 	Role   string `json:"role"`
 }
 
+// BanMemberRequest represents banning a user from a room
+type BanMemberRequest struct {
+	UserID string `json:"user_id"`
+	Reason string `json:"reason"`
+}
+
 // AddMemberHandler adds a user to a room
 func (r *Router) AddMemberHandler(w http.ResponseWriter, req *http.Request) {
-	userIDStr := req.Header.Get("X-User-ID")
-	requesterID, err := uuid.Parse(userIDStr)
+	requesterID, err := getUserIDFromContext(req.Context())
 	if err != nil {
-		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
-	_ = requesterID // Temporarily mark as used
 
 	roomIDStr := req.PathValue("id")
 	roomID, err := uuid.Parse(roomIDStr)
@@ -41,15 +49,34 @@ func (r *Router) AddMemberHandler(w http.ResponseWriter, req *http.Request) {
 		http.Error(w, "Invalid member ID", http.StatusBadRequest)
 		return
 	}
+	if addReq.Role == "" {
+		addReq.Role = "member"
+	}
+	if addReq.Role != "member" && addReq.Role != "moderator" && addReq.Role != "admin" {
+		http.Error(w, "role must be member, moderator or admin", http.StatusBadRequest)
+		return
+	}
 
-	// Authorization check: Verify if requesterID has admin status in roomID
-	// For now, this is a placeholder. In a real implementation, you would query the database
-	// to check the role of requesterID in roomID.
-	// E.g., is_admin, err := r.db.IsRoomAdmin(req.Context(), roomID, requesterID)
-	// if err != nil || !is_admin {
-	// 	http.Error(w, "Forbidden: Not authorized to add members to this room", http.StatusForbidden)
-	// 	return
-	// }
+	requesterRole, ok := r.authorizeModeratorRole(w, req, roomID, requesterID, "manage members")
+	if !ok {
+		return
+	}
+	// Moderators add members; only admins hand out moderator or admin rights
+	if addReq.Role != "member" && requesterRole != "admin" {
+		http.Error(w, "Forbidden: only admins can add moderators and admins", http.StatusForbidden)
+		return
+	}
+
+	banned, err := r.db.IsRoomBanned(req.Context(), roomID, memberID)
+	if err != nil {
+		r.logger.Error(req.Context(), "Failed to check ban of user %s in room %s: %v", memberID, roomID, err)
+		http.Error(w, "Failed to add member", http.StatusInternalServerError)
+		return
+	}
+	if banned {
+		http.Error(w, "User is banned from this room", http.StatusForbidden)
+		return
+	}
 
 	// Add member to room
 	err = r.db.AddRoomMember(req.Context(), roomID, memberID, addReq.Role)
@@ -58,20 +85,26 @@ func (r *Router) AddMemberHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	r.publishMembershipChange(req, rooms.MembershipChange{
+		RoomID: roomID,
+		UserID: memberID,
+		Change: rooms.MembershipAdded,
+		Role:   addReq.Role,
+		By:     requesterID,
+	})
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
 }
 
-// RemoveMemberHandler removes a user from a room
+// RemoveMemberHandler removes a user from a room. Members can always remove themselves.
 func (r *Router) RemoveMemberHandler(w http.ResponseWriter, req *http.Request) {
-	userIDStr := req.Header.Get("X-User-ID")
-	requesterID, err := uuid.Parse(userIDStr)
+	requesterID, err := getUserIDFromContext(req.Context())
 	if err != nil {
-		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
-	_ = requesterID // Temporarily mark as used
 
 	roomIDStr := req.PathValue("id")
 	roomID, err := uuid.Parse(roomIDStr)
@@ -87,14 +120,9 @@ func (r *Router) RemoveMemberHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	// Authorization check: Verify if requesterID has admin status in roomID
-	// For now, this is a placeholder. In a real implementation, you would query the database
-	// to check the role of requesterID in roomID.
-	// E.g., is_admin, err := r.db.IsRoomAdmin(req.Context(), roomID, requesterID)
-	// if err != nil || !is_admin {
-	// 	http.Error(w, "Forbidden: Not authorized to remove members from this room", http.StatusForbidden)
-	// 	return
-	// }
+	if memberID != requesterID && !r.authorizeMemberManagement(w, req, roomID, requesterID) {
+		return
+	}
 
 	// Remove member from room
 	err = r.db.RemoveRoomMember(req.Context(), roomID, memberID)
@@ -103,6 +131,138 @@ func (r *Router) RemoveMemberHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	r.publishMembershipChange(req, rooms.MembershipChange{
+		RoomID: roomID,
+		UserID: memberID,
+		Change: rooms.MembershipRemoved,
+		By:     requesterID,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
+
+// BanMemberHandler removes a user from a room and keeps them from being added back
+func (r *Router) BanMemberHandler(w http.ResponseWriter, req *http.Request) {
+	requesterID, err := getUserIDFromContext(req.Context())
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	roomID, err := uuid.Parse(req.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid room ID", http.StatusBadRequest)
+		return
+	}
+
+	var banReq BanMemberRequest
+	if err := json.NewDecoder(req.Body).Decode(&banReq); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	memberID, err := uuid.Parse(banReq.UserID)
+	if err != nil {
+		http.Error(w, "Invalid member ID", http.StatusBadRequest)
+		return
+	}
+	if memberID == requesterID {
+		http.Error(w, "Cannot ban yourself", http.StatusBadRequest)
+		return
+	}
+
+	if !r.authorizeMemberManagement(w, req, roomID, requesterID) {
+		return
+	}
+
+	if err := r.db.BanRoomMember(req.Context(), roomID, memberID, requesterID, banReq.Reason); err != nil {
+		r.logger.Error(req.Context(), "Failed to ban user %s from room %s: %v", memberID, roomID, err)
+		http.Error(w, "Failed to ban member", http.StatusInternalServerError)
+		return
+	}
+
+	r.publishMembershipChange(req, rooms.MembershipChange{
+		RoomID: roomID,
+		UserID: memberID,
+		Change: rooms.MembershipBanned,
+		By:     requesterID,
+	})
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
 }
+
+// UnbanMemberHandler lifts a user's ban from a room. It does not add them back.
+func (r *Router) UnbanMemberHandler(w http.ResponseWriter, req *http.Request) {
+	requesterID, err := getUserIDFromContext(req.Context())
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	roomID, err := uuid.Parse(req.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid room ID", http.StatusBadRequest)
+		return
+	}
+
+	memberID, err := uuid.Parse(req.PathValue("user_id"))
+	if err != nil {
+		http.Error(w, "Invalid member ID", http.StatusBadRequest)
+		return
+	}
+
+	if !r.authorizeMemberManagement(w, req, roomID, requesterID) {
+		return
+	}
+
+	if err := r.db.UnbanRoomMember(req.Context(), roomID, memberID); err != nil {
+		r.logger.Error(req.Context(), "Failed to unban user %s from room %s: %v", memberID, roomID, err)
+		http.Error(w, "Failed to unban member", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
+
+// authorizeMemberManagement checks that the requester is an admin or moderator of the room,
+// writing the error response if they are not.
+func (r *Router) authorizeMemberManagement(w http.ResponseWriter, req *http.Request, roomID, requesterID uuid.UUID) bool {
+	return r.authorizeModerator(w, req, roomID, requesterID, "manage members")
+}
+
+// authorizeModerator checks that the requester is an admin or moderator of the room, writing the
+// error response naming the action they are not allowed to perform if they are not.
+func (r *Router) authorizeModerator(w http.ResponseWriter, req *http.Request, roomID, requesterID uuid.UUID, action string) bool {
+	_, ok := r.authorizeModeratorRole(w, req, roomID, requesterID, action)
+	return ok
+}
+
+// authorizeModeratorRole is authorizeModerator for callers that also need the requester's role.
+func (r *Router) authorizeModeratorRole(w http.ResponseWriter, req *http.Request, roomID, requesterID uuid.UUID, action string) (string, bool) {
+	role, err := r.db.GetRoomMemberRole(req.Context(), roomID, requesterID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		http.Error(w, "Not a member of this room", http.StatusForbidden)
+		return "", false
+	}
+	if err != nil {
+		r.logger.Error(req.Context(), "Failed to fetch role of user %s in room %s: %v", requesterID, roomID, err)
+		http.Error(w, "Failed to check permissions", http.StatusInternalServerError)
+		return "", false
+	}
+	if role != "admin" && role != "moderator" {
+		http.Error(w, "Forbidden: only admins and moderators can "+action, http.StatusForbidden)
+		return "", false
+	}
+	return role, true
+}
+
+// publishMembershipChange propagates a stored membership change to the live connections on every node.
+// The change is already stored, so a failure to publish is only logged.
+func (r *Router) publishMembershipChange(req *http.Request, change rooms.MembershipChange) {
+	if err := r.roomMgr.PublishMembershipChange(req.Context(), change); err != nil {
+		r.logger.Error(req.Context(), "Failed to publish %s membership change of user %s in room %s: %v", change.Change, change.UserID, change.RoomID, err)
+	}
+}
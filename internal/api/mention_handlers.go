@@ -0,0 +1,99 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/dukepan/multi-rooms-chat-back/internal/models"
+)
+
+// MentionsResponse is a page of the user's mentions, newest first. NextBefore is passed as before to
+// fetch the next page, and is omitted on the last page.
+type MentionsResponse struct {
+	Mentions   []models.Mention `json:"mentions"`
+	NextBefore int64            `json:"next_before,omitempty"`
+}
+
+// MarkMentionsSeenRequest represents marking mentions as seen, either in the given messages or in
+// every message up to UpToMessageID
+type MarkMentionsSeenRequest struct {
+	MessageIDs    []int64 `json:"message_ids"`
+	UpToMessageID int64   `json:"up_to_message_id"`
+}
+
+// GetMentionsHandler lists the mentions of the authenticated user across their rooms
+func (r *Router) GetMentionsHandler(w http.ResponseWriter, req *http.Request) {
+	userID, err := getUserIDFromContext(req.Context())
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Parse query parameters
+	limit := 50
+	if limitStr := req.URL.Query().Get("limit"); limitStr != "" {
+		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 && l <= 100 {
+			limit = l
+		}
+	}
+
+	before := int64(0)
+	if beforeStr := req.URL.Query().Get("before"); beforeStr != "" {
+		b, err := strconv.ParseInt(beforeStr, 10, 64)
+		if err != nil || b < 0 {
+			http.Error(w, "Invalid before", http.StatusBadRequest)
+			return
+		}
+		before = b
+	}
+	unseenOnly := req.URL.Query().Get("unseen") == "true"
+
+	mentions, err := r.db.GetUserMentions(req.Context(), userID, before, limit, unseenOnly)
+	if err != nil {
+		r.logger.Error(req.Context(), "Failed to fetch mentions of user %s: %v", userID, err)
+		http.Error(w, "Failed to fetch mentions", http.StatusInternalServerError)
+		return
+	}
+
+	resp := MentionsResponse{Mentions: mentions}
+	if mentions == nil {
+		resp.Mentions = make([]models.Mention, 0)
+	}
+	if len(mentions) == limit {
+		resp.NextBefore = mentions[len(mentions)-1].MessageID
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// MarkMentionsSeenHandler marks mentions of the authenticated user as seen, which clears them from
+// the unread mention counts of their rooms
+func (r *Router) MarkMentionsSeenHandler(w http.ResponseWriter, req *http.Request) {
+	userID, err := getUserIDFromContext(req.Context())
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var seenReq MarkMentionsSeenRequest
+	if err := json.NewDecoder(req.Body).Decode(&seenReq); err != nil || (len(seenReq.MessageIDs) == 0 && seenReq.UpToMessageID <= 0) {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if len(seenReq.MessageIDs) > 100 {
+		http.Error(w, "Too many message IDs", http.StatusBadRequest)
+		return
+	}
+
+	seen, err := r.db.MarkMentionsSeen(req.Context(), userID, seenReq.MessageIDs, seenReq.UpToMessageID)
+	if err != nil {
+		r.logger.Error(req.Context(), "Failed to mark mentions of user %s as seen: %v", userID, err)
+		http.Error(w, "Failed to mark mentions as seen", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int64{"seen": seen})
+}
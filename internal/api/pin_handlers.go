@@ -0,0 +1,157 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+
+	"github.com/dukepan/multi-rooms-chat-back/internal/models"
+	"github.com/dukepan/multi-rooms-chat-back/internal/rooms"
+)
+
+// PinEventContent is the content of the system message recording a pin or unpin in a room's history
+type PinEventContent struct {
+	Event     string `json:"event"` // message_pinned, message_unpinned
+	MessageID int64  `json:"message_id"`
+}
+
+// PinMessageHandler pins a message in its room (admins and moderators)
+func (r *Router) PinMessageHandler(w http.ResponseWriter, req *http.Request) {
+	userID, err := getUserIDFromContext(req.Context())
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	roomID, messageID, ok := parseMessagePath(w, req)
+	if !ok {
+		return
+	}
+	if !r.authorizeModerator(w, req, roomID, userID, "pin messages") {
+		return
+	}
+
+	message, err := r.db.GetMessageByID(req.Context(), messageID)
+	if errors.Is(err, pgx.ErrNoRows) || (err == nil && message.RoomID != roomID) {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		r.logger.Error(req.Context(), "Failed to fetch message %d: %v", messageID, err)
+		http.Error(w, "Failed to pin message", http.StatusInternalServerError)
+		return
+	}
+
+	pinned, err := r.db.PinMessage(req.Context(), roomID, messageID, userID)
+	if err != nil {
+		r.logger.Error(req.Context(), "Failed to pin message %d in room %s: %v", messageID, roomID, err)
+		http.Error(w, "Failed to pin message", http.StatusInternalServerError)
+		return
+	}
+	// Pinning a pinned message changes nothing, so it is neither broadcast nor recorded again
+	if pinned {
+		r.publishPinChange(req, roomID, userID, messageID, rooms.FrameMessagePinned)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Message pinned successfully"})
+}
+
+// UnpinMessageHandler unpins a message (admins and moderators)
+func (r *Router) UnpinMessageHandler(w http.ResponseWriter, req *http.Request) {
+	userID, err := getUserIDFromContext(req.Context())
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	roomID, messageID, ok := parseMessagePath(w, req)
+	if !ok {
+		return
+	}
+	if !r.authorizeModerator(w, req, roomID, userID, "unpin messages") {
+		return
+	}
+
+	unpinned, err := r.db.UnpinMessage(req.Context(), roomID, messageID)
+	if err != nil {
+		r.logger.Error(req.Context(), "Failed to unpin message %d in room %s: %v", messageID, roomID, err)
+		http.Error(w, "Failed to unpin message", http.StatusInternalServerError)
+		return
+	}
+	if !unpinned {
+		http.Error(w, "Message is not pinned", http.StatusNotFound)
+		return
+	}
+	r.publishPinChange(req, roomID, userID, messageID, rooms.FrameMessageUnpinned)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Message unpinned successfully"})
+}
+
+// GetPinsHandler lists the pinned messages of a room, most recently pinned first
+func (r *Router) GetPinsHandler(w http.ResponseWriter, req *http.Request) {
+	userID, err := getUserIDFromContext(req.Context())
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	roomID, err := uuid.Parse(req.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid room ID", http.StatusBadRequest)
+		return
+	}
+
+	// Check membership
+	isMember, err := r.db.IsRoomMember(req.Context(), roomID, userID)
+	if err != nil || !isMember {
+		http.Error(w, "Not a member of this room", http.StatusForbidden)
+		return
+	}
+
+	pins, err := r.db.GetPinnedMessages(req.Context(), roomID)
+	if err != nil {
+		r.logger.Error(req.Context(), "Failed to fetch pinned messages of room %s: %v", roomID, err)
+		http.Error(w, "Failed to fetch pinned messages", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if pins == nil {
+		pins = make([]models.PinnedMessage, 0)
+	}
+	json.NewEncoder(w).Encode(pins)
+}
+
+// publishPinChange broadcasts a stored pin or unpin to the room on every node and records it in the
+// room's history as a system message. The change is already stored, so failures are only logged.
+func (r *Router) publishPinChange(req *http.Request, roomID, userID uuid.UUID, messageID int64, eventType string) {
+	err := r.syncEngine.PublishRoomEvent(req.Context(), roomID, eventType, map[string]interface{}{
+		"message_id": messageID,
+		"user_id":    userID,
+	})
+	if err != nil {
+		r.logger.Error(req.Context(), "Failed to publish %s event for message %d: %v", eventType, messageID, err)
+	}
+
+	content, err := json.Marshal(PinEventContent{Event: eventType, MessageID: messageID})
+	if err != nil {
+		r.logger.Error(req.Context(), "Failed to marshal %s event for message %d: %v", eventType, messageID, err)
+		return
+	}
+	msg := &models.Message{
+		RoomID:      roomID,
+		UserID:      userID,
+		Content:     string(content),
+		MessageType: models.MessageTypeSystem,
+		CreatedAt:   time.Now(),
+	}
+	if err := r.messageWriter.QueueMessage(msg); err != nil {
+		r.logger.Error(req.Context(), "Failed to record %s event for message %d in room %s: %v", eventType, messageID, roomID, err)
+	}
+}
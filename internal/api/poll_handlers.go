@@ -0,0 +1,110 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// VotePollRequest represents a vote in a poll, replacing the voter's previous votes
+type VotePollRequest struct {
+	OptionIDs []int `json:"option_ids"`
+}
+
+// GetPollHandler returns a poll with its tally and the options the user voted for
+func (r *Router) GetPollHandler(w http.ResponseWriter, req *http.Request) {
+	userID, err := getUserIDFromContext(req.Context())
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	roomID, messageID, ok := parseMessagePath(w, req)
+	if !ok {
+		return
+	}
+
+	poll, err := r.roomMgr.GetPoll(req.Context(), userID, roomID, messageID)
+	if err != nil {
+		r.writeMessageActionError(w, req, "Failed to fetch poll", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(poll)
+}
+
+// VotePollHandler votes in a poll, broadcasting the new tally to the room
+func (r *Router) VotePollHandler(w http.ResponseWriter, req *http.Request) {
+	userID, err := getUserIDFromContext(req.Context())
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	roomID, messageID, ok := parseMessagePath(w, req)
+	if !ok {
+		return
+	}
+
+	var voteReq VotePollRequest
+	if err := json.NewDecoder(req.Body).Decode(&voteReq); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	poll, err := r.roomMgr.VotePoll(req.Context(), userID, roomID, messageID, voteReq.OptionIDs)
+	if err != nil {
+		r.writeMessageActionError(w, req, "Failed to vote", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(poll)
+}
+
+// RetractPollVoteHandler retracts the user's votes in a poll, broadcasting the new tally to the room
+func (r *Router) RetractPollVoteHandler(w http.ResponseWriter, req *http.Request) {
+	userID, err := getUserIDFromContext(req.Context())
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	roomID, messageID, ok := parseMessagePath(w, req)
+	if !ok {
+		return
+	}
+
+	poll, err := r.roomMgr.RetractPollVote(req.Context(), userID, roomID, messageID)
+	if err != nil {
+		r.writeMessageActionError(w, req, "Failed to retract vote", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(poll)
+}
+
+// ClosePollHandler closes a poll before its close time, freezing its results (its author, admins and
+// moderators)
+func (r *Router) ClosePollHandler(w http.ResponseWriter, req *http.Request) {
+	userID, err := getUserIDFromContext(req.Context())
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	roomID, messageID, ok := parseMessagePath(w, req)
+	if !ok {
+		return
+	}
+
+	poll, err := r.roomMgr.ClosePoll(req.Context(), userID, roomID, messageID)
+	if err != nil {
+		r.writeMessageActionError(w, req, "Failed to close poll", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(poll)
+}
@@ -3,6 +3,7 @@ package api
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
@@ -12,6 +13,7 @@ import (
 
 	"github.com/dukepan/multi-rooms-chat-back/internal/contextkey"
 	"github.com/dukepan/multi-rooms-chat-back/internal/models"
+	"github.com/dukepan/multi-rooms-chat-back/internal/rooms"
 )
 
 // CreateRoomRequest represents a create room request
@@ -54,28 +56,65 @@ func (r *Router) CreateRoomHandler(w http.ResponseWriter, req *http.Request) {
 	json.NewEncoder(w).Encode(room)
 }
 
-// GetRoomsHandler retrieves all rooms for the user
+// GetRoomsHandler retrieves all rooms for the user, with their read cursor, unread count and
+// unread mention count in each
 func (r *Router) GetRoomsHandler(w http.ResponseWriter, req *http.Request) {
-	userIDStr := req.Header.Get("X-User-ID")
-	userID, err := uuid.Parse(userIDStr)
+	userID, err := getUserIDFromContext(req.Context())
 	if err != nil {
-		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
-	rooms, err := r.db.GetRoomsByUser(req.Context(), userID)
+	rooms, err := r.db.GetUserRooms(req.Context(), userID)
 	if err != nil {
+		r.logger.Error(req.Context(), "Failed to fetch rooms of user %s: %v", userID, err)
 		http.Error(w, "Failed to fetch rooms", http.StatusInternalServerError)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	if rooms == nil {
-		rooms = make([]models.Room, 0)
+		rooms = make([]models.UserRoom, 0)
 	}
 	json.NewEncoder(w).Encode(rooms)
 }
 
+// MarkReadRequest represents moving the read cursor of a room
+type MarkReadRequest struct {
+	MessageID int64 `json:"message_id"`
+}
+
+// MarkReadHandler marks every message of a room up to a message as read, syncing the cursor to the
+// user's other devices. It responds with the resulting cursor, which never moves backwards.
+func (r *Router) MarkReadHandler(w http.ResponseWriter, req *http.Request) {
+	userID, err := getUserIDFromContext(req.Context())
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	roomID, err := uuid.Parse(req.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid room ID", http.StatusBadRequest)
+		return
+	}
+
+	var readReq MarkReadRequest
+	if err := json.NewDecoder(req.Body).Decode(&readReq); err != nil || readReq.MessageID <= 0 {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	cursor, err := r.roomMgr.MarkRead(req.Context(), userID, roomID, readReq.MessageID)
+	if err != nil {
+		r.writeMessageActionError(w, req, "Failed to mark messages read", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rooms.ReadCursorPayload{LastReadMessageID: cursor})
+}
+
 // GetRoomHandler retrieves a single room by ID
 func (r *Router) GetRoomHandler(w http.ResponseWriter, req *http.Request) {
 	userIDStr := req.Header.Get("X-User-ID")
@@ -109,12 +148,51 @@ func (r *Router) GetRoomHandler(w http.ResponseWriter, req *http.Request) {
 	json.NewEncoder(w).Encode(room)
 }
 
-// GetRoomMessagesHandler retrieves messages from a room (paginated)
+// RoomPresenceResponse represents the users currently connected to a room
+type RoomPresenceResponse struct {
+	RoomID  uuid.UUID   `json:"room_id"`
+	UserIDs []uuid.UUID `json:"user_ids"`
+}
+
+// GetRoomPresenceHandler retrieves the users currently connected to a room on any node
+func (r *Router) GetRoomPresenceHandler(w http.ResponseWriter, req *http.Request) {
+	userID, err := getUserIDFromContext(req.Context())
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	roomIDStr := req.PathValue("id")
+	roomID, err := uuid.Parse(roomIDStr)
+	if err != nil {
+		http.Error(w, "Invalid room ID", http.StatusBadRequest)
+		return
+	}
+
+	// Check membership
+	isMember, err := r.db.IsRoomMember(req.Context(), roomID, userID)
+	if err != nil || !isMember {
+		http.Error(w, "Not a member of this room", http.StatusForbidden)
+		return
+	}
+
+	userIDs, err := r.roomMgr.RoomPresence(req.Context(), roomID)
+	if err != nil {
+		r.logger.Error(req.Context(), "Failed to fetch presence of room %s: %v", roomID, err)
+		http.Error(w, "Failed to fetch presence", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(RoomPresenceResponse{RoomID: roomID, UserIDs: userIDs})
+}
+
+// GetRoomMessagesHandler retrieves messages from a room (paginated). Fetched messages count as
+// delivered to the requester.
 func (r *Router) GetRoomMessagesHandler(w http.ResponseWriter, req *http.Request) {
-	userIDStr := req.Header.Get("X-User-ID")
-	userID, err := uuid.Parse(userIDStr)
+	userID, err := getUserIDFromContext(req.Context())
 	if err != nil {
-		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
@@ -149,24 +227,39 @@ func (r *Router) GetRoomMessagesHandler(w http.ResponseWriter, req *http.Request
 		}
 	}
 
-	messages, err := r.db.GetRoomMessages(req.Context(), roomID, limit, before)
+	// Replies can be left to their threads, which roots summarize
+	excludeReplies := req.URL.Query().Get("exclude_replies") == "true"
+
+	messages, err := r.db.GetRoomMessages(req.Context(), roomID, limit, before, excludeReplies)
 	if err != nil {
 		http.Error(w, "Failed to fetch messages", http.StatusInternalServerError)
 		return
 	}
+	r.roomMgr.RecordHistoryDelivery(userID, messages)
 
-	// Enrich messages with user info
+	// Enrich messages with user info, and polls with their tally
 	enrichedMessages := make([]map[string]interface{}, len(messages))
 	for i, msg := range messages {
 		user, _ := r.db.GetUserByID(req.Context(), msg.UserID)
+		if msg.MessageType == models.MessageTypePoll {
+			if msg.Poll, err = r.db.GetPoll(req.Context(), msg.ID, userID); err != nil {
+				r.logger.Error(req.Context(), "Failed to fetch poll %d: %v", msg.ID, err)
+			}
+		}
 		enrichedMessages[i] = map[string]interface{}{
-			"id":         msg.ID,
-			"room_id":    msg.RoomID,
-			"user":       user,
-			"content":    msg.Content,
-			"type":       msg.MessageType,
-			"file_url":   msg.FileURL,
-			"created_at": msg.CreatedAt,
+			"id":          msg.ID,
+			"room_id":     msg.RoomID,
+			"user":        user,
+			"content":     msg.Content,
+			"type":        msg.MessageType,
+			"file_url":    msg.FileURL,
+			"parent_id":   msg.ParentID,
+			"thread":      msg.Thread,
+			"revision":    msg.Revision,
+			"poll":        msg.Poll,
+			"created_at":  msg.CreatedAt,
+			"ttl_seconds": msg.TTLSeconds,
+			"expires_at":  msg.ExpiresAt,
 		}
 	}
 
@@ -257,6 +350,73 @@ func (r *Router) SearchMessagesHandler(w http.ResponseWriter, req *http.Request)
 	json.NewEncoder(w).Encode(messages)
 }
 
+// MessageReceiptsResponse lists the recipients a message was delivered to and read by
+type MessageReceiptsResponse struct {
+	MessageID      int64                    `json:"message_id"`
+	RecipientCount int                      `json:"recipient_count"`
+	Delivered      []models.MessageDelivery `json:"delivered"`
+	Read           []models.MessageRead     `json:"read"`
+}
+
+// GetMessageReceiptsHandler retrieves who received and who read a message
+func (r *Router) GetMessageReceiptsHandler(w http.ResponseWriter, req *http.Request) {
+	userID, err := getUserIDFromContext(req.Context())
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	roomID, messageID, ok := parseMessagePath(w, req)
+	if !ok {
+		return
+	}
+
+	// Check membership
+	isMember, err := r.db.IsRoomMember(req.Context(), roomID, userID)
+	if err != nil || !isMember {
+		http.Error(w, "Not a member of this room", http.StatusForbidden)
+		return
+	}
+
+	summaries, err := r.db.GetReceiptSummaries(req.Context(), []int64{messageID})
+	if err != nil {
+		r.logger.Error(req.Context(), "Failed to count receipts of message %d: %v", messageID, err)
+		http.Error(w, "Failed to fetch receipts", http.StatusInternalServerError)
+		return
+	}
+	if len(summaries) == 0 || summaries[0].RoomID != roomID {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+
+	deliveries, err := r.db.GetMessageDeliveries(req.Context(), messageID)
+	if err != nil {
+		r.logger.Error(req.Context(), "Failed to fetch deliveries of message %d: %v", messageID, err)
+		http.Error(w, "Failed to fetch receipts", http.StatusInternalServerError)
+		return
+	}
+	reads, err := r.db.GetMessageReads(req.Context(), messageID)
+	if err != nil {
+		r.logger.Error(req.Context(), "Failed to fetch reads of message %d: %v", messageID, err)
+		http.Error(w, "Failed to fetch receipts", http.StatusInternalServerError)
+		return
+	}
+
+	if deliveries == nil {
+		deliveries = make([]models.MessageDelivery, 0)
+	}
+	if reads == nil {
+		reads = make([]models.MessageRead, 0)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(MessageReceiptsResponse{
+		MessageID:      messageID,
+		RecipientCount: summaries[0].RecipientCount,
+		Delivered:      deliveries,
+		Read:           reads,
+	})
+}
+
 // EditMessageRequest represents an edit message request
 type EditMessageRequest struct {
 	Content string `json:"content"`
@@ -270,46 +430,55 @@ func (r *Router) EditMessageHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	messageIDStr := req.PathValue("messageID")
-	messageID, err := strconv.ParseInt(messageIDStr, 10, 64)
-	if err != nil {
-		http.Error(w, "Invalid message ID", http.StatusBadRequest)
+	roomID, messageID, ok := parseMessagePath(w, req)
+	if !ok {
 		return
 	}
 
 	var editReq EditMessageRequest
-	if err := json.NewDecoder(req.Body).Decode(&editReq); err != nil {
+	if err := json.NewDecoder(req.Body).Decode(&editReq); err != nil || editReq.Content == "" {
 		http.Error(w, "Invalid request", http.StatusBadRequest)
 		return
 	}
 
-	// Get the message to verify ownership
-	message, err := r.db.GetMessageByID(req.Context(), messageID)
-	if err != nil || message.UserID != userID {
-		http.Error(w, "Message not found or unauthorized to edit", http.StatusForbidden)
+	// Authorization, persistence and the broadcast are shared with the WebSocket API
+	updatedMessage, err := r.roomMgr.EditMessage(req.Context(), userID, roomID, messageID, editReq.Content)
+	if err != nil {
+		r.writeMessageActionError(w, req, "Failed to edit message", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(updatedMessage)
+}
+
+// MessageRevisionsResponse lists every version of a message's content
+type MessageRevisionsResponse struct {
+	MessageID int64                    `json:"message_id"`
+	Revisions []models.MessageRevision `json:"revisions"` // Oldest first, the last one being the current content
+}
+
+// GetMessageRevisionsHandler returns the edit history of a message (its author, admins and moderators)
+func (r *Router) GetMessageRevisionsHandler(w http.ResponseWriter, req *http.Request) {
+	userID, err := getUserIDFromContext(req.Context())
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
-	// Edit message in DB
-	if err := r.db.EditMessage(req.Context(), messageID, userID, editReq.Content); err != nil {
-		http.Error(w, "Failed to edit message", http.StatusInternalServerError)
+	roomID, messageID, ok := parseMessagePath(w, req)
+	if !ok {
 		return
 	}
 
-	// Fetch the updated message to send in response and broadcast
-	updatedMessage, err := r.db.GetMessageByID(req.Context(), messageID)
+	revisions, err := r.roomMgr.GetMessageRevisions(req.Context(), userID, roomID, messageID)
 	if err != nil {
-		// Log error, but proceed with a generic success if DB update was fine
-		json.NewEncoder(w).Encode(map[string]string{"message": "Message edited successfully, but failed to fetch updated message."})
+		r.writeMessageActionError(w, req, "Failed to fetch message revisions", err)
 		return
 	}
 
-	// Publish message update event to other nodes (via syncEngine)
-	// This will then trigger broadcasting to clients in the room
-	r.syncEngine.PublishMessage(req.Context(), updatedMessage)
-
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(updatedMessage)
+	json.NewEncoder(w).Encode(MessageRevisionsResponse{MessageID: messageID, Revisions: revisions})
 }
 
 // SoftDeleteMessageHandler handles message soft deletion
@@ -320,31 +489,16 @@ func (r *Router) SoftDeleteMessageHandler(w http.ResponseWriter, req *http.Reque
 		return
 	}
 
-	messageIDStr := req.PathValue("messageID")
-	messageID, err := strconv.ParseInt(messageIDStr, 10, 64)
-	if err != nil {
-		http.Error(w, "Invalid message ID", http.StatusBadRequest)
-		return
-	}
-
-	// Get the message to verify ownership
-	message, err := r.db.GetMessageByID(req.Context(), messageID)
-	if err != nil || message.UserID != userID {
-		http.Error(w, "Message not found or unauthorized to delete", http.StatusForbidden)
+	roomID, messageID, ok := parseMessagePath(w, req)
+	if !ok {
 		return
 	}
 
-	// Soft delete message in DB
-	if err := r.db.SoftDeleteMessage(req.Context(), messageID, userID); err != nil {
-		http.Error(w, "Failed to delete message", http.StatusInternalServerError)
+	if _, err := r.roomMgr.DeleteMessage(req.Context(), userID, roomID, messageID); err != nil {
+		r.writeMessageActionError(w, req, "Failed to delete message", err)
 		return
 	}
 
-	// Publish message update event (soft delete) to other nodes (via syncEngine)
-	// This will then trigger broadcasting to clients in the room
-	// For soft delete, we'll send a simplified message indicating deletion
-	r.syncEngine.PublishMessage(req.Context(), &models.Message{ID: messageID, RoomID: message.RoomID, DeletedAt: &message.CreatedAt})
-
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{"message": "Message deleted successfully"})
 }
@@ -362,46 +516,22 @@ func (r *Router) AddReactionHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	roomIDStr := req.PathValue("id")
-	roomID, err := uuid.Parse(roomIDStr)
-	if err != nil {
-		http.Error(w, "Invalid room ID", http.StatusBadRequest)
-		return
-	}
-
-	messageIDStr := req.PathValue("messageID")
-	messageID, err := strconv.ParseInt(messageIDStr, 10, 64)
-	if err != nil {
-		http.Error(w, "Invalid message ID", http.StatusBadRequest)
+	roomID, messageID, ok := parseMessagePath(w, req)
+	if !ok {
 		return
 	}
 
 	var addReq AddReactionRequest
-	if err := json.NewDecoder(req.Body).Decode(&addReq); err != nil {
+	if err := json.NewDecoder(req.Body).Decode(&addReq); err != nil || addReq.Emoji == "" {
 		http.Error(w, "Invalid request", http.StatusBadRequest)
 		return
 	}
 
-	// Check room membership
-	isMember, err := r.db.IsRoomMember(req.Context(), roomID, userID)
-	if err != nil || !isMember {
-		http.Error(w, "Not a member of this room", http.StatusForbidden)
-		return
-	}
-
-	// Add reaction to DB
-	if err := r.db.AddMessageReaction(req.Context(), messageID, userID, addReq.Emoji); err != nil {
-		http.Error(w, "Failed to add reaction", http.StatusInternalServerError)
+	if err := r.roomMgr.AddReaction(req.Context(), userID, roomID, messageID, addReq.Emoji); err != nil {
+		r.writeMessageActionError(w, req, "Failed to add reaction", err)
 		return
 	}
 
-	// Publish reaction update event
-	r.syncEngine.PublishRoomEvent(req.Context(), roomID, "reaction_added", map[string]interface{}{
-		"message_id": messageID,
-		"user_id":    userID,
-		"emoji":      addReq.Emoji,
-	})
-
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{"message": "Reaction added successfully"})
 }
@@ -414,17 +544,8 @@ func (r *Router) RemoveReactionHandler(w http.ResponseWriter, req *http.Request)
 		return
 	}
 
-	roomIDStr := req.PathValue("id")
-	roomID, err := uuid.Parse(roomIDStr)
-	if err != nil {
-		http.Error(w, "Invalid room ID", http.StatusBadRequest)
-		return
-	}
-
-	messageIDStr := req.PathValue("messageID")
-	messageID, err := strconv.ParseInt(messageIDStr, 10, 64)
-	if err != nil {
-		http.Error(w, "Invalid message ID", http.StatusBadRequest)
+	roomID, messageID, ok := parseMessagePath(w, req)
+	if !ok {
 		return
 	}
 
@@ -434,28 +555,59 @@ func (r *Router) RemoveReactionHandler(w http.ResponseWriter, req *http.Request)
 		return
 	}
 
-	// Check room membership
-	isMember, err := r.db.IsRoomMember(req.Context(), roomID, userID)
-	if err != nil || !isMember {
-		http.Error(w, "Not a member of this room", http.StatusForbidden)
+	if err := r.roomMgr.RemoveReaction(req.Context(), userID, roomID, messageID, emoji); err != nil {
+		r.writeMessageActionError(w, req, "Failed to remove reaction", err)
 		return
 	}
 
-	// Remove reaction from DB
-	if err := r.db.RemoveMessageReaction(req.Context(), messageID, userID, emoji); err != nil {
-		http.Error(w, "Failed to remove reaction", http.StatusInternalServerError)
-		return
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Reaction removed successfully"})
+}
+
+// parseMessagePath parses the room and message IDs of a /rooms/{id}/messages/{messageID} path,
+// writing a 400 response if either is invalid.
+func parseMessagePath(w http.ResponseWriter, req *http.Request) (uuid.UUID, int64, bool) {
+	roomID, err := uuid.Parse(req.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid room ID", http.StatusBadRequest)
+		return uuid.Nil, 0, false
 	}
 
-	// Publish reaction update event
-	r.syncEngine.PublishRoomEvent(req.Context(), roomID, "reaction_removed", map[string]interface{}{
-		"message_id": messageID,
-		"user_id":    userID,
-		"emoji":      emoji,
-	})
+	messageID, err := strconv.ParseInt(req.PathValue("messageID"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid message ID", http.StatusBadRequest)
+		return uuid.Nil, 0, false
+	}
+	return roomID, messageID, true
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"message": "Reaction removed successfully"})
+// writeMessageActionError writes the HTTP response for an error returned by a message action.
+func (r *Router) writeMessageActionError(w http.ResponseWriter, req *http.Request, failure string, err error) {
+	switch {
+	case errors.Is(err, rooms.ErrMessageNotFound):
+		http.Error(w, "Message not found", http.StatusNotFound)
+	case errors.Is(err, rooms.ErrNotRoomMember):
+		http.Error(w, "Not a member of this room", http.StatusForbidden)
+	case errors.Is(err, rooms.ErrForbidden):
+		http.Error(w, "Unauthorized to modify this message", http.StatusForbidden)
+	case errors.Is(err, rooms.ErrRevisionsHidden):
+		http.Error(w, "Forbidden: only the author, admins and moderators can view revisions", http.StatusForbidden)
+	case errors.Is(err, rooms.ErrScheduledMessageNotFound):
+		http.Error(w, "Scheduled message not found or already sent", http.StatusNotFound)
+	case errors.Is(err, rooms.ErrInvalidSendAt):
+		http.Error(w, "send_at must be in the future and at most a year ahead", http.StatusBadRequest)
+	case errors.Is(err, rooms.ErrUndoSendFixed):
+		http.Error(w, "send_at of a message held for undo send cannot be changed", http.StatusConflict)
+	case errors.Is(err, rooms.ErrPollNotFound):
+		http.Error(w, "Poll not found", http.StatusNotFound)
+	case errors.Is(err, rooms.ErrPollClosed):
+		http.Error(w, "Poll is closed", http.StatusConflict)
+	case errors.Is(err, rooms.ErrInvalidPollVote):
+		http.Error(w, "Invalid vote: choose one option, or one or more distinct options in a multiple choice poll", http.StatusBadRequest)
+	default:
+		r.logger.Error(req.Context(), "%s: %v", failure, err)
+		http.Error(w, failure, http.StatusInternalServerError)
+	}
 }
 
 // getUserIDFromContext is a helper to extract userID from context
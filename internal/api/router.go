@@ -1,8 +1,10 @@
 package api
 
 import (
+	"context"
 	"fmt"
 	"net/http"
+	"net/netip"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
@@ -29,6 +31,9 @@ type Router struct {
 	fileStore     *filestore.LocalFileStore
 	clamAVClient  *filescan.ClamAVClient
 	logger        *utils.Logger // Add logger field
+
+	// trustedProxies are the proxies whose X-Forwarded-For is used to find the client's address
+	trustedProxies []netip.Prefix
 }
 
 // NewRouter creates a new HTTP router with configured handlers and middleware
@@ -49,6 +54,11 @@ func NewRouter(database *db.Database, redisCache *cache.Cache, roomMgr *rooms.Ma
 		clamAVClient:  clamAVClient,
 		logger:        logger,
 	}
+	trustedProxies, err := ParseTrustedProxies(cfg.TrustedProxies)
+	if err != nil {
+		logger.Fatal(context.Background(), "Invalid trusted proxies: %v", err)
+	}
+	r.trustedProxies = trustedProxies
 
 	// Apply Request ID middleware to all requests
 	routerWithMiddleware := middleware.RequestIDMiddleware(r.mux)
@@ -59,23 +69,52 @@ func NewRouter(database *db.Database, redisCache *cache.Cache, roomMgr *rooms.Ma
 	// Public endpoints
 	r.mux.HandleFunc("/auth/signup", r.SignupHandler)
 	r.mux.HandleFunc("/auth/login", r.LoginHandler)
+	r.mux.HandleFunc("POST /auth/logout", r.LogoutHandler)
 	r.mux.HandleFunc("/healthz", r.HealthzHandler)
 	r.mux.Handle("/metrics", promhttp.Handler()) // Prometheus metrics endpoint
 	// Serve static files from local storage
 	r.mux.Handle(fmt.Sprintf("%s/", cfg.BaseFileURL), http.StripPrefix(cfg.BaseFileURL, http.FileServer(http.Dir(cfg.FileStoragePath))))
 
 	// Protected endpoints with AuthMiddleware and RateLimiter
-	r.mux.Handle("/rooms", r.AuthMiddleware(rateLimiter.Middleware(http.HandlerFunc(r.GetRoomsHandler))))
-	r.mux.Handle("/rooms", r.AuthMiddleware(rateLimiter.Middleware(http.HandlerFunc(r.CreateRoomHandler))))
+	r.mux.Handle("GET /rooms", r.AuthMiddleware(rateLimiter.Middleware(http.HandlerFunc(r.GetRoomsHandler))))
+	r.mux.Handle("POST /rooms", r.AuthMiddleware(rateLimiter.Middleware(http.HandlerFunc(r.CreateRoomHandler))))
 	r.mux.Handle("/rooms/{id}", r.AuthMiddleware(rateLimiter.Middleware(http.HandlerFunc(r.GetRoomHandler))))
 	r.mux.Handle("/rooms/{id}/messages", r.AuthMiddleware(rateLimiter.Middleware(http.HandlerFunc(r.GetRoomMessagesHandler))))
+	r.mux.Handle("POST /rooms/{id}/read", r.AuthMiddleware(rateLimiter.Middleware(http.HandlerFunc(r.MarkReadHandler))))
+	r.mux.Handle("PUT /rooms/{id}/message-ttl", r.AuthMiddleware(rateLimiter.Middleware(http.HandlerFunc(r.SetMessageTTLHandler))))
+	r.mux.Handle("GET /rooms/{id}/pins", r.AuthMiddleware(rateLimiter.Middleware(http.HandlerFunc(r.GetPinsHandler))))
+	r.mux.Handle("GET /rooms/{id}/presence", r.AuthMiddleware(rateLimiter.Middleware(http.HandlerFunc(r.GetRoomPresenceHandler))))
+	// Server-Sent Events and long-polling fallbacks for clients that cannot open a WebSocket
+	r.mux.Handle("GET /rooms/{id}/events", r.AuthMiddleware(rateLimiter.Middleware(http.HandlerFunc(r.RoomEventsHandler))))
+	r.mux.Handle("GET /rooms/{id}/events/poll", r.AuthMiddleware(rateLimiter.Middleware(http.HandlerFunc(r.PollRoomEventsHandler))))
+	r.mux.Handle("POST /rooms/{id}/members", r.AuthMiddleware(rateLimiter.Middleware(http.HandlerFunc(r.AddMemberHandler))))
+	r.mux.Handle("DELETE /rooms/{id}/members/{user_id}", r.AuthMiddleware(rateLimiter.Middleware(http.HandlerFunc(r.RemoveMemberHandler))))
+	r.mux.Handle("POST /rooms/{id}/bans", r.AuthMiddleware(rateLimiter.Middleware(http.HandlerFunc(r.BanMemberHandler))))
+	r.mux.Handle("DELETE /rooms/{id}/bans/{user_id}", r.AuthMiddleware(rateLimiter.Middleware(http.HandlerFunc(r.UnbanMemberHandler))))
 	r.mux.Handle("/rooms/{id}/search", r.AuthMiddleware(rateLimiter.Middleware(http.HandlerFunc(r.SearchMessagesHandler))))
-	r.mux.Handle("/rooms/{id}/messages/{messageID}", r.AuthMiddleware(rateLimiter.Middleware(http.HandlerFunc(r.EditMessageHandler))))
-	r.mux.Handle("/rooms/{id}/messages/{messageID}", r.AuthMiddleware(rateLimiter.Middleware(http.HandlerFunc(r.SoftDeleteMessageHandler))))
-	r.mux.Handle("/rooms/{id}/messages/{messageID}/reactions", r.AuthMiddleware(rateLimiter.Middleware(http.HandlerFunc(r.AddReactionHandler))))
-	r.mux.Handle("/rooms/{id}/messages/{messageID}/reactions/{emoji}", r.AuthMiddleware(rateLimiter.Middleware(http.HandlerFunc(r.RemoveReactionHandler))))
+	r.mux.Handle("PATCH /rooms/{id}/messages/{messageID}", r.AuthMiddleware(rateLimiter.Middleware(http.HandlerFunc(r.EditMessageHandler))))
+	r.mux.Handle("DELETE /rooms/{id}/messages/{messageID}", r.AuthMiddleware(rateLimiter.Middleware(http.HandlerFunc(r.SoftDeleteMessageHandler))))
+	r.mux.Handle("GET /rooms/{id}/messages/{messageID}/receipts", r.AuthMiddleware(rateLimiter.Middleware(http.HandlerFunc(r.GetMessageReceiptsHandler))))
+	r.mux.Handle("GET /rooms/{id}/messages/{messageID}/revisions", r.AuthMiddleware(rateLimiter.Middleware(http.HandlerFunc(r.GetMessageRevisionsHandler))))
+	r.mux.Handle("GET /rooms/{id}/messages/{messageID}/thread", r.AuthMiddleware(rateLimiter.Middleware(http.HandlerFunc(r.GetThreadHandler))))
+	r.mux.Handle("POST /rooms/{id}/messages/{messageID}/thread/follow", r.AuthMiddleware(rateLimiter.Middleware(http.HandlerFunc(r.FollowThreadHandler))))
+	r.mux.Handle("DELETE /rooms/{id}/messages/{messageID}/thread/follow", r.AuthMiddleware(rateLimiter.Middleware(http.HandlerFunc(r.UnfollowThreadHandler))))
+	r.mux.Handle("GET /rooms/{id}/messages/{messageID}/poll", r.AuthMiddleware(rateLimiter.Middleware(http.HandlerFunc(r.GetPollHandler))))
+	r.mux.Handle("POST /rooms/{id}/messages/{messageID}/poll/votes", r.AuthMiddleware(rateLimiter.Middleware(http.HandlerFunc(r.VotePollHandler))))
+	r.mux.Handle("DELETE /rooms/{id}/messages/{messageID}/poll/votes", r.AuthMiddleware(rateLimiter.Middleware(http.HandlerFunc(r.RetractPollVoteHandler))))
+	r.mux.Handle("POST /rooms/{id}/messages/{messageID}/poll/close", r.AuthMiddleware(rateLimiter.Middleware(http.HandlerFunc(r.ClosePollHandler))))
+	r.mux.Handle("POST /rooms/{id}/messages/{messageID}/pin", r.AuthMiddleware(rateLimiter.Middleware(http.HandlerFunc(r.PinMessageHandler))))
+	r.mux.Handle("DELETE /rooms/{id}/messages/{messageID}/pin", r.AuthMiddleware(rateLimiter.Middleware(http.HandlerFunc(r.UnpinMessageHandler))))
+	r.mux.Handle("POST /rooms/{id}/messages/{messageID}/reactions", r.AuthMiddleware(rateLimiter.Middleware(http.HandlerFunc(r.AddReactionHandler))))
+	r.mux.Handle("DELETE /rooms/{id}/messages/{messageID}/reactions/{emoji}", r.AuthMiddleware(rateLimiter.Middleware(http.HandlerFunc(r.RemoveReactionHandler))))
+	r.mux.Handle("GET /me/mentions", r.AuthMiddleware(rateLimiter.Middleware(http.HandlerFunc(r.GetMentionsHandler))))
+	r.mux.Handle("POST /me/mentions/seen", r.AuthMiddleware(rateLimiter.Middleware(http.HandlerFunc(r.MarkMentionsSeenHandler))))
+	r.mux.Handle("GET /me/scheduled-messages", r.AuthMiddleware(rateLimiter.Middleware(http.HandlerFunc(r.GetScheduledMessagesHandler))))
+	r.mux.Handle("PATCH /me/scheduled-messages/{scheduledID}", r.AuthMiddleware(rateLimiter.Middleware(http.HandlerFunc(r.EditScheduledMessageHandler))))
+	r.mux.Handle("DELETE /me/scheduled-messages/{scheduledID}", r.AuthMiddleware(rateLimiter.Middleware(http.HandlerFunc(r.CancelScheduledMessageHandler))))
 	r.mux.Handle("/files/upload", r.AuthMiddleware(rateLimiter.Middleware(http.HandlerFunc(r.UploadFileHandler))))
 	// WebSocket endpoint will handle rate limiting internally or at a different layer if needed
+	r.mux.Handle("POST /ws/ticket", r.AuthMiddleware(rateLimiter.Middleware(http.HandlerFunc(r.WSTicketHandler))))
 	r.mux.Handle("/ws", http.HandlerFunc(r.WebSocketHandler))
 
 	return routerWithMiddleware
@@ -0,0 +1,115 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/dukepan/multi-rooms-chat-back/internal/models"
+)
+
+// EditScheduledMessageRequest represents changing a pending send. Omitted fields are left unchanged.
+type EditScheduledMessageRequest struct {
+	Content *string    `json:"content"`
+	SendAt  *time.Time `json:"send_at"`
+}
+
+// GetScheduledMessagesHandler lists the authenticated user's pending sends, soonest first, optionally
+// in a single room
+func (r *Router) GetScheduledMessagesHandler(w http.ResponseWriter, req *http.Request) {
+	userID, err := getUserIDFromContext(req.Context())
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	roomID := uuid.Nil
+	if roomIDStr := req.URL.Query().Get("room_id"); roomIDStr != "" {
+		if roomID, err = uuid.Parse(roomIDStr); err != nil {
+			http.Error(w, "Invalid room ID", http.StatusBadRequest)
+			return
+		}
+	}
+
+	scheduled, err := r.db.GetScheduledMessages(req.Context(), userID, roomID)
+	if err != nil {
+		r.logger.Error(req.Context(), "Failed to fetch scheduled messages of user %s: %v", userID, err)
+		http.Error(w, "Failed to fetch scheduled messages", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if scheduled == nil {
+		scheduled = make([]models.ScheduledMessage, 0)
+	}
+	json.NewEncoder(w).Encode(scheduled)
+}
+
+// EditScheduledMessageHandler changes the content or send time of a pending send
+func (r *Router) EditScheduledMessageHandler(w http.ResponseWriter, req *http.Request) {
+	userID, err := getUserIDFromContext(req.Context())
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	id, ok := parseScheduledMessageID(w, req)
+	if !ok {
+		return
+	}
+
+	var editReq EditScheduledMessageRequest
+	if err := json.NewDecoder(req.Body).Decode(&editReq); err != nil || (editReq.Content == nil && editReq.SendAt == nil) {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if editReq.Content != nil && *editReq.Content == "" {
+		http.Error(w, "Content cannot be empty", http.StatusBadRequest)
+		return
+	}
+
+	scheduled, err := r.roomMgr.EditScheduledMessage(req.Context(), userID, id, editReq.Content, editReq.SendAt)
+	if err != nil {
+		r.writeMessageActionError(w, req, "Failed to edit scheduled message", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(scheduled)
+}
+
+// CancelScheduledMessageHandler cancels a pending send, which also undoes sending a message within
+// the undo send window
+func (r *Router) CancelScheduledMessageHandler(w http.ResponseWriter, req *http.Request) {
+	userID, err := getUserIDFromContext(req.Context())
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	id, ok := parseScheduledMessageID(w, req)
+	if !ok {
+		return
+	}
+
+	if err := r.roomMgr.CancelScheduledMessage(req.Context(), userID, id); err != nil {
+		r.writeMessageActionError(w, req, "Failed to cancel scheduled message", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Scheduled message canceled successfully"})
+}
+
+// parseScheduledMessageID parses the scheduled message ID path value, writing the error response if it is invalid.
+func parseScheduledMessageID(w http.ResponseWriter, req *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(req.PathValue("scheduledID"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid scheduled message ID", http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
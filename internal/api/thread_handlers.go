@@ -0,0 +1,82 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// GetThreadHandler retrieves the thread a message belongs to: its root, with the reply count and
+// latest reply, and its replies oldest first
+func (r *Router) GetThreadHandler(w http.ResponseWriter, req *http.Request) {
+	userID, err := getUserIDFromContext(req.Context())
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	roomID, messageID, ok := parseMessagePath(w, req)
+	if !ok {
+		return
+	}
+
+	// Parse query parameters
+	limit := 50
+	if limitStr := req.URL.Query().Get("limit"); limitStr != "" {
+		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 && l <= 100 {
+			limit = l
+		}
+	}
+
+	after := int64(0)
+	if afterStr := req.URL.Query().Get("after"); afterStr != "" {
+		a, err := strconv.ParseInt(afterStr, 10, 64)
+		if err != nil || a < 0 {
+			http.Error(w, "Invalid after", http.StatusBadRequest)
+			return
+		}
+		after = a
+	}
+
+	thread, err := r.roomMgr.GetThread(req.Context(), userID, roomID, messageID, after, limit)
+	if err != nil {
+		r.writeMessageActionError(w, req, "Failed to fetch thread", err)
+		return
+	}
+	r.roomMgr.RecordHistoryDelivery(userID, thread.Replies)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(thread)
+}
+
+// FollowThreadHandler makes the user follow the thread a message belongs to, so that they are notified
+// of its new replies
+func (r *Router) FollowThreadHandler(w http.ResponseWriter, req *http.Request) {
+	r.setThreadFollow(w, req, true)
+}
+
+// UnfollowThreadHandler stops notifying the user of the new replies to the thread a message belongs to
+func (r *Router) UnfollowThreadHandler(w http.ResponseWriter, req *http.Request) {
+	r.setThreadFollow(w, req, false)
+}
+
+func (r *Router) setThreadFollow(w http.ResponseWriter, req *http.Request, following bool) {
+	userID, err := getUserIDFromContext(req.Context())
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	roomID, messageID, ok := parseMessagePath(w, req)
+	if !ok {
+		return
+	}
+
+	if err := r.roomMgr.SetThreadFollow(req.Context(), userID, roomID, messageID, following); err != nil {
+		r.writeMessageActionError(w, req, "Failed to update thread follow", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"following": following})
+}
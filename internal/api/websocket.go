@@ -1,21 +1,40 @@
 package api
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
 
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/codes"
 
+	"github.com/dukepan/multi-rooms-chat-back/internal/auth"
+	"github.com/dukepan/multi-rooms-chat-back/internal/cache"
+	"github.com/dukepan/multi-rooms-chat-back/internal/contextkey"
 	"github.com/dukepan/multi-rooms-chat-back/internal/rooms"
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 )
 
+// maxDeviceIDLength is the maximum length of the device_id a client identifies its device with.
+const maxDeviceIDLength = 64
+
+// wsTokenProtocolPrefix marks a Sec-WebSocket-Protocol entry carrying the client's JWT, for clients that
+// cannot set headers on the upgrade request. The server never selects it as the subprotocol.
+const wsTokenProtocolPrefix = "bearer."
+
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
+	Subprotocols:    rooms.SupportedProtocols,
 	CheckOrigin: func(r *http.Request) bool {
 		// In production, validate origin more strictly
 		return true
@@ -27,46 +46,67 @@ func (r *Router) WebSocketHandler(w http.ResponseWriter, req *http.Request) {
 	ctx, span := otel.Tracer("websocket-server").Start(req.Context(), "WebSocketConnection")
 	defer span.End()
 
-	// Extract JWT from query parameter
-	token := req.URL.Query().Get("token")
-	if token == "" {
-		http.Error(w, "Missing token", http.StatusUnauthorized)
-		span.SetStatus(codes.Error, "Missing token")
+	// A draining node sends new connections to the other nodes
+	if r.roomMgr.Draining() {
+		writeDraining(w)
+		span.SetStatus(codes.Error, "Server draining")
 		return
 	}
 
-	// Validate token
-	claims, err := r.jwtMgr.ValidateToken(token)
+	userID, tokenInfo, err := r.authenticateUpgrade(ctx, req)
 	if err != nil {
-		http.Error(w, "Invalid token", http.StatusUnauthorized)
-		span.SetStatus(codes.Error, fmt.Sprintf("Invalid token: %v", err))
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		span.SetStatus(codes.Error, fmt.Sprintf("Authentication failed: %v", err))
 		return
 	}
 
-	span.SetAttributes(attribute.String("user.id", claims.UserID.String()))
+	span.SetAttributes(attribute.String("user.id", userID.String()))
 
-	// Extract room ID from query parameter
-	roomIDStr := req.URL.Query().Get("room_id")
-	if roomIDStr == "" {
-		http.Error(w, "Missing room_id", http.StatusBadRequest)
-		span.SetStatus(codes.Error, "Missing room_id")
+	// device_id groups the connections of one device, so the user stays online while any device is connected
+	deviceID := req.URL.Query().Get("device_id")
+	if len(deviceID) > maxDeviceIDLength {
+		http.Error(w, "Invalid device_id", http.StatusBadRequest)
+		span.SetStatus(codes.Error, "Invalid device_id")
 		return
 	}
 
-	roomID, err := uuid.Parse(roomIDStr)
-	if err != nil {
-		http.Error(w, "Invalid room_id", http.StatusBadRequest)
-		span.SetStatus(codes.Error, fmt.Sprintf("Invalid room_id: %v", err))
-		return
-	}
+	// A room can optionally be given at connect time for clients that only need a single room.
+	// Any number of further rooms can be subscribed to over the connection itself.
+	// last_event_id resumes that room, replaying the events missed since then.
+	var initialRoomID uuid.UUID
+	var lastEventID int64
+	if roomIDStr := req.URL.Query().Get("room_id"); roomIDStr != "" {
+		initialRoomID, err = uuid.Parse(roomIDStr)
+		if err != nil {
+			http.Error(w, "Invalid room_id", http.StatusBadRequest)
+			span.SetStatus(codes.Error, fmt.Sprintf("Invalid room_id: %v", err))
+			return
+		}
+
+		span.SetAttributes(attribute.String("room.id", initialRoomID.String()))
 
-	span.SetAttributes(attribute.String("room.id", roomID.String()))
+		if lastEventIDStr := req.URL.Query().Get("last_event_id"); lastEventIDStr != "" {
+			lastEventID, err = strconv.ParseInt(lastEventIDStr, 10, 64)
+			if err != nil || lastEventID < 0 {
+				http.Error(w, "Invalid last_event_id", http.StatusBadRequest)
+				span.SetStatus(codes.Error, fmt.Sprintf("Invalid last_event_id: %v", err))
+				return
+			}
+		}
+
+		// Check room membership
+		isMember, err := r.db.IsRoomMember(ctx, initialRoomID, userID)
+		if err != nil || !isMember {
+			http.Error(w, "Not a member of this room", http.StatusForbidden)
+			span.SetStatus(codes.Error, fmt.Sprintf("Not a member of room %s: %v", initialRoomID, err))
+			return
+		}
+	}
 
-	// Check room membership
-	isMember, err := r.db.IsRoomMember(ctx, roomID, claims.UserID)
-	if err != nil || !isMember {
-		http.Error(w, "Not a member of this room", http.StatusForbidden)
-		span.SetStatus(codes.Error, fmt.Sprintf("Not a member of room %s: %v", roomID, err))
+	// Negotiate the protocol version. Clients that offer no subprotocol get the current version.
+	if !supportsOfferedProtocol(req) {
+		http.Error(w, "Unsupported protocol version", http.StatusBadRequest)
+		span.SetStatus(codes.Error, "Unsupported protocol version")
 		return
 	}
 
@@ -76,15 +116,221 @@ func (r *Router) WebSocketHandler(w http.ResponseWriter, req *http.Request) {
 		span.SetStatus(codes.Error, fmt.Sprintf("Failed to upgrade WebSocket connection: %v", err))
 		return
 	}
-	defer conn.Close()
 
+	span.SetAttributes(attribute.String("websocket.protocol", conn.Subprotocol()))
 	span.SetStatus(codes.Ok, "WebSocket connection established")
 
-	// Create and start client
-	room := r.roomMgr.GetOrCreateRoom(roomID)
-	client := rooms.NewClient(room, conn, claims.UserID, r.messageWriter)
+	// Create and start client. The connection is owned by the client's pumps from here on.
+	client := rooms.NewClient(r.roomMgr, conn, userID, deviceID, tokenInfo, r.messageWriter)
 	client.Start()
 
-	// Keep connection alive
-	select {}
+	if initialRoomID != uuid.Nil {
+		if _, err := client.Subscribe(context.Background(), initialRoomID, lastEventID); err != nil {
+			r.logger.Error(ctx, "Failed to subscribe to room %s: %v", initialRoomID, err)
+			client.SendError(rooms.FrameSubscribe, initialRoomID, err)
+		}
+	}
+}
+
+// WSTicketRequest is the optional body of a WebSocket ticket request
+type WSTicketRequest struct {
+	// BindIP restricts the ticket to the address it was requested from
+	BindIP bool `json:"bind_ip"`
+}
+
+// WSTicketResponse carries a WebSocket ticket, passed to /ws as ?ticket=
+type WSTicketResponse struct {
+	Ticket    string `json:"ticket"`
+	ExpiresIn int    `json:"expires_in"` // seconds
+}
+
+// WSTicketHandler issues a short-lived, single-use ticket for opening a WebSocket connection, so that
+// browsers do not have to put their token in the connection URL
+func (r *Router) WSTicketHandler(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	claims, ok := ctx.Value(contextkey.ContextKeyClaims).(*auth.Claims)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var ticketReq WSTicketRequest
+	if req.ContentLength != 0 {
+		if err := json.NewDecoder(req.Body).Decode(&ticketReq); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	ticket := cache.WSTicket{UserID: claims.UserID, TokenID: claims.ID}
+	if claims.ExpiresAt != nil {
+		ticket.TokenExpiresAt = claims.ExpiresAt.Time
+	}
+	if ticketReq.BindIP {
+		ticket.IP = r.clientIP(req)
+	}
+
+	ttl := time.Duration(r.cfg.WSTicketTTLSeconds) * time.Second
+	ticketID, err := r.cache.IssueWSTicket(ctx, ticket, ttl)
+	if err != nil {
+		r.logger.Error(ctx, "Failed to issue WebSocket ticket for user %s: %v", claims.UserID, err)
+		http.Error(w, "Failed to issue ticket", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(WSTicketResponse{Ticket: ticketID, ExpiresIn: r.cfg.WSTicketTTLSeconds})
+}
+
+// authenticateUpgrade identifies the user opening a WebSocket connection and the token the connection
+// is bound to. Credentials are taken, in order, from a ?ticket= issued by WSTicketHandler, an
+// Authorization header, a "bearer.<jwt>" entry in Sec-WebSocket-Protocol, and the deprecated ?token=.
+func (r *Router) authenticateUpgrade(ctx context.Context, req *http.Request) (uuid.UUID, rooms.TokenInfo, error) {
+	if ticketID := req.URL.Query().Get("ticket"); ticketID != "" {
+		ticket, err := r.cache.RedeemWSTicket(ctx, ticketID)
+		if err != nil {
+			return uuid.Nil, rooms.TokenInfo{}, err
+		}
+		if ticket == nil {
+			return uuid.Nil, rooms.TokenInfo{}, errors.New("invalid or expired ticket")
+		}
+		if ticket.IP != "" && ticket.IP != r.clientIP(req) {
+			return uuid.Nil, rooms.TokenInfo{}, errors.New("ticket was issued to another address")
+		}
+		// The token the ticket was issued for may have been revoked since
+		revoked, err := r.cache.IsTokenRevoked(ctx, ticket.TokenID)
+		if err != nil {
+			return uuid.Nil, rooms.TokenInfo{}, err
+		}
+		if revoked {
+			return uuid.Nil, rooms.TokenInfo{}, errors.New("token has been revoked")
+		}
+		return ticket.UserID, rooms.TokenInfo{ID: ticket.TokenID, ExpiresAt: ticket.TokenExpiresAt}, nil
+	}
+
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		for _, protocol := range websocket.Subprotocols(req) {
+			if strings.HasPrefix(protocol, wsTokenProtocolPrefix) {
+				token = strings.TrimPrefix(protocol, wsTokenProtocolPrefix)
+				break
+			}
+		}
+	}
+	if token == "" {
+		token = req.URL.Query().Get("token")
+	}
+	if token == "" {
+		return uuid.Nil, rooms.TokenInfo{}, errors.New("missing credentials")
+	}
+
+	claims, err := r.authenticate(ctx, token)
+	if err != nil {
+		return uuid.Nil, rooms.TokenInfo{}, err
+	}
+	tokenInfo := rooms.TokenInfo{ID: claims.ID}
+	if claims.ExpiresAt != nil {
+		tokenInfo.ExpiresAt = claims.ExpiresAt.Time
+	}
+	return claims.UserID, tokenInfo, nil
+}
+
+// ParseTrustedProxies parses the proxies whose X-Forwarded-For is trusted, written as comma-separated
+// IP addresses or CIDR ranges.
+func ParseTrustedProxies(s string) ([]netip.Prefix, error) {
+	var proxies []netip.Prefix
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if strings.Contains(entry, "/") {
+			prefix, err := netip.ParsePrefix(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy range %q: %w", entry, err)
+			}
+			proxies = append(proxies, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy address %q: %w", entry, err)
+		}
+		addr = addr.Unmap()
+		proxies = append(proxies, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return proxies, nil
+}
+
+// clientIP returns the address of the client. X-Forwarded-For is only honoured for requests coming from
+// a trusted proxy, and then the client is the rightmost address in it that is not a trusted proxy, since
+// the addresses to its left are whatever the client sent.
+func (r *Router) clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	if !r.isTrustedProxy(host) {
+		return host
+	}
+
+	var forwarded []string
+	for _, value := range req.Header.Values("X-Forwarded-For") {
+		forwarded = append(forwarded, strings.Split(value, ",")...)
+	}
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr := strings.TrimSpace(forwarded[i])
+		if addr == "" {
+			continue
+		}
+		if !r.isTrustedProxy(addr) {
+			return addr
+		}
+		host = addr
+	}
+	// Every hop is a trusted proxy, so the leftmost one is as close to the client as it gets
+	return host
+}
+
+// isTrustedProxy reports whether addr is one of the configured trusted proxies.
+func (r *Router) isTrustedProxy(addr string) bool {
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return false
+	}
+	ip = ip.Unmap()
+	for _, proxy := range r.trustedProxies {
+		if proxy.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeDraining rejects a connection because the node is draining, asking the client to retry shortly.
+func writeDraining(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", "1")
+	http.Error(w, "Server is draining, reconnect shortly", http.StatusServiceUnavailable)
+}
+
+// supportsOfferedProtocol reports whether the server speaks at least one of the subprotocols offered in
+// the Sec-WebSocket-Protocol header. A request that offers none, other than a token, is accepted.
+func supportsOfferedProtocol(req *http.Request) bool {
+	offered := websocket.Subprotocols(req)
+	if len(offered) == 0 {
+		return true
+	}
+	offeredVersion := false
+	for _, protocol := range offered {
+		if strings.HasPrefix(protocol, wsTokenProtocolPrefix) {
+			continue
+		}
+		offeredVersion = true
+		if _, ok := rooms.ProtocolVersionFor(protocol); ok && protocol != "" {
+			return true
+		}
+	}
+	return !offeredVersion
 }
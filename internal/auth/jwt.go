@@ -63,6 +63,7 @@ func (jm *JWTManager) GenerateToken(userID uuid.UUID, username, email string, ex
 		Username: username,
 		Email:    email,
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.NewString(), // Lets the token be revoked
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(expiresIn)),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 			Issuer:    "gochat",
@@ -25,6 +25,12 @@ type PresenceState struct {
 	Status      string    `json:"status"`
 	LastSeen    time.Time `json:"last_seen"`
 	CurrentRoom uuid.UUID `json:"current_room,omitempty"`
+	Devices     int       `json:"devices,omitempty"` // Number of devices with a live connection
+}
+
+// presenceKey returns the key holding a user's PresenceState.
+func presenceKey(userID uuid.UUID) string {
+	return fmt.Sprintf("presence:%s", userID.String())
 }
 
 type Cache struct {
@@ -124,7 +130,7 @@ func (c *Cache) SetUserPresence(ctx context.Context, userID uuid.UUID, state Pre
 		span.End()
 	}()
 
-	key := fmt.Sprintf("presence:%s", userID.String())
+	key := presenceKey(userID)
 	data, err := json.Marshal(state)
 	if err != nil {
 		span.RecordError(err)
@@ -148,7 +154,7 @@ func (c *Cache) GetUserPresence(ctx context.Context, userID uuid.UUID) (*Presenc
 		span.End()
 	}()
 
-	key := fmt.Sprintf("presence:%s", userID.String())
+	key := presenceKey(userID)
 	data, err := c.client.Get(ctx, key).Result()
 	if err == redis.Nil {
 		span.SetStatus(codes.Ok, "User not found in presence cache")
@@ -179,7 +185,7 @@ func (c *Cache) DeleteUserPresence(ctx context.Context, userID uuid.UUID) error
 		span.End()
 	}()
 
-	key := fmt.Sprintf("presence:%s", userID.String())
+	key := presenceKey(userID)
 	err := c.client.Del(ctx, key).Err()
 	if err != nil {
 		span.RecordError(err)
@@ -0,0 +1,214 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Call is the shared state of a call in a room. A room has at most one active call.
+type Call struct {
+	ID        string
+	RoomID    uuid.UUID
+	Kind      string // audio or video
+	StartedBy uuid.UUID
+	StartedAt time.Time
+	// Participants maps each participant to the connection they take part with
+	Participants map[uuid.UUID]uuid.UUID
+}
+
+func roomCallKey(roomID uuid.UUID) string {
+	return "room:" + roomID.String() + ":call"
+}
+
+func callKey(callID string) string {
+	return "call:" + callID
+}
+
+func callParticipantsKey(callID string) string {
+	return "call:" + callID + ":participants"
+}
+
+// startCallScript starts a call in a room unless one is already active, adding its starter as the first
+// participant. It returns the ID of the room's active call, which is ARGV[1] if the call was started.
+var startCallScript = redis.NewScript(`
+local active = redis.call('GET', KEYS[1])
+if active then
+  return active
+end
+local ttl = tonumber(ARGV[7])
+redis.call('SET', KEYS[1], ARGV[1], 'EX', ttl)
+redis.call('HSET', KEYS[2], 'room_id', ARGV[2], 'kind', ARGV[3], 'started_by', ARGV[4], 'started_at', ARGV[5])
+redis.call('EXPIRE', KEYS[2], ttl)
+redis.call('HSET', KEYS[3], ARGV[4], ARGV[6])
+redis.call('EXPIRE', KEYS[3], ttl)
+return ARGV[1]
+`)
+
+// joinCallScript adds a participant to the active call ARGV[1] of a room. It returns 0 if the call is
+// no longer active.
+var joinCallScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) ~= ARGV[1] then
+  return 0
+end
+local ttl = tonumber(ARGV[4])
+redis.call('HSET', KEYS[3], ARGV[2], ARGV[3])
+redis.call('EXPIRE', KEYS[1], ttl)
+redis.call('EXPIRE', KEYS[2], ttl)
+redis.call('EXPIRE', KEYS[3], ttl)
+return 1
+`)
+
+// leaveCallScript removes a participant's connection from call ARGV[1], ending the call if it was the
+// last participant. It returns -1 if the connection was not in the call, 0 if the call ended, and
+// otherwise the number of participants left.
+var leaveCallScript = redis.NewScript(`
+if redis.call('HGET', KEYS[3], ARGV[2]) ~= ARGV[3] then
+  return -1
+end
+redis.call('HDEL', KEYS[3], ARGV[2])
+local left = redis.call('HLEN', KEYS[3])
+if left > 0 then
+  return left
+end
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+  redis.call('DEL', KEYS[1])
+end
+redis.call('DEL', KEYS[2], KEYS[3])
+return 0
+`)
+
+// endCallScript ends call ARGV[1] and returns 1, or 0 if it was no longer active.
+var endCallScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) ~= ARGV[1] then
+  return 0
+end
+redis.call('DEL', KEYS[1], KEYS[2], KEYS[3])
+return 1
+`)
+
+// StartCall starts a call in a room with its starter as the first participant, unless the room already
+// has an active call. It returns the ID of the room's active call, which equals call.ID if it was started.
+// The call expires after ttl without anyone joining, so that calls of a node that died do not linger.
+func (c *Cache) StartCall(ctx context.Context, call Call, connID uuid.UUID, ttl time.Duration) (string, error) {
+	start := time.Now()
+	ctx, span := otel.Tracer("redis-client").Start(ctx, "redis.start_call", trace.WithAttributes(attribute.String("room.id", call.RoomID.String())))
+	defer func() {
+		redisLatency.Record(ctx, float64(time.Since(start).Milliseconds()), metric.WithAttributes(attribute.String("redis.command", "start_call")))
+		span.End()
+	}()
+
+	active, err := startCallScript.Run(ctx, c.client,
+		[]string{roomCallKey(call.RoomID), callKey(call.ID), callParticipantsKey(call.ID)},
+		call.ID, call.RoomID.String(), call.Kind, call.StartedBy.String(), call.StartedAt.UnixMilli(), connID.String(), int64(ttl.Seconds()),
+	).Text()
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Failed to start call")
+		return "", fmt.Errorf("failed to start call: %w", err)
+	}
+	return active, nil
+}
+
+// JoinCall adds a user's connection to a room's active call, replacing any other connection of the user.
+// It reports false if the call is no longer active.
+func (c *Cache) JoinCall(ctx context.Context, roomID uuid.UUID, callID string, userID, connID uuid.UUID, ttl time.Duration) (bool, error) {
+	joined, err := joinCallScript.Run(ctx, c.client,
+		[]string{roomCallKey(roomID), callKey(callID), callParticipantsKey(callID)},
+		callID, userID.String(), connID.String(), int64(ttl.Seconds()),
+	).Int()
+	if err != nil {
+		return false, fmt.Errorf("failed to join call: %w", err)
+	}
+	return joined == 1, nil
+}
+
+// LeaveCall removes a user's connection from a call, ending the call if no participant is left.
+// It reports whether the connection was in the call and whether the call ended.
+func (c *Cache) LeaveCall(ctx context.Context, roomID uuid.UUID, callID string, userID, connID uuid.UUID) (left, ended bool, err error) {
+	remaining, err := leaveCallScript.Run(ctx, c.client,
+		[]string{roomCallKey(roomID), callKey(callID), callParticipantsKey(callID)},
+		callID, userID.String(), connID.String(),
+	).Int()
+	if err != nil {
+		return false, false, fmt.Errorf("failed to leave call: %w", err)
+	}
+	return remaining >= 0, remaining == 0, nil
+}
+
+// EndCall ends a room's call for every participant. It reports false if the call was no longer active.
+func (c *Cache) EndCall(ctx context.Context, roomID uuid.UUID, callID string) (bool, error) {
+	ended, err := endCallScript.Run(ctx, c.client,
+		[]string{roomCallKey(roomID), callKey(callID), callParticipantsKey(callID)},
+		callID,
+	).Int()
+	if err != nil {
+		return false, fmt.Errorf("failed to end call: %w", err)
+	}
+	return ended == 1, nil
+}
+
+// GetCall returns the state of a call, or nil if it is not active.
+func (c *Cache) GetCall(ctx context.Context, callID string) (*Call, error) {
+	start := time.Now()
+	ctx, span := otel.Tracer("redis-client").Start(ctx, "redis.get_call")
+	defer func() {
+		redisLatency.Record(ctx, float64(time.Since(start).Milliseconds()), metric.WithAttributes(attribute.String("redis.command", "get_call")))
+		span.End()
+	}()
+
+	pipe := c.client.Pipeline()
+	metaCmd := pipe.HGetAll(ctx, callKey(callID))
+	participantsCmd := pipe.HGetAll(ctx, callParticipantsKey(callID))
+	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Failed to get call")
+		return nil, fmt.Errorf("failed to get call: %w", err)
+	}
+
+	meta := metaCmd.Val()
+	if len(meta) == 0 {
+		return nil, nil
+	}
+	call := &Call{ID: callID, Kind: meta["kind"], Participants: make(map[uuid.UUID]uuid.UUID)}
+	call.RoomID, _ = uuid.Parse(meta["room_id"])
+	call.StartedBy, _ = uuid.Parse(meta["started_by"])
+	if ms, err := strconv.ParseInt(meta["started_at"], 10, 64); err == nil {
+		call.StartedAt = time.UnixMilli(ms)
+	}
+	for userStr, connStr := range participantsCmd.Val() {
+		userID, err := uuid.Parse(userStr)
+		if err != nil {
+			continue
+		}
+		connID, err := uuid.Parse(connStr)
+		if err != nil {
+			continue
+		}
+		call.Participants[userID] = connID
+	}
+	return call, nil
+}
+
+// GetRoomCall returns the ID of a room's active call, or "" if it has none.
+func (c *Cache) GetRoomCall(ctx context.Context, roomID uuid.UUID) (string, error) {
+	callID, err := c.client.Get(ctx, roomCallKey(roomID)).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get room call: %w", err)
+	}
+	return callID, nil
+}
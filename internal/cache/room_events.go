@@ -0,0 +1,167 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// RoomEventLogSize is the number of most recent events kept per room for replay.
+	RoomEventLogSize = 500
+
+	// roomEventLogTTL is how long a room's event log is kept after its last event.
+	roomEventLogTTL = 24 * time.Hour
+)
+
+// RoomEventsKey returns the sorted set holding a room's recent events, scored by event ID.
+func RoomEventsKey(roomID uuid.UUID) string {
+	return "room:" + roomID.String() + ":messages"
+}
+
+func roomSeqKey(roomID uuid.UUID) string {
+	return "room:" + roomID.String() + ":seq"
+}
+
+// NextRoomEventID allocates the next event ID in a room's sequence. IDs are shared by all nodes.
+func (c *Cache) NextRoomEventID(ctx context.Context, roomID uuid.UUID) (int64, error) {
+	start := time.Now()
+	ctx, span := otel.Tracer("redis-client").Start(ctx, "redis.next_room_event_id", trace.WithAttributes(attribute.String("room.id", roomID.String())))
+	defer func() {
+		redisLatency.Record(ctx, float64(time.Since(start).Milliseconds()), metric.WithAttributes(attribute.String("redis.command", "next_room_event_id")))
+		span.End()
+	}()
+
+	id, err := c.client.Incr(ctx, roomSeqKey(roomID)).Result()
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Failed to allocate room event ID")
+		return 0, fmt.Errorf("failed to allocate room event ID: %w", err)
+	}
+	return id, nil
+}
+
+// LastRoomEventID returns the most recently allocated event ID in a room, or 0 if none has been allocated.
+func (c *Cache) LastRoomEventID(ctx context.Context, roomID uuid.UUID) (int64, error) {
+	val, err := c.client.Get(ctx, roomSeqKey(roomID)).Result()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to get last room event ID: %w", err)
+	}
+	return strconv.ParseInt(val, 10, 64)
+}
+
+// AppendRoomEvent stores an encoded event in the room's event log and trims the log to RoomEventLogSize.
+func (c *Cache) AppendRoomEvent(ctx context.Context, roomID uuid.UUID, eventID int64, data []byte) error {
+	start := time.Now()
+	ctx, span := otel.Tracer("redis-client").Start(ctx, "redis.append_room_event", trace.WithAttributes(attribute.String("room.id", roomID.String())))
+	defer func() {
+		redisLatency.Record(ctx, float64(time.Since(start).Milliseconds()), metric.WithAttributes(attribute.String("redis.command", "append_room_event")))
+		span.End()
+	}()
+
+	key := RoomEventsKey(roomID)
+	pipe := c.client.TxPipeline()
+	pipe.ZAdd(ctx, key, redis.Z{Score: float64(eventID), Member: data})
+	pipe.ZRemRangeByRank(ctx, key, 0, -RoomEventLogSize-1)
+	pipe.Expire(ctx, key, roomEventLogTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Failed to append room event")
+		return fmt.Errorf("failed to append room event: %w", err)
+	}
+	return nil
+}
+
+// GetRoomEventsSince returns the encoded events of a room with an ID greater than afterID, oldest first.
+// complete is false when some of those events have already been trimmed from the log, in which case
+// the caller has to fall back to persistent storage.
+func (c *Cache) GetRoomEventsSince(ctx context.Context, roomID uuid.UUID, afterID int64) (events []string, complete bool, err error) {
+	start := time.Now()
+	ctx, span := otel.Tracer("redis-client").Start(ctx, "redis.get_room_events_since", trace.WithAttributes(attribute.String("room.id", roomID.String())))
+	defer func() {
+		redisLatency.Record(ctx, float64(time.Since(start).Milliseconds()), metric.WithAttributes(attribute.String("redis.command", "get_room_events_since")))
+		span.End()
+	}()
+
+	lastID, err := c.LastRoomEventID(ctx, roomID)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Failed to get last room event ID")
+		return nil, false, err
+	}
+	if lastID <= afterID {
+		return nil, true, nil
+	}
+
+	key := RoomEventsKey(roomID)
+	oldest, err := c.client.ZRangeWithScores(ctx, key, 0, 0).Result()
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Failed to read room event log")
+		return nil, false, fmt.Errorf("failed to read room event log: %w", err)
+	}
+	if len(oldest) == 0 || int64(oldest[0].Score) > afterID+1 {
+		return nil, false, nil
+	}
+
+	events, err = c.client.ZRangeByScore(ctx, key, &redis.ZRangeBy{
+		Min: "(" + strconv.FormatInt(afterID, 10),
+		Max: "+inf",
+	}).Result()
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Failed to read room event log")
+		return nil, false, fmt.Errorf("failed to read room event log: %w", err)
+	}
+	return events, true, nil
+}
+
+// RemoveRoomEvents deletes the encoded events of a room for which match returns true from its event
+// log, such as the events of messages that no longer exist, and returns how many were deleted.
+func (c *Cache) RemoveRoomEvents(ctx context.Context, roomID uuid.UUID, match func(event string) bool) (int, error) {
+	start := time.Now()
+	ctx, span := otel.Tracer("redis-client").Start(ctx, "redis.remove_room_events", trace.WithAttributes(attribute.String("room.id", roomID.String())))
+	defer func() {
+		redisLatency.Record(ctx, float64(time.Since(start).Milliseconds()), metric.WithAttributes(attribute.String("redis.command", "remove_room_events")))
+		span.End()
+	}()
+
+	key := RoomEventsKey(roomID)
+	events, err := c.client.ZRange(ctx, key, 0, -1).Result()
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Failed to read room event log")
+		return 0, fmt.Errorf("failed to read room event log: %w", err)
+	}
+
+	var matched []interface{}
+	for _, event := range events {
+		if match(event) {
+			matched = append(matched, event)
+		}
+	}
+	if len(matched) == 0 {
+		return 0, nil
+	}
+	// Events appended meanwhile are left alone, since members are removed by value
+	removed, err := c.client.ZRem(ctx, key, matched...).Result()
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Failed to remove room events")
+		return 0, fmt.Errorf("failed to remove room events: %w", err)
+	}
+	return int(removed), nil
+}
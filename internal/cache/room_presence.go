@@ -0,0 +1,183 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// RoomPresenceKey returns the sorted set of the connections subscribed to a room on any node,
+// as "<user_id>/<connection_id>" members scored by the time they were last seen (Unix seconds).
+func RoomPresenceKey(roomID uuid.UUID) string {
+	return "room:" + roomID.String() + ":presence"
+}
+
+// roomPresenceUsersKey returns the hash counting the connections of each user present in a room.
+func roomPresenceUsersKey(roomID uuid.UUID) string {
+	return "room:" + roomID.String() + ":presence:users"
+}
+
+func roomPresenceMember(userID, connID uuid.UUID) string {
+	return userID.String() + "/" + connID.String()
+}
+
+// addRoomPresenceScript adds a connection to a room's roster and returns 1 if it is the user's first
+// connection in the room.
+var addRoomPresenceScript = redis.NewScript(`
+if redis.call('ZADD', KEYS[1], ARGV[3], ARGV[2]) == 0 then
+  return 0
+end
+if redis.call('HINCRBY', KEYS[2], ARGV[1], 1) == 1 then
+  return 1
+end
+return 0
+`)
+
+// removeRoomPresenceScript removes a connection from a room's roster and returns 1 if it was the user's
+// last connection in the room.
+var removeRoomPresenceScript = redis.NewScript(`
+if redis.call('ZREM', KEYS[1], ARGV[2]) == 0 then
+  return 0
+end
+if redis.call('HINCRBY', KEYS[2], ARGV[1], -1) <= 0 then
+  redis.call('HDEL', KEYS[2], ARGV[1])
+  return 1
+end
+return 0
+`)
+
+// pruneRoomPresenceScript removes the connections last seen before ARGV[1] from a room's roster and
+// returns the users who had no other connection left in the room.
+var pruneRoomPresenceScript = redis.NewScript(`
+local departed = {}
+for _, member in ipairs(redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', '(' .. ARGV[1])) do
+  redis.call('ZREM', KEYS[1], member)
+  local userID = string.match(member, '^([^/]*)/')
+  if userID and redis.call('HINCRBY', KEYS[2], userID, -1) <= 0 then
+    redis.call('HDEL', KEYS[2], userID)
+    table.insert(departed, userID)
+  end
+end
+return departed
+`)
+
+// AddRoomPresence records that a connection of a user is subscribed to a room.
+// It reports whether this is the user's first connection in the room.
+func (c *Cache) AddRoomPresence(ctx context.Context, roomID, userID, connID uuid.UUID) (bool, error) {
+	start := time.Now()
+	ctx, span := otel.Tracer("redis-client").Start(ctx, "redis.add_room_presence", trace.WithAttributes(attribute.String("room.id", roomID.String()), attribute.String("user.id", userID.String())))
+	defer func() {
+		redisLatency.Record(ctx, float64(time.Since(start).Milliseconds()), metric.WithAttributes(attribute.String("redis.command", "add_room_presence")))
+		span.End()
+	}()
+
+	first, err := addRoomPresenceScript.Run(ctx, c.client,
+		[]string{RoomPresenceKey(roomID), roomPresenceUsersKey(roomID)},
+		userID.String(), roomPresenceMember(userID, connID), time.Now().Unix(),
+	).Int()
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Failed to add room presence")
+		return false, fmt.Errorf("failed to add room presence: %w", err)
+	}
+	return first == 1, nil
+}
+
+// RemoveRoomPresence records that a connection of a user is no longer subscribed to a room.
+// It reports whether this was the user's last connection in the room.
+func (c *Cache) RemoveRoomPresence(ctx context.Context, roomID, userID, connID uuid.UUID) (bool, error) {
+	start := time.Now()
+	ctx, span := otel.Tracer("redis-client").Start(ctx, "redis.remove_room_presence", trace.WithAttributes(attribute.String("room.id", roomID.String()), attribute.String("user.id", userID.String())))
+	defer func() {
+		redisLatency.Record(ctx, float64(time.Since(start).Milliseconds()), metric.WithAttributes(attribute.String("redis.command", "remove_room_presence")))
+		span.End()
+	}()
+
+	last, err := removeRoomPresenceScript.Run(ctx, c.client,
+		[]string{RoomPresenceKey(roomID), roomPresenceUsersKey(roomID)},
+		userID.String(), roomPresenceMember(userID, connID),
+	).Int()
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Failed to remove room presence")
+		return false, fmt.Errorf("failed to remove room presence: %w", err)
+	}
+	return last == 1, nil
+}
+
+// RefreshRoomPresence marks a connection in a room's roster as still alive.
+func (c *Cache) RefreshRoomPresence(ctx context.Context, roomID, userID, connID uuid.UUID) error {
+	err := c.client.ZAddXX(ctx, RoomPresenceKey(roomID), redis.Z{
+		Score:  float64(time.Now().Unix()),
+		Member: roomPresenceMember(userID, connID),
+	}).Err()
+	if err != nil {
+		return fmt.Errorf("failed to refresh room presence: %w", err)
+	}
+	return nil
+}
+
+// PruneRoomPresence removes the connections not refreshed since cutoff from a room's roster, such as
+// those of a node that died, and returns the users who no longer have a connection in the room.
+func (c *Cache) PruneRoomPresence(ctx context.Context, roomID uuid.UUID, cutoff time.Time) ([]uuid.UUID, error) {
+	start := time.Now()
+	ctx, span := otel.Tracer("redis-client").Start(ctx, "redis.prune_room_presence", trace.WithAttributes(attribute.String("room.id", roomID.String())))
+	defer func() {
+		redisLatency.Record(ctx, float64(time.Since(start).Milliseconds()), metric.WithAttributes(attribute.String("redis.command", "prune_room_presence")))
+		span.End()
+	}()
+
+	departed, err := pruneRoomPresenceScript.Run(ctx, c.client,
+		[]string{RoomPresenceKey(roomID), roomPresenceUsersKey(roomID)},
+		cutoff.Unix(),
+	).StringSlice()
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Failed to prune room presence")
+		return nil, fmt.Errorf("failed to prune room presence: %w", err)
+	}
+
+	userIDs := make([]uuid.UUID, 0, len(departed))
+	for _, field := range departed {
+		if userID, err := uuid.Parse(field); err == nil {
+			userIDs = append(userIDs, userID)
+		}
+	}
+	return userIDs, nil
+}
+
+// GetRoomPresence returns the users with at least one connection subscribed to a room.
+func (c *Cache) GetRoomPresence(ctx context.Context, roomID uuid.UUID) ([]uuid.UUID, error) {
+	start := time.Now()
+	ctx, span := otel.Tracer("redis-client").Start(ctx, "redis.get_room_presence", trace.WithAttributes(attribute.String("room.id", roomID.String())))
+	defer func() {
+		redisLatency.Record(ctx, float64(time.Since(start).Milliseconds()), metric.WithAttributes(attribute.String("redis.command", "get_room_presence")))
+		span.End()
+	}()
+
+	fields, err := c.client.HKeys(ctx, roomPresenceUsersKey(roomID)).Result()
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Failed to get room presence")
+		return nil, fmt.Errorf("failed to get room presence: %w", err)
+	}
+
+	userIDs := make([]uuid.UUID, 0, len(fields))
+	for _, field := range fields {
+		userID, err := uuid.Parse(field)
+		if err != nil {
+			continue
+		}
+		userIDs = append(userIDs, userID)
+	}
+	return userIDs, nil
+}
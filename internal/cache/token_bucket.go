@@ -0,0 +1,82 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// TokenBucket is a token bucket stored in Redis, shared by every node.
+type TokenBucket struct {
+	Key      string
+	Capacity float64 // Maximum number of tokens, i.e. the allowed burst
+	Rate     float64 // Tokens added per second
+}
+
+// takeTokensScript takes one token from each bucket in KEYS, or none if any of them is empty.
+// ARGV holds the capacity and rate of each bucket. It returns 0 on success, or the 1-based index
+// of the first empty bucket. Time comes from the Redis server so that all nodes share one clock.
+var takeTokensScript = redis.NewScript(`
+local t = redis.call('TIME')
+local now = tonumber(t[1]) + tonumber(t[2]) / 1000000
+local tokens = {}
+for i = 1, #KEYS do
+  local capacity = tonumber(ARGV[2 * i - 1])
+  local rate = tonumber(ARGV[2 * i])
+  local state = redis.call('HMGET', KEYS[i], 'tokens', 'ts')
+  local available = tonumber(state[1])
+  local ts = tonumber(state[2])
+  if available == nil or ts == nil then
+    available = capacity
+    ts = now
+  end
+  available = math.min(capacity, available + math.max(0, now - ts) * rate)
+  if available < 1 then
+    return i
+  end
+  tokens[i] = available
+end
+for i = 1, #KEYS do
+  local capacity = tonumber(ARGV[2 * i - 1])
+  local rate = tonumber(ARGV[2 * i])
+  redis.call('HSET', KEYS[i], 'tokens', tostring(tokens[i] - 1), 'ts', tostring(now))
+  redis.call('EXPIRE', KEYS[i], math.ceil(capacity / rate) + 1)
+end
+return 0
+`)
+
+// TakeTokens atomically takes one token from every bucket, or from none of them if any is empty.
+// It returns the index of the first empty bucket, or -1 if the tokens were taken.
+func (c *Cache) TakeTokens(ctx context.Context, buckets ...TokenBucket) (int, error) {
+	start := time.Now()
+	ctx, span := otel.Tracer("redis-client").Start(ctx, "redis.take_tokens")
+	defer func() {
+		redisLatency.Record(ctx, float64(time.Since(start).Milliseconds()), metric.WithAttributes(attribute.String("redis.command", "take_tokens")))
+		span.End()
+	}()
+
+	keys := make([]string, len(buckets))
+	args := make([]interface{}, 0, 2*len(buckets))
+	for i, bucket := range buckets {
+		if bucket.Capacity < 1 || bucket.Rate <= 0 {
+			return 0, fmt.Errorf("invalid token bucket %s", bucket.Key)
+		}
+		keys[i] = bucket.Key
+		args = append(args, bucket.Capacity, bucket.Rate)
+	}
+
+	empty, err := takeTokensScript.Run(ctx, c.client, keys, args...).Int()
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Failed to take tokens")
+		return 0, fmt.Errorf("failed to take tokens: %w", err)
+	}
+	return empty - 1, nil
+}
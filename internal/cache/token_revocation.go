@@ -0,0 +1,60 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+)
+
+func revokedTokenKey(tokenID string) string {
+	return "revoked_token:" + tokenID
+}
+
+// RevokeToken records that the token with the given ID (its jti claim) is no longer valid.
+// The record is kept until the token would have expired anyway.
+func (c *Cache) RevokeToken(ctx context.Context, tokenID string, expiresAt time.Time) error {
+	start := time.Now()
+	ctx, span := otel.Tracer("redis-client").Start(ctx, "redis.revoke_token")
+	defer func() {
+		redisLatency.Record(ctx, float64(time.Since(start).Milliseconds()), metric.WithAttributes(attribute.String("redis.command", "revoke_token")))
+		span.End()
+	}()
+
+	ttl := time.Until(expiresAt)
+	if ttl < time.Second {
+		ttl = time.Second
+	}
+	if err := c.client.Set(ctx, revokedTokenKey(tokenID), 1, ttl).Err(); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Failed to revoke token")
+		return fmt.Errorf("failed to revoke token: %w", err)
+	}
+	return nil
+}
+
+// IsTokenRevoked reports whether the token with the given ID has been revoked. Tokens without an ID
+// cannot be revoked.
+func (c *Cache) IsTokenRevoked(ctx context.Context, tokenID string) (bool, error) {
+	if tokenID == "" {
+		return false, nil
+	}
+	start := time.Now()
+	ctx, span := otel.Tracer("redis-client").Start(ctx, "redis.is_token_revoked")
+	defer func() {
+		redisLatency.Record(ctx, float64(time.Since(start).Milliseconds()), metric.WithAttributes(attribute.String("redis.command", "is_token_revoked")))
+		span.End()
+	}()
+
+	n, err := c.client.Exists(ctx, revokedTokenKey(tokenID)).Result()
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Failed to check token revocation")
+		return false, fmt.Errorf("failed to check token revocation: %w", err)
+	}
+	return n > 0, nil
+}
@@ -0,0 +1,201 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Aggregate presence states of a user, matching the users.status CHECK constraint.
+const (
+	StatusOnline  = "online"
+	StatusAway    = "away"
+	StatusOffline = "offline"
+)
+
+// PresenceUpdate describes a change to one of a user's connections.
+type PresenceUpdate struct {
+	UserID   uuid.UUID
+	DeviceID string
+	ConnID   uuid.UUID
+
+	// Disconnected removes the connection; otherwise it is kept alive until TTL from now.
+	Disconnected bool
+	// LastActive is when the user last did something on the connection.
+	LastActive time.Time
+	// AwayAfter is how long all of a user's connections must be inactive for the user to be away.
+	AwayAfter time.Duration
+	// TTL is how long the connection counts as alive without another update, so that connections of a
+	// node that died expire on their own.
+	TTL time.Duration
+}
+
+// PresenceChange is the aggregate presence of a user before and after an update.
+type PresenceChange struct {
+	Previous string
+	Current  string
+}
+
+// Changed reports whether the update changed the user's aggregate presence.
+func (c PresenceChange) Changed() bool {
+	return c.Previous != c.Current
+}
+
+func userConnectionsKey(userID uuid.UUID) string {
+	return fmt.Sprintf("presence:%s:connections", userID.String())
+}
+
+func userActivityKey(userID uuid.UUID) string {
+	return fmt.Sprintf("presence:%s:activity", userID.String())
+}
+
+// updatePresenceScript applies a connection update and recomputes the user's aggregate presence.
+// KEYS: the connections sorted set (members "<device_id>/<connection_id>" scored by expiry), the
+// activity hash (member -> last active time) and the presence state.
+// ARGV: now, member, expiry (0 removes the connection), last active, away after, TTL (seconds),
+// and now as RFC 3339 for last_seen.
+var updatePresenceScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local ttl = tonumber(ARGV[6])
+
+local expired = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', now)
+for _, member in ipairs(expired) do
+  redis.call('HDEL', KEYS[2], member)
+end
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now)
+
+if tonumber(ARGV[3]) == 0 then
+  redis.call('ZREM', KEYS[1], ARGV[2])
+  redis.call('HDEL', KEYS[2], ARGV[2])
+else
+  redis.call('ZADD', KEYS[1], ARGV[3], ARGV[2])
+  redis.call('HSET', KEYS[2], ARGV[2], ARGV[4])
+end
+
+local status = 'offline'
+local devices = {}
+local deviceCount = 0
+for _, member in ipairs(redis.call('ZRANGE', KEYS[1], 0, -1)) do
+  if status == 'offline' then
+    status = 'away'
+  end
+  local active = tonumber(redis.call('HGET', KEYS[2], member))
+  if active and now - active < tonumber(ARGV[5]) then
+    status = 'online'
+  end
+  local device = string.match(member, '^(.*)/[^/]*$') or member
+  if not devices[device] then
+    devices[device] = true
+    deviceCount = deviceCount + 1
+  end
+end
+
+local previous = 'offline'
+local current = redis.call('GET', KEYS[3])
+if current then
+  local ok, state = pcall(cjson.decode, current)
+  if ok and type(state) == 'table' and state.status then
+    previous = state.status
+  end
+end
+
+local state = cjson.encode({status = status, last_seen = ARGV[7], devices = deviceCount})
+if status == 'offline' then
+  -- Offline is kept without expiry so that last_seen survives
+  redis.call('SET', KEYS[3], state)
+  redis.call('DEL', KEYS[1], KEYS[2])
+else
+  redis.call('SET', KEYS[3], state, 'EX', ttl)
+  redis.call('EXPIRE', KEYS[1], ttl)
+  redis.call('EXPIRE', KEYS[2], ttl)
+end
+return {previous, status}
+`)
+
+// UpdateUserPresence applies a change to one of a user's connections and recomputes the user's aggregate
+// presence from all of their live connections on every node: online if any of them was active within
+// AwayAfter, away if they all are idle, and offline once none is left.
+func (c *Cache) UpdateUserPresence(ctx context.Context, update PresenceUpdate) (PresenceChange, error) {
+	start := time.Now()
+	ctx, span := otel.Tracer("redis-client").Start(ctx, "redis.update_user_presence", trace.WithAttributes(attribute.String("user.id", update.UserID.String())))
+	defer func() {
+		redisLatency.Record(ctx, float64(time.Since(start).Milliseconds()), metric.WithAttributes(attribute.String("redis.command", "update_user_presence")))
+		span.End()
+	}()
+
+	now := time.Now()
+	var expiry int64
+	if !update.Disconnected {
+		expiry = now.Add(update.TTL).Unix()
+	}
+	ttlSeconds := int64(update.TTL.Seconds())
+	if ttlSeconds < 1 {
+		ttlSeconds = 1
+	}
+
+	result, err := updatePresenceScript.Run(ctx, c.client,
+		[]string{userConnectionsKey(update.UserID), userActivityKey(update.UserID), presenceKey(update.UserID)},
+		now.Unix(),
+		update.DeviceID+"/"+update.ConnID.String(),
+		expiry,
+		update.LastActive.Unix(),
+		int64(update.AwayAfter.Seconds()),
+		ttlSeconds,
+		now.UTC().Format(time.RFC3339Nano),
+	).StringSlice()
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Failed to update user presence")
+		return PresenceChange{}, fmt.Errorf("failed to update user presence: %w", err)
+	}
+	if len(result) != 2 {
+		return PresenceChange{}, fmt.Errorf("unexpected presence update result %v", result)
+	}
+	return PresenceChange{Previous: result[0], Current: result[1]}, nil
+}
+
+// RecomputeUserPresence prunes the connections of a user that expired, such as those of a node that
+// died, and returns the user's aggregate presence from the ones left, storing it like UpdateUserPresence.
+func (c *Cache) RecomputeUserPresence(ctx context.Context, userID uuid.UUID, awayAfter, ttl time.Duration) (string, error) {
+	start := time.Now()
+	ctx, span := otel.Tracer("redis-client").Start(ctx, "redis.recompute_user_presence", trace.WithAttributes(attribute.String("user.id", userID.String())))
+	defer func() {
+		redisLatency.Record(ctx, float64(time.Since(start).Milliseconds()), metric.WithAttributes(attribute.String("redis.command", "recompute_user_presence")))
+		span.End()
+	}()
+
+	now := time.Now()
+	ttlSeconds := int64(ttl.Seconds())
+	if ttlSeconds < 1 {
+		ttlSeconds = 1
+	}
+	// Removing a connection that does not exist only recomputes the aggregate
+	result, err := updatePresenceScript.Run(ctx, c.client,
+		[]string{userConnectionsKey(userID), userActivityKey(userID), presenceKey(userID)},
+		now.Unix(),
+		"",
+		0,
+		0,
+		int64(awayAfter.Seconds()),
+		ttlSeconds,
+		now.UTC().Format(time.RFC3339Nano),
+	).StringSlice()
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Failed to recompute user presence")
+		return "", fmt.Errorf("failed to recompute user presence: %w", err)
+	}
+	if len(result) != 2 {
+		return "", fmt.Errorf("unexpected presence update result %v", result)
+	}
+	return result[1], nil
+}
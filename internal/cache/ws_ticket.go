@@ -0,0 +1,89 @@
+package cache
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// WSTicket is a single-use credential for opening a WebSocket connection, issued to an authenticated
+// user so that their token does not have to appear in the connection URL.
+type WSTicket struct {
+	UserID uuid.UUID `json:"user_id"`
+	// IP, if set, is the only client address the ticket can be redeemed from.
+	IP string `json:"ip,omitempty"`
+	// TokenID and TokenExpiresAt identify the token the ticket was issued for, which the connection inherits.
+	TokenID        string    `json:"token_id,omitempty"`
+	TokenExpiresAt time.Time `json:"token_expires_at,omitzero"`
+}
+
+func wsTicketKey(ticketID string) string {
+	return "ws_ticket:" + ticketID
+}
+
+// IssueWSTicket stores a ticket valid for ttl and returns its ID.
+func (c *Cache) IssueWSTicket(ctx context.Context, ticket WSTicket, ttl time.Duration) (string, error) {
+	start := time.Now()
+	ctx, span := otel.Tracer("redis-client").Start(ctx, "redis.issue_ws_ticket", trace.WithAttributes(attribute.String("user.id", ticket.UserID.String())))
+	defer func() {
+		redisLatency.Record(ctx, float64(time.Since(start).Milliseconds()), metric.WithAttributes(attribute.String("redis.command", "issue_ws_ticket")))
+		span.End()
+	}()
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", fmt.Errorf("failed to generate ticket: %w", err)
+	}
+	ticketID := base64.RawURLEncoding.EncodeToString(raw)
+
+	data, err := json.Marshal(ticket)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal ticket: %w", err)
+	}
+	if err := c.client.Set(ctx, wsTicketKey(ticketID), data, ttl).Err(); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Failed to issue WebSocket ticket")
+		return "", fmt.Errorf("failed to store ticket: %w", err)
+	}
+	return ticketID, nil
+}
+
+// RedeemWSTicket consumes a ticket, returning nil if it does not exist, has expired or was already redeemed.
+func (c *Cache) RedeemWSTicket(ctx context.Context, ticketID string) (*WSTicket, error) {
+	start := time.Now()
+	ctx, span := otel.Tracer("redis-client").Start(ctx, "redis.redeem_ws_ticket")
+	defer func() {
+		redisLatency.Record(ctx, float64(time.Since(start).Milliseconds()), metric.WithAttributes(attribute.String("redis.command", "redeem_ws_ticket")))
+		span.End()
+	}()
+
+	// GETDEL makes redemption atomic, so a ticket cannot be used twice even across nodes
+	data, err := c.client.GetDel(ctx, wsTicketKey(ticketID)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Failed to redeem WebSocket ticket")
+		return nil, fmt.Errorf("failed to redeem ticket: %w", err)
+	}
+
+	var ticket WSTicket
+	if err := json.Unmarshal(data, &ticket); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal ticket: %w", err)
+	}
+	return &ticket, nil
+}
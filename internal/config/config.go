@@ -27,6 +27,38 @@ type Config struct {
 	AWSSecretAccessKey   string `env:"AWS_SECRET_ACCESS_KEY,secret"`
 	JWTRSAPrivateKey     string `env:"JWT_RSA_PRIVATE_KEY,secret"`
 	JWTRSAPublicKey      string `env:"JWT_RSA_PUBLIC_KEY,secret"`
+
+	// SlowConsumerPolicy is the default policy for clients that cannot keep up with a room: drop, disconnect or buffer
+	SlowConsumerPolicy string `env:"SLOW_CONSUMER_POLICY"`
+	// SlowConsumerRoomPolicies overrides the policy per room as "<room_id>=<policy>,..."
+	SlowConsumerRoomPolicies string `env:"SLOW_CONSUMER_ROOM_POLICIES"`
+	// SlowConsumerOverflowSize is the number of frames buffered per client under the buffer policy
+	SlowConsumerOverflowSize int `env:"SLOW_CONSUMER_OVERFLOW_SIZE"`
+
+	// WSRateLimitsConnection and WSRateLimitsUser override the WebSocket flood limits per frame type
+	// as "<frame type>=<burst>:<rate per second>,...", with "*" for all other frame types
+	WSRateLimitsConnection string `env:"WS_RATE_LIMITS_CONNECTION"`
+	WSRateLimitsUser       string `env:"WS_RATE_LIMITS_USER"`
+	// WSRateLimitMaxViolations is the number of rate-limited frames after which a client is disconnected
+	WSRateLimitMaxViolations int `env:"WS_RATE_LIMIT_MAX_VIOLATIONS"`
+
+	// WSDrainWaveSize and WSDrainWaveIntervalMs control how connections are closed on shutdown:
+	// WSDrainWaveSize at a time, WSDrainWaveIntervalMs apart
+	WSDrainWaveSize       int `env:"WS_DRAIN_WAVE_SIZE"`
+	WSDrainWaveIntervalMs int `env:"WS_DRAIN_WAVE_INTERVAL_MS"`
+	// WSDrainReconnectWindowMs is the window over which drained clients are told to spread their reconnects
+	WSDrainReconnectWindowMs int `env:"WS_DRAIN_RECONNECT_WINDOW_MS"`
+
+	// WSTicketTTLSeconds is how long a WebSocket ticket can be redeemed after it was issued
+	WSTicketTTLSeconds int `env:"WS_TICKET_TTL_SECONDS"`
+
+	// UndoSendWindowSeconds is how long messages sent with undo_send are held, and can be canceled, before
+	// they are sent; 0 sends them right away
+	UndoSendWindowSeconds int `env:"UNDO_SEND_WINDOW_SECONDS"`
+
+	// TrustedProxies are the proxies in front of the server, as comma-separated IP addresses or CIDR
+	// ranges. X-Forwarded-For is ignored on requests that do not come from one of them.
+	TrustedProxies string `env:"TRUSTED_PROXIES"`
 }
 
 // Load loads configuration from environment variables
@@ -52,6 +84,24 @@ func Load() *Config {
 		RedisRateLimitMax:    getEnvAsInt("REDIS_RATE_LIMIT_MAX", 100),
 		FileStoragePath:      getEnv("FILE_STORAGE_PATH", "./uploads"),
 		BaseFileURL:          getEnv("BASE_FILE_URL", "/files"),
+
+		SlowConsumerPolicy:       getEnv("SLOW_CONSUMER_POLICY", "drop"),
+		SlowConsumerRoomPolicies: getEnv("SLOW_CONSUMER_ROOM_POLICIES", ""),
+		SlowConsumerOverflowSize: getEnvAsInt("SLOW_CONSUMER_OVERFLOW_SIZE", 1024),
+
+		WSRateLimitsConnection:   getEnv("WS_RATE_LIMITS_CONNECTION", ""),
+		WSRateLimitsUser:         getEnv("WS_RATE_LIMITS_USER", ""),
+		WSRateLimitMaxViolations: getEnvAsInt("WS_RATE_LIMIT_MAX_VIOLATIONS", 5),
+
+		WSDrainWaveSize:          getEnvAsInt("WS_DRAIN_WAVE_SIZE", 200),
+		WSDrainWaveIntervalMs:    getEnvAsInt("WS_DRAIN_WAVE_INTERVAL_MS", 500),
+		WSDrainReconnectWindowMs: getEnvAsInt("WS_DRAIN_RECONNECT_WINDOW_MS", 10000),
+
+		WSTicketTTLSeconds: getEnvAsInt("WS_TICKET_TTL_SECONDS", 30),
+
+		UndoSendWindowSeconds: getEnvAsInt("UNDO_SEND_WINDOW_SECONDS", 5),
+
+		TrustedProxies: getEnv("TRUSTED_PROXIES", ""),
 	}
 }
 
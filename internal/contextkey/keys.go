@@ -5,4 +5,5 @@ type contextKey string
 const (
 	ContextKeyUserID    contextKey = "userID"
 	ContextKeyRequestID contextKey = "requestID"
+	ContextKeyClaims    contextKey = "claims"
 )
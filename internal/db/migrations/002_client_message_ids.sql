@@ -0,0 +1,7 @@
+-- Client-generated message IDs make message sends idempotent.
+-- A client that resends a message after reconnecting reuses the same client_msg_id,
+-- and the unique index below lets the writer detect the duplicate.
+ALTER TABLE messages ADD COLUMN client_msg_id TEXT;
+
+CREATE UNIQUE INDEX idx_messages_client_msg_id ON messages(room_id, user_id, client_msg_id)
+  WHERE client_msg_id IS NOT NULL;
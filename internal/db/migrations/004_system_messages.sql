@@ -0,0 +1,4 @@
+-- System messages are recorded by the server, such as the start and end of calls
+ALTER TABLE messages DROP CONSTRAINT messages_message_type_check;
+ALTER TABLE messages ADD CONSTRAINT messages_message_type_check
+  CHECK (message_type IN ('text', 'image', 'file', 'system'));
@@ -0,0 +1,10 @@
+-- Messages delivered to their recipients, recorded when written to one of the recipient's connections
+-- or fetched through history. Reads are kept in message_reads.
+CREATE TABLE message_deliveries (
+  message_id BIGINT NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+  user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  delivered_at TIMESTAMPTZ DEFAULT NOW(),
+  PRIMARY KEY (message_id, user_id)
+);
+
+CREATE INDEX idx_message_deliveries_user ON message_deliveries(user_id);
@@ -0,0 +1,18 @@
+-- Read state is kept as a cursor per room and member instead of a row per message read:
+-- every message up to last_read_message_id counts as read.
+ALTER TABLE room_members ADD COLUMN last_read_message_id BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE room_members ADD COLUMN last_read_at TIMESTAMPTZ;
+
+-- Carry over the reads recorded so far. message_reads is no longer written.
+UPDATE room_members rm
+SET last_read_message_id = reads.last_read_message_id, last_read_at = reads.last_read_at
+FROM (
+  SELECT m.room_id, r.user_id, MAX(r.message_id) AS last_read_message_id, MAX(r.read_at) AS last_read_at
+  FROM message_reads r
+  INNER JOIN messages m ON m.id = r.message_id
+  GROUP BY m.room_id, r.user_id
+) reads
+WHERE rm.room_id = reads.room_id AND rm.user_id = reads.user_id;
+
+-- Unread counts scan a room's messages after a cursor
+CREATE INDEX idx_messages_room_id ON messages(room_id, id);
@@ -0,0 +1,16 @@
+-- Users mentioned in messages, by name or through @here and @room. A user is mentioned at most once
+-- per message.
+CREATE TABLE mentions (
+  message_id BIGINT NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+  user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  room_id UUID NOT NULL REFERENCES rooms(id) ON DELETE CASCADE,
+  mentioned_by UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  kind TEXT NOT NULL CHECK (kind IN ('user', 'here', 'room')),
+  seen_at TIMESTAMPTZ,
+  created_at TIMESTAMPTZ DEFAULT NOW(),
+  PRIMARY KEY (message_id, user_id)
+);
+
+-- A user's mentions, newest first, and their unread mentions per room
+CREATE INDEX idx_mentions_user ON mentions(user_id, message_id DESC);
+CREATE INDEX idx_mentions_user_room ON mentions(user_id, room_id, message_id);
@@ -0,0 +1,15 @@
+-- Replies point to the root message of their thread through parent_id. Threads are one level deep.
+CREATE INDEX idx_messages_parent ON messages(parent_id, id) WHERE parent_id IS NOT NULL;
+
+-- Users following a thread are notified of its new replies. The root's author and everyone who replies
+-- follow it automatically, unless they unfollowed it, which is kept as following = FALSE.
+CREATE TABLE thread_follows (
+  message_id BIGINT NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+  user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  following BOOLEAN NOT NULL DEFAULT TRUE,
+  created_at TIMESTAMPTZ DEFAULT NOW(),
+  updated_at TIMESTAMPTZ DEFAULT NOW(),
+  PRIMARY KEY (message_id, user_id)
+);
+
+CREATE INDEX idx_thread_follows_user ON thread_follows(user_id);
@@ -0,0 +1,9 @@
+-- Messages pinned in their room by its admins and moderators. A message is pinned at most once.
+CREATE TABLE pinned_messages (
+  message_id BIGINT PRIMARY KEY REFERENCES messages(id) ON DELETE CASCADE,
+  room_id UUID NOT NULL REFERENCES rooms(id) ON DELETE CASCADE,
+  pinned_by UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  pinned_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_pinned_messages_room ON pinned_messages(room_id, pinned_at DESC);
@@ -0,0 +1,22 @@
+-- Messages waiting to be sent: at a time chosen by their sender, or once the undo send window of an
+-- ordinary message has passed. A row is deleted when its message is handed to the message writer or its
+-- send is canceled, so every row is a pending send.
+CREATE TABLE scheduled_messages (
+  id BIGSERIAL PRIMARY KEY,
+  room_id UUID NOT NULL REFERENCES rooms(id) ON DELETE CASCADE,
+  user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  content TEXT NOT NULL,
+  message_type TEXT NOT NULL DEFAULT 'text' CHECK (message_type IN ('text', 'image', 'file')),
+  file_url TEXT NOT NULL DEFAULT '',
+  parent_id BIGINT REFERENCES messages(id) ON DELETE CASCADE,
+  -- Becomes the message's client_msg_id, so that a message handed over twice is stored once
+  client_msg_id TEXT NOT NULL,
+  undo_send BOOLEAN NOT NULL DEFAULT FALSE,
+  send_at TIMESTAMPTZ NOT NULL,
+  created_at TIMESTAMPTZ DEFAULT NOW(),
+  updated_at TIMESTAMPTZ DEFAULT NOW(),
+  UNIQUE (room_id, user_id, client_msg_id)
+);
+
+CREATE INDEX idx_scheduled_messages_send_at ON scheduled_messages(send_at);
+CREATE INDEX idx_scheduled_messages_user ON scheduled_messages(user_id, send_at);
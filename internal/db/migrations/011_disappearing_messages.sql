@@ -0,0 +1,17 @@
+-- Disappearing messages: a room can make its messages expire a number of seconds after they are sent
+-- or after they are first read, and a message can be sent with a shorter lifetime of its own. Expired
+-- messages are hard-deleted by the expirer.
+ALTER TABLE rooms ADD COLUMN message_ttl_seconds INTEGER CHECK (message_ttl_seconds > 0);
+ALTER TABLE rooms ADD COLUMN message_ttl_after TEXT NOT NULL DEFAULT 'sent' CHECK (message_ttl_after IN ('sent', 'read'));
+
+-- The lifetime of a message is fixed when it is stored. Its expires_at is set then if it expires after
+-- being sent, or when a member other than its sender first reads it if it expires after being read.
+ALTER TABLE messages ADD COLUMN ttl_seconds INTEGER CHECK (ttl_seconds > 0);
+ALTER TABLE messages ADD COLUMN expire_on_read BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE messages ADD COLUMN expires_at TIMESTAMPTZ;
+
+CREATE INDEX idx_messages_expires_at ON messages(expires_at) WHERE expires_at IS NOT NULL;
+CREATE INDEX idx_messages_expire_on_read ON messages(room_id, id) WHERE expire_on_read AND expires_at IS NULL;
+
+-- The lifetime a scheduled message was sent with
+ALTER TABLE scheduled_messages ADD COLUMN ttl_seconds INTEGER CHECK (ttl_seconds > 0);
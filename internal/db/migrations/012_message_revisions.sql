@@ -0,0 +1,17 @@
+-- Edit history: every version of a message's content. Revision 0 is the content the message was sent
+-- with and each edit adds the next revision, which messages.revision points to.
+ALTER TABLE messages ADD COLUMN revision INTEGER NOT NULL DEFAULT 0;
+
+CREATE TABLE message_revisions (
+  message_id BIGINT NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+  revision INTEGER NOT NULL,
+  content TEXT NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  PRIMARY KEY (message_id, revision)
+);
+
+-- Messages edited before revisions were kept have lost what they were sent with, so their history
+-- starts at their current content
+UPDATE messages SET revision = 1 WHERE edited_at IS NOT NULL;
+INSERT INTO message_revisions (message_id, revision, content, created_at)
+SELECT id, 1, content, edited_at FROM messages WHERE edited_at IS NOT NULL;
@@ -0,0 +1,39 @@
+-- Polls are messages of type poll, whose content is the question
+ALTER TABLE messages DROP CONSTRAINT messages_message_type_check;
+ALTER TABLE messages ADD CONSTRAINT messages_message_type_check
+  CHECK (message_type IN ('text', 'image', 'file', 'system', 'poll'));
+
+-- The final counts are frozen when a poll closes, and stay NULL while it is open
+CREATE TABLE polls (
+  message_id BIGINT PRIMARY KEY REFERENCES messages(id) ON DELETE CASCADE,
+  multiple_choice BOOLEAN NOT NULL DEFAULT FALSE,
+  anonymous BOOLEAN NOT NULL DEFAULT FALSE,
+  closes_at TIMESTAMPTZ,
+  closed_at TIMESTAMPTZ,
+  final_voter_count INTEGER,
+  created_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+CREATE INDEX idx_polls_closes_at ON polls(closes_at) WHERE closed_at IS NULL AND closes_at IS NOT NULL;
+
+-- Options are numbered from 1 in the order they were given
+CREATE TABLE poll_options (
+  poll_id BIGINT NOT NULL REFERENCES polls(message_id) ON DELETE CASCADE,
+  id INTEGER NOT NULL,
+  text TEXT NOT NULL,
+  final_vote_count INTEGER,
+  PRIMARY KEY (poll_id, id)
+);
+
+-- Votes of anonymous polls are stored with their voter too, so that they can be changed and retracted,
+-- but voters are only ever shown for polls with visible votes
+CREATE TABLE poll_votes (
+  poll_id BIGINT NOT NULL,
+  option_id INTEGER NOT NULL,
+  user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  created_at TIMESTAMPTZ DEFAULT NOW(),
+  PRIMARY KEY (poll_id, option_id, user_id),
+  FOREIGN KEY (poll_id, option_id) REFERENCES poll_options(poll_id, id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_poll_votes_user ON poll_votes(poll_id, user_id);
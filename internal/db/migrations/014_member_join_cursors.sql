@@ -0,0 +1,10 @@
+-- Members only receive the messages sent after they joined: messages up to joined_after_message_id
+-- do not count them as recipients, so their read cursor starting at the room's last message does not
+-- mark older messages as read by them.
+ALTER TABLE room_members ADD COLUMN joined_after_message_id BIGINT NOT NULL DEFAULT 0;
+
+-- Existing members joined after the last message sent before their joined_at
+UPDATE room_members rm
+SET joined_after_message_id = COALESCE((
+  SELECT MAX(m.id) FROM messages m WHERE m.room_id = rm.room_id AND m.created_at < rm.joined_at
+), 0);
@@ -2,11 +2,13 @@ package db
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"time"
 
 	"github.com/dukepan/multi-rooms-chat-back/internal/models"
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
 )
 
 // User queries
@@ -53,14 +55,37 @@ func (db *Database) UpdateUserStatus(ctx context.Context, userID uuid.UUID, stat
 	return err
 }
 
+// GetPresentUserIDs returns the users whose stored status is online or away.
+func (db *Database) GetPresentUserIDs(ctx context.Context) ([]uuid.UUID, error) {
+	rows, err := db.pool.Query(ctx, `SELECT id FROM users WHERE status <> 'offline'`)
+	if err != nil {
+		return nil, err
+	}
+	return scanUserIDs(rows)
+}
+
+// MarkUserOffline stores that a user is offline. It returns false if they already were, so that only
+// one of several nodes noticing it publishes the change.
+func (db *Database) MarkUserOffline(ctx context.Context, userID uuid.UUID) (bool, error) {
+	tag, err := db.pool.Exec(ctx,
+		`UPDATE users SET status = 'offline', last_seen = NOW() WHERE id = $1 AND status <> 'offline'`,
+		userID,
+	)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
 // Room queries
 func (db *Database) GetRoomByID(ctx context.Context, roomID uuid.UUID) (*models.Room, error) {
 	var room models.Room
 	err := db.pool.QueryRow(ctx,
-		`SELECT id, name, type, creator_id, topic, is_archived, created_at 
+		`SELECT id, name, type, creator_id, topic, is_archived, created_at, message_ttl_seconds, message_ttl_after 
 		 FROM rooms WHERE id = $1`,
 		roomID,
-	).Scan(&room.ID, &room.Name, &room.Type, &room.CreatorID, &room.Topic, &room.IsArchived, &room.CreatedAt)
+	).Scan(&room.ID, &room.Name, &room.Type, &room.CreatorID, &room.Topic, &room.IsArchived, &room.CreatedAt,
+		&room.MessageTTLSeconds, &room.MessageTTLAfter)
 	return &room, err
 }
 
@@ -89,6 +114,50 @@ func (db *Database) GetRoomsByUser(ctx context.Context, userID uuid.UUID) ([]mod
 	return rooms, rows.Err()
 }
 
+// GetUserRooms returns the rooms of a user with their read state: the number of unread messages sent by
+// others and how many of them mention the user in mentions they have not marked as seen. Expired messages
+// are not counted, and neither are thread replies unless they mention the user: like the room timeline
+// without replies, the unread count only covers the messages posted to the room itself.
+func (db *Database) GetUserRooms(ctx context.Context, userID uuid.UUID) ([]models.UserRoom, error) {
+	rows, err := db.pool.Query(ctx,
+		`SELECT r.id, r.name, r.type, r.creator_id, COALESCE(r.topic, ''), r.is_archived, r.created_at,
+		   r.message_ttl_seconds, r.message_ttl_after, rm.last_read_message_id, unread.total, unread_mentions.total
+		 FROM rooms r
+		 INNER JOIN room_members rm ON r.id = rm.room_id
+		 CROSS JOIN LATERAL (
+		   SELECT COUNT(*) AS total
+		   FROM messages m
+		   WHERE m.room_id = r.id AND m.id > rm.last_read_message_id AND m.user_id <> rm.user_id AND m.deleted_at IS NULL
+		     AND m.parent_id IS NULL AND (m.expires_at IS NULL OR m.expires_at > NOW())
+		 ) unread
+		 CROSS JOIN LATERAL (
+		   SELECT COUNT(*) AS total
+		   FROM mentions mn
+		   INNER JOIN messages m ON m.id = mn.message_id
+		   WHERE mn.user_id = rm.user_id AND mn.room_id = r.id AND mn.message_id > rm.last_read_message_id
+		     AND mn.seen_at IS NULL AND m.deleted_at IS NULL AND (m.expires_at IS NULL OR m.expires_at > NOW())
+		 ) unread_mentions
+		 WHERE rm.user_id = $1 AND r.is_archived = false
+		 ORDER BY r.created_at DESC`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rooms []models.UserRoom
+	for rows.Next() {
+		var room models.UserRoom
+		if err := rows.Scan(&room.ID, &room.Name, &room.Type, &room.CreatorID, &room.Topic, &room.IsArchived, &room.CreatedAt,
+			&room.MessageTTLSeconds, &room.MessageTTLAfter, &room.LastReadMessageID, &room.UnreadCount, &room.UnreadMentionCount); err != nil {
+			return nil, err
+		}
+		rooms = append(rooms, room)
+	}
+	return rooms, rows.Err()
+}
+
 func (db *Database) CreateRoom(ctx context.Context, name, roomType string, creatorID uuid.UUID) (*models.Room, error) {
 	room := &models.Room{
 		ID:        uuid.New(),
@@ -108,9 +177,12 @@ func (db *Database) CreateRoom(ctx context.Context, name, roomType string, creat
 }
 
 // Room member queries
+// AddRoomMember adds a user to a room. The messages sent before they joined count as read.
 func (db *Database) AddRoomMember(ctx context.Context, roomID, userID uuid.UUID, role string) error {
 	_, err := db.pool.Exec(ctx,
-		`INSERT INTO room_members (room_id, user_id, role) VALUES ($1, $2, $3)
+		`WITH last AS (SELECT COALESCE(MAX(id), 0) AS id FROM messages WHERE room_id = $1)
+		 INSERT INTO room_members (room_id, user_id, role, last_read_message_id, joined_after_message_id)
+		 SELECT $1, $2, $3, last.id, last.id FROM last
 		 ON CONFLICT (room_id, user_id) DO NOTHING`,
 		roomID, userID, role,
 	)
@@ -134,54 +206,183 @@ func (db *Database) IsRoomMember(ctx context.Context, roomID, userID uuid.UUID)
 	return exists, err
 }
 
+// GetRoomMemberRole returns the role of a member of a room, or pgx.ErrNoRows if the user is not a member.
+func (db *Database) GetRoomMemberRole(ctx context.Context, roomID, userID uuid.UUID) (string, error) {
+	var role string
+	err := db.pool.QueryRow(ctx,
+		`SELECT COALESCE(role, 'member') FROM room_members WHERE room_id = $1 AND user_id = $2`,
+		roomID, userID,
+	).Scan(&role)
+	return role, err
+}
+
+// BanRoomMember removes a user from a room and records the ban so that they cannot be added back.
+func (db *Database) BanRoomMember(ctx context.Context, roomID, userID, bannedBy uuid.UUID, reason string) error {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx,
+		`DELETE FROM room_members WHERE room_id = $1 AND user_id = $2`,
+		roomID, userID,
+	); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx,
+		`INSERT INTO room_bans (room_id, user_id, banned_by, reason) VALUES ($1, $2, $3, NULLIF($4, ''))
+		 ON CONFLICT (room_id, user_id) DO UPDATE SET banned_by = EXCLUDED.banned_by, reason = EXCLUDED.reason, created_at = NOW()`,
+		roomID, userID, bannedBy, reason,
+	); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// UnbanRoomMember lifts a user's ban from a room.
+func (db *Database) UnbanRoomMember(ctx context.Context, roomID, userID uuid.UUID) error {
+	_, err := db.pool.Exec(ctx,
+		`DELETE FROM room_bans WHERE room_id = $1 AND user_id = $2`,
+		roomID, userID,
+	)
+	return err
+}
+
+// IsRoomBanned reports whether a user is banned from a room.
+func (db *Database) IsRoomBanned(ctx context.Context, roomID, userID uuid.UUID) (bool, error) {
+	var exists bool
+	err := db.pool.QueryRow(ctx,
+		`SELECT EXISTS(SELECT 1 FROM room_bans WHERE room_id = $1 AND user_id = $2)`,
+		roomID, userID,
+	).Scan(&exists)
+	return exists, err
+}
+
 // Message queries
 func (db *Database) GetMessageByID(ctx context.Context, messageID int64) (*models.Message, error) {
 	var msg models.Message
 	err := db.pool.QueryRow(ctx,
-		`SELECT id, room_id, user_id, content, message_type, file_url, parent_id, edited_at, deleted_at, created_at 
+		`SELECT id, room_id, user_id, content, message_type, file_url, parent_id, edited_at, revision, deleted_at, created_at, ttl_seconds, expires_at 
 		 FROM messages WHERE id = $1 AND deleted_at IS NULL`,
 		messageID,
-	).Scan(&msg.ID, &msg.RoomID, &msg.UserID, &msg.Content, &msg.MessageType, &msg.FileURL, &msg.ParentID, &msg.EditedAt, &msg.DeletedAt, &msg.CreatedAt)
+	).Scan(&msg.ID, &msg.RoomID, &msg.UserID, &msg.Content, &msg.MessageType, &msg.FileURL, &msg.ParentID, &msg.EditedAt, &msg.Revision, &msg.DeletedAt, &msg.CreatedAt,
+		&msg.TTLSeconds, &msg.ExpiresAt)
 	return &msg, err
 }
 
-func (db *Database) GetRoomMessages(ctx context.Context, roomID uuid.UUID, limit int, before int64) ([]models.Message, error) {
-	query := `SELECT id, room_id, user_id, content, message_type, file_url, parent_id, edited_at, deleted_at, created_at 
-	          FROM messages 
-	          WHERE room_id = $1 AND deleted_at IS NULL`
+// GetRoomMessages returns the messages of a room newest first, each thread root with a summary of its
+// replies. Only messages before the given message ID are returned when before is set, and replies are
+// left out with excludeReplies, so that they only show up in their thread. Expired messages the expirer
+// has not deleted yet are left out too.
+func (db *Database) GetRoomMessages(ctx context.Context, roomID uuid.UUID, limit int, before int64, excludeReplies bool) ([]models.Message, error) {
+	query := `SELECT ` + threadMessageColumns + `
+	          FROM messages m ` + threadSummaryJoin + `
+	          WHERE m.room_id = $1 AND m.deleted_at IS NULL AND (m.expires_at IS NULL OR m.expires_at > NOW())`
 	args := []interface{}{roomID}
 
 	if before > 0 {
-		query += ` AND id < $2`
 		args = append(args, before)
+		query += fmt.Sprintf(` AND m.id < $%d`, len(args))
+	}
+	if excludeReplies {
+		query += ` AND m.parent_id IS NULL`
 	}
 
-	query += ` ORDER BY created_at DESC LIMIT $` + string(rune(len(args)+1))
 	args = append(args, limit)
+	query += fmt.Sprintf(` ORDER BY m.created_at DESC LIMIT $%d`, len(args))
 
 	rows, err := db.pool.Query(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
+	return scanThreadMessages(rows)
+}
+
+// threadMessageColumns selects a message m along with the summary of its replies joined by threadSummaryJoin.
+const threadMessageColumns = `m.id, m.room_id, m.user_id, m.content, m.message_type, m.file_url, m.parent_id, m.edited_at, m.revision, m.deleted_at, m.created_at,
+	m.ttl_seconds, m.expires_at, t.reply_count, t.id, t.user_id, t.created_at`
+
+// threadSummaryJoin joins the count of a message's replies that were not deleted, and its latest reply.
+const threadSummaryJoin = `LEFT JOIN LATERAL (
+	  SELECT COUNT(*) OVER () AS reply_count, r.id, r.user_id, r.created_at
+	  FROM messages r
+	  WHERE r.parent_id = m.id AND r.deleted_at IS NULL
+	  ORDER BY r.id DESC LIMIT 1
+	) t ON TRUE`
+
+func scanThreadMessages(rows pgx.Rows) ([]models.Message, error) {
 	defer rows.Close()
 
 	var messages []models.Message
 	for rows.Next() {
 		var msg models.Message
-		if err := rows.Scan(&msg.ID, &msg.RoomID, &msg.UserID, &msg.Content, &msg.MessageType, &msg.FileURL, &msg.ParentID, &msg.EditedAt, &msg.DeletedAt, &msg.CreatedAt); err != nil {
+		var replyCount *int
+		var lastReplyID *int64
+		var lastReplyUserID *uuid.UUID
+		var lastReplyAt *time.Time
+		if err := rows.Scan(&msg.ID, &msg.RoomID, &msg.UserID, &msg.Content, &msg.MessageType, &msg.FileURL, &msg.ParentID, &msg.EditedAt, &msg.Revision, &msg.DeletedAt, &msg.CreatedAt,
+			&msg.TTLSeconds, &msg.ExpiresAt, &replyCount, &lastReplyID, &lastReplyUserID, &lastReplyAt); err != nil {
 			return nil, err
 		}
+		if replyCount != nil {
+			msg.Thread = &models.ThreadSummary{
+				ReplyCount:      *replyCount,
+				LastReplyID:     *lastReplyID,
+				LastReplyUserID: *lastReplyUserID,
+				LastReplyAt:     *lastReplyAt,
+			}
+		}
 		messages = append(messages, msg)
 	}
 	return messages, rows.Err()
 }
 
-func (db *Database) CreateMessage(ctx context.Context, msg *models.Message) error {
-	return db.pool.QueryRow(ctx,
-		`INSERT INTO messages (room_id, user_id, content, message_type, file_url, parent_id) 
-		 VALUES ($1, $2, $3, $4, $5, $6) RETURNING id, created_at`,
-		msg.RoomID, msg.UserID, msg.Content, msg.MessageType, msg.FileURL, msg.ParentID,
+// CreateMessage inserts a message. See CreateMessageTx for how duplicates are reported.
+func (db *Database) CreateMessage(ctx context.Context, msg *models.Message) (bool, error) {
+	return createMessage(ctx, db.pool, msg)
+}
+
+// CreateMessageTx inserts a message within tx. It returns false if a message with the same
+// client_msg_id was already stored by the same user in the same room, in which case msg is
+// populated with the canonical ID and creation time of the existing message.
+func (db *Database) CreateMessageTx(ctx context.Context, tx pgx.Tx, msg *models.Message) (bool, error) {
+	return createMessage(ctx, tx, msg)
+}
+
+// rowQuerier is implemented by both the pool and transactions.
+type rowQuerier interface {
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
+}
+
+// createMessage stores msg with the lifetime of the room's disappearing messages, or msg.TTLSeconds if
+// it is shorter, and fills in msg.TTLSeconds and msg.ExpiresAt accordingly.
+func createMessage(ctx context.Context, q rowQuerier, msg *models.Message) (bool, error) {
+	err := q.QueryRow(ctx,
+		`INSERT INTO messages (room_id, user_id, content, message_type, file_url, parent_id, client_msg_id, ttl_seconds, expire_on_read, expires_at) 
+		 SELECT $1, $2, $3, $4, $5, $6, NULLIF($7, ''), ttl.seconds, ttl.on_read,
+		   CASE WHEN ttl.seconds IS NOT NULL AND NOT ttl.on_read THEN NOW() + make_interval(secs => ttl.seconds) END
+		 FROM (
+		   SELECT LEAST($8::int, r.message_ttl_seconds) AS seconds, r.message_ttl_after = 'read' AS on_read
+		   FROM rooms r WHERE r.id = $1
+		 ) ttl
+		 ON CONFLICT (room_id, user_id, client_msg_id) WHERE client_msg_id IS NOT NULL DO NOTHING
+		 RETURNING id, created_at, ttl_seconds, expires_at`,
+		msg.RoomID, msg.UserID, msg.Content, msg.MessageType, msg.FileURL, msg.ParentID, msg.ClientMsgID, msg.TTLSeconds,
+	).Scan(&msg.ID, &msg.CreatedAt, &msg.TTLSeconds, &msg.ExpiresAt)
+	if err == nil {
+		return true, nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return false, err
+	}
+
+	// The insert was skipped because the client already sent this message
+	err = q.QueryRow(ctx,
+		`SELECT id, created_at FROM messages WHERE room_id = $1 AND user_id = $2 AND client_msg_id = $3`,
+		msg.RoomID, msg.UserID, msg.ClientMsgID,
 	).Scan(&msg.ID, &msg.CreatedAt)
+	return false, err
 }
 
 // SearchMessages searches messages in a room with enhanced filtering and ranking
@@ -233,23 +434,209 @@ func (db *Database) SearchMessages(ctx context.Context, roomID uuid.UUID, query
 	return messages, rows.Err()
 }
 
-// Read receipt queries
-func (db *Database) MarkMessageRead(ctx context.Context, messageID int64, userID uuid.UUID) error {
-	_, err := db.pool.Exec(ctx,
-		`INSERT INTO message_reads (message_id, user_id) VALUES ($1, $2)
-		 ON CONFLICT DO NOTHING`,
-		messageID, userID,
+// Read cursor queries
+
+// AdvanceReadCursor moves a member's read cursor in a room forward to messageID. It returns the previous
+// cursor, or pgx.ErrNoRows if the cursor was already at or past messageID or the user is not a member.
+func (db *Database) AdvanceReadCursor(ctx context.Context, roomID, userID uuid.UUID, messageID int64) (int64, error) {
+	var previous int64
+	err := db.pool.QueryRow(ctx,
+		`WITH old AS (
+		   SELECT last_read_message_id FROM room_members WHERE room_id = $1 AND user_id = $2 FOR UPDATE
+		 )
+		 UPDATE room_members rm SET last_read_message_id = $3, last_read_at = NOW()
+		 FROM old
+		 WHERE rm.room_id = $1 AND rm.user_id = $2 AND rm.last_read_message_id < $3
+		 RETURNING old.last_read_message_id`,
+		roomID, userID, messageID,
+	).Scan(&previous)
+	return previous, err
+}
+
+// GetReadCursor returns the ID of the last message a member has read in a room, or pgx.ErrNoRows if
+// the user is not a member.
+func (db *Database) GetReadCursor(ctx context.Context, roomID, userID uuid.UUID) (int64, error) {
+	var cursor int64
+	err := db.pool.QueryRow(ctx,
+		`SELECT last_read_message_id FROM room_members WHERE room_id = $1 AND user_id = $2`,
+		roomID, userID,
+	).Scan(&cursor)
+	return cursor, err
+}
+
+// GetMessagesReadInRange returns the IDs of the messages of other users in a room that a member read by
+// moving their cursor from after to upTo, newest first and at most limit of them.
+func (db *Database) GetMessagesReadInRange(ctx context.Context, roomID, userID uuid.UUID, after, upTo int64, limit int) ([]int64, error) {
+	rows, err := db.pool.Query(ctx,
+		`SELECT id FROM messages
+		 WHERE room_id = $1 AND id > $2 AND id <= $3 AND user_id <> $4 AND deleted_at IS NULL
+		 ORDER BY id DESC LIMIT $5`,
+		roomID, after, upTo, userID, limit,
 	)
-	return err
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messageIDs []int64
+	for rows.Next() {
+		var messageID int64
+		if err := rows.Scan(&messageID); err != nil {
+			return nil, err
+		}
+		messageIDs = append(messageIDs, messageID)
+	}
+	return messageIDs, rows.Err()
 }
 
-// EditMessage updates the content of a message.
-func (db *Database) EditMessage(ctx context.Context, messageID int64, userID uuid.UUID, newContent string) error {
-	_, err := db.pool.Exec(ctx,
-		`UPDATE messages SET content = $1, edited_at = NOW() WHERE id = $2 AND user_id = $3 AND deleted_at IS NULL`,
+// RecordDeliveries stores that messages reached their recipients, given as parallel slices. It returns
+// the IDs of the messages that were delivered to someone for the first time.
+func (db *Database) RecordDeliveries(ctx context.Context, messageIDs []int64, userIDs []uuid.UUID) ([]int64, error) {
+	users := make([]string, len(userIDs))
+	for i, userID := range userIDs {
+		users[i] = userID.String()
+	}
+	rows, err := db.pool.Query(ctx,
+		`INSERT INTO message_deliveries (message_id, user_id)
+		 SELECT r.message_id, r.user_id FROM unnest($1::bigint[], $2::uuid[]) AS r(message_id, user_id)
+		 WHERE EXISTS (SELECT 1 FROM messages m WHERE m.id = r.message_id)
+		 ON CONFLICT DO NOTHING
+		 RETURNING message_id`,
+		messageIDs, users,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var delivered []int64
+	for rows.Next() {
+		var messageID int64
+		if err := rows.Scan(&messageID); err != nil {
+			return nil, err
+		}
+		delivered = append(delivered, messageID)
+	}
+	return delivered, rows.Err()
+}
+
+// GetMessageDeliveries returns the recipients a message was delivered to.
+func (db *Database) GetMessageDeliveries(ctx context.Context, messageID int64) ([]models.MessageDelivery, error) {
+	rows, err := db.pool.Query(ctx,
+		`SELECT message_id, user_id, delivered_at FROM message_deliveries WHERE message_id = $1`,
+		messageID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []models.MessageDelivery
+	for rows.Next() {
+		var delivery models.MessageDelivery
+		if err := rows.Scan(&delivery.MessageID, &delivery.UserID, &delivery.DeliveredAt); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, rows.Err()
+}
+
+// GetReceiptSummaries counts, for each message, its recipients (the room's members other than the
+// sender who joined before it was sent) and how many of them it was delivered to and read by.
+func (db *Database) GetReceiptSummaries(ctx context.Context, messageIDs []int64) ([]models.ReceiptSummary, error) {
+	rows, err := db.pool.Query(ctx,
+		`SELECT m.id, m.room_id, m.user_id,
+		   (SELECT COUNT(*) FROM room_members rm
+		    WHERE rm.room_id = m.room_id AND rm.user_id <> m.user_id AND rm.joined_after_message_id < m.id),
+		   (SELECT COUNT(*) FROM message_deliveries d
+		    INNER JOIN room_members rm ON rm.room_id = m.room_id AND rm.user_id = d.user_id
+		    WHERE d.message_id = m.id AND d.user_id <> m.user_id AND rm.joined_after_message_id < m.id),
+		   (SELECT COUNT(*) FROM room_members rm
+		    WHERE rm.room_id = m.room_id AND rm.user_id <> m.user_id AND rm.joined_after_message_id < m.id AND rm.last_read_message_id >= m.id)
+		 FROM messages m WHERE m.id = ANY($1) AND m.deleted_at IS NULL`,
+		messageIDs,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var summaries []models.ReceiptSummary
+	for rows.Next() {
+		var summary models.ReceiptSummary
+		if err := rows.Scan(&summary.MessageID, &summary.RoomID, &summary.SenderID, &summary.RecipientCount, &summary.DeliveredCount, &summary.ReadCount); err != nil {
+			return nil, err
+		}
+		summaries = append(summaries, summary)
+	}
+	return summaries, rows.Err()
+}
+
+// EditMessage updates the content of a user's message and stores it as the message's next revision,
+// which it returns. It returns pgx.ErrNoRows if the message is not the user's or was deleted.
+func (db *Database) EditMessage(ctx context.Context, messageID int64, userID uuid.UUID, newContent string) (int, error) {
+	tx, err := db.pool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	var revision int
+	var previous string
+	var createdAt, editedAt time.Time
+	err = tx.QueryRow(ctx,
+		`UPDATE messages m SET content = $1, edited_at = NOW(), revision = m.revision + 1
+		 FROM (SELECT id, content FROM messages WHERE id = $2 FOR UPDATE) old
+		 WHERE m.id = old.id AND m.user_id = $3 AND m.deleted_at IS NULL
+		 RETURNING m.revision, old.content, m.created_at, m.edited_at`,
 		newContent, messageID, userID,
+	).Scan(&revision, &previous, &createdAt, &editedAt)
+	if err != nil {
+		return 0, err
+	}
+
+	// The content the message was sent with is only kept once it is first edited
+	if revision == 1 {
+		if _, err := tx.Exec(ctx,
+			`INSERT INTO message_revisions (message_id, revision, content, created_at) VALUES ($1, 0, $2, $3)`,
+			messageID, previous, createdAt,
+		); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := tx.Exec(ctx,
+		`INSERT INTO message_revisions (message_id, revision, content, created_at) VALUES ($1, $2, $3, $4)`,
+		messageID, revision, newContent, editedAt,
+	); err != nil {
+		return 0, err
+	}
+	return revision, tx.Commit(ctx)
+}
+
+// GetMessageRevisions returns the stored versions of a message's content, oldest first. Messages that
+// were never edited have none.
+func (db *Database) GetMessageRevisions(ctx context.Context, messageID int64) ([]models.MessageRevision, error) {
+	rows, err := db.pool.Query(ctx,
+		`SELECT message_id, revision, content, created_at FROM message_revisions
+		 WHERE message_id = $1
+		 ORDER BY revision`,
+		messageID,
 	)
-	return err
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var revisions []models.MessageRevision
+	for rows.Next() {
+		var revision models.MessageRevision
+		if err := rows.Scan(&revision.MessageID, &revision.Revision, &revision.Content, &revision.CreatedAt); err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, revision)
+	}
+	return revisions, rows.Err()
 }
 
 // SoftDeleteMessage marks a message as deleted.
@@ -261,9 +648,14 @@ func (db *Database) SoftDeleteMessage(ctx context.Context, messageID int64, user
 	return err
 }
 
+// GetMessageReads returns the recipients whose read cursor has passed a message. ReadAt is when the cursor
+// last moved, which may be later than when the message itself was read.
 func (db *Database) GetMessageReads(ctx context.Context, messageID int64) ([]models.MessageRead, error) {
 	rows, err := db.pool.Query(ctx,
-		`SELECT message_id, user_id, read_at FROM message_reads WHERE message_id = $1`,
+		`SELECT m.id, rm.user_id, COALESCE(rm.last_read_at, rm.joined_at)
+		 FROM messages m
+		 INNER JOIN room_members rm ON rm.room_id = m.room_id
+		 WHERE m.id = $1 AND rm.user_id <> m.user_id AND rm.joined_after_message_id < m.id AND rm.last_read_message_id >= m.id`,
 		messageID,
 	)
 	if err != nil {
@@ -320,3 +712,624 @@ func (db *Database) GetMessageReactions(ctx context.Context, messageID int64) ([
 	}
 	return reactions, rows.Err()
 }
+
+// Mention queries
+
+// GetRoomMemberIDsByUsername returns the members of a room whose username is one of usernames,
+// compared case-insensitively.
+func (db *Database) GetRoomMemberIDsByUsername(ctx context.Context, roomID uuid.UUID, usernames []string) ([]uuid.UUID, error) {
+	rows, err := db.pool.Query(ctx,
+		`SELECT rm.user_id FROM room_members rm
+		 INNER JOIN users u ON u.id = rm.user_id
+		 WHERE rm.room_id = $1 AND lower(u.username) = ANY($2)`,
+		roomID, usernames,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanUserIDs(rows)
+}
+
+// GetRoomMemberIDs returns the members of a room. With onlineOnly, only the members whose status is
+// online are returned.
+func (db *Database) GetRoomMemberIDs(ctx context.Context, roomID uuid.UUID, onlineOnly bool) ([]uuid.UUID, error) {
+	rows, err := db.pool.Query(ctx,
+		`SELECT rm.user_id FROM room_members rm
+		 INNER JOIN users u ON u.id = rm.user_id
+		 WHERE rm.room_id = $1 AND (NOT $2 OR u.status = 'online')`,
+		roomID, onlineOnly,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanUserIDs(rows)
+}
+
+func scanUserIDs(rows pgx.Rows) ([]uuid.UUID, error) {
+	defer rows.Close()
+
+	var userIDs []uuid.UUID
+	for rows.Next() {
+		var userID uuid.UUID
+		if err := rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+		userIDs = append(userIDs, userID)
+	}
+	return userIDs, rows.Err()
+}
+
+// CreateMentions stores mentions of a message. Users already mentioned in the message are skipped, so
+// that storing the mentions of a resent or edited message again only returns the new ones. It returns
+// the mentions that were stored, with their creation time.
+func (db *Database) CreateMentions(ctx context.Context, mentions []models.Mention) ([]models.Mention, error) {
+	if len(mentions) == 0 {
+		return nil, nil
+	}
+	users := make([]string, len(mentions))
+	kinds := make([]string, len(mentions))
+	for i, mention := range mentions {
+		users[i] = mention.UserID.String()
+		kinds[i] = mention.Kind
+	}
+	first := mentions[0]
+	rows, err := db.pool.Query(ctx,
+		`INSERT INTO mentions (message_id, user_id, room_id, mentioned_by, kind)
+		 SELECT $1, r.user_id, $2, $3, r.kind FROM unnest($4::uuid[], $5::text[]) AS r(user_id, kind)
+		 ON CONFLICT DO NOTHING
+		 RETURNING user_id, kind, created_at`,
+		first.MessageID, first.RoomID, first.MentionedBy, users, kinds,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var created []models.Mention
+	for rows.Next() {
+		mention := first
+		if err := rows.Scan(&mention.UserID, &mention.Kind, &mention.CreatedAt); err != nil {
+			return nil, err
+		}
+		created = append(created, mention)
+	}
+	return created, rows.Err()
+}
+
+// GetUserMentions returns the mentions of a user in messages that were not deleted, in the rooms the user
+// is still a member of, newest first. Only mentions in messages before the given message ID are returned
+// when before is set, and only those not seen yet with unseenOnly.
+func (db *Database) GetUserMentions(ctx context.Context, userID uuid.UUID, before int64, limit int, unseenOnly bool) ([]models.Mention, error) {
+	rows, err := db.pool.Query(ctx,
+		`SELECT mn.message_id, mn.room_id, mn.user_id, mn.mentioned_by, mn.kind, m.content, mn.seen_at, mn.created_at
+		 FROM mentions mn
+		 INNER JOIN messages m ON m.id = mn.message_id
+		 INNER JOIN room_members rm ON rm.room_id = mn.room_id AND rm.user_id = mn.user_id
+		 WHERE mn.user_id = $1 AND ($2 = 0 OR mn.message_id < $2) AND (NOT $3 OR mn.seen_at IS NULL)
+		   AND m.deleted_at IS NULL
+		 ORDER BY mn.message_id DESC LIMIT $4`,
+		userID, before, unseenOnly, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var mentions []models.Mention
+	for rows.Next() {
+		var mention models.Mention
+		if err := rows.Scan(&mention.MessageID, &mention.RoomID, &mention.UserID, &mention.MentionedBy, &mention.Kind,
+			&mention.Content, &mention.SeenAt, &mention.CreatedAt); err != nil {
+			return nil, err
+		}
+		mentions = append(mentions, mention)
+	}
+	return mentions, rows.Err()
+}
+
+// MarkMentionsSeen marks the mentions of a user in the given messages, and in every message up to
+// upTo when it is set, as seen. It returns the number of mentions that were not seen before.
+func (db *Database) MarkMentionsSeen(ctx context.Context, userID uuid.UUID, messageIDs []int64, upTo int64) (int64, error) {
+	tag, err := db.pool.Exec(ctx,
+		`UPDATE mentions SET seen_at = NOW()
+		 WHERE user_id = $1 AND seen_at IS NULL AND (message_id = ANY($2::bigint[]) OR message_id <= $3)`,
+		userID, messageIDs, upTo,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+// Thread queries
+
+// GetThreadReplies returns the replies to a message that were not deleted, oldest first. Only replies
+// after the given message ID are returned when after is set.
+func (db *Database) GetThreadReplies(ctx context.Context, rootID int64, after int64, limit int) ([]models.Message, error) {
+	rows, err := db.pool.Query(ctx,
+		`SELECT `+threadMessageColumns+`
+		 FROM messages m `+threadSummaryJoin+`
+		 WHERE m.parent_id = $1 AND m.id > $2 AND m.deleted_at IS NULL AND (m.expires_at IS NULL OR m.expires_at > NOW())
+		 ORDER BY m.id LIMIT $3`,
+		rootID, after, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanThreadMessages(rows)
+}
+
+// GetThreadSummary counts the replies to a message that were not deleted and returns its latest reply.
+// A message without replies gets a summary with a reply count of 0.
+func (db *Database) GetThreadSummary(ctx context.Context, rootID int64) (*models.ThreadSummary, error) {
+	var summary models.ThreadSummary
+	err := db.pool.QueryRow(ctx,
+		`SELECT COUNT(*) OVER (), id, user_id, created_at FROM messages
+		 WHERE parent_id = $1 AND deleted_at IS NULL
+		 ORDER BY id DESC LIMIT 1`,
+		rootID,
+	).Scan(&summary.ReplyCount, &summary.LastReplyID, &summary.LastReplyUserID, &summary.LastReplyAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return &models.ThreadSummary{}, nil
+	}
+	return &summary, err
+}
+
+// AutoFollowThread makes the author of a thread's root message and userID follow the thread, unless
+// they explicitly followed or unfollowed it before.
+func (db *Database) AutoFollowThread(ctx context.Context, rootID int64, userID uuid.UUID) error {
+	_, err := db.pool.Exec(ctx,
+		`INSERT INTO thread_follows (message_id, user_id)
+		 SELECT m.id, f.user_id FROM messages m
+		 CROSS JOIN LATERAL (VALUES (m.user_id), ($2::uuid)) AS f(user_id)
+		 WHERE m.id = $1
+		 ON CONFLICT (message_id, user_id) DO NOTHING`,
+		rootID, userID,
+	)
+	return err
+}
+
+// SetThreadFollow records that a user explicitly follows or unfollows a thread.
+func (db *Database) SetThreadFollow(ctx context.Context, rootID int64, userID uuid.UUID, following bool) error {
+	_, err := db.pool.Exec(ctx,
+		`INSERT INTO thread_follows (message_id, user_id, following) VALUES ($1, $2, $3)
+		 ON CONFLICT (message_id, user_id) DO UPDATE SET following = EXCLUDED.following, updated_at = NOW()`,
+		rootID, userID, following,
+	)
+	return err
+}
+
+// IsFollowingThread reports whether a user follows a thread.
+func (db *Database) IsFollowingThread(ctx context.Context, rootID int64, userID uuid.UUID) (bool, error) {
+	var following bool
+	err := db.pool.QueryRow(ctx,
+		`SELECT EXISTS(SELECT 1 FROM thread_follows WHERE message_id = $1 AND user_id = $2 AND following)`,
+		rootID, userID,
+	).Scan(&following)
+	return following, err
+}
+
+// GetThreadFollowers returns the users following a thread who are still members of its room.
+func (db *Database) GetThreadFollowers(ctx context.Context, rootID int64) ([]uuid.UUID, error) {
+	rows, err := db.pool.Query(ctx,
+		`SELECT tf.user_id FROM thread_follows tf
+		 INNER JOIN messages m ON m.id = tf.message_id
+		 INNER JOIN room_members rm ON rm.room_id = m.room_id AND rm.user_id = tf.user_id
+		 WHERE tf.message_id = $1 AND tf.following`,
+		rootID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanUserIDs(rows)
+}
+
+// Pin queries
+
+// PinMessage pins a message in its room. It returns false if the message was already pinned.
+func (db *Database) PinMessage(ctx context.Context, roomID uuid.UUID, messageID int64, pinnedBy uuid.UUID) (bool, error) {
+	tag, err := db.pool.Exec(ctx,
+		`INSERT INTO pinned_messages (message_id, room_id, pinned_by) VALUES ($1, $2, $3)
+		 ON CONFLICT (message_id) DO NOTHING`,
+		messageID, roomID, pinnedBy,
+	)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// UnpinMessage unpins a message. It returns false if the message was not pinned in the room.
+func (db *Database) UnpinMessage(ctx context.Context, roomID uuid.UUID, messageID int64) (bool, error) {
+	tag, err := db.pool.Exec(ctx,
+		`DELETE FROM pinned_messages WHERE message_id = $1 AND room_id = $2`,
+		messageID, roomID,
+	)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// GetPinnedMessages returns the pinned messages of a room that were not deleted, most recently pinned first.
+func (db *Database) GetPinnedMessages(ctx context.Context, roomID uuid.UUID) ([]models.PinnedMessage, error) {
+	rows, err := db.pool.Query(ctx,
+		`SELECT m.id, m.room_id, m.user_id, m.content, m.message_type, m.file_url, m.parent_id, m.edited_at, m.deleted_at, m.created_at,
+		   p.pinned_by, p.pinned_at
+		 FROM pinned_messages p
+		 INNER JOIN messages m ON m.id = p.message_id
+		 WHERE p.room_id = $1 AND m.deleted_at IS NULL
+		 ORDER BY p.pinned_at DESC`,
+		roomID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pins []models.PinnedMessage
+	for rows.Next() {
+		var pin models.PinnedMessage
+		msg := &pin.Message
+		if err := rows.Scan(&msg.ID, &msg.RoomID, &msg.UserID, &msg.Content, &msg.MessageType, &msg.FileURL, &msg.ParentID, &msg.EditedAt, &msg.DeletedAt, &msg.CreatedAt,
+			&pin.PinnedBy, &pin.PinnedAt); err != nil {
+			return nil, err
+		}
+		pins = append(pins, pin)
+	}
+	return pins, rows.Err()
+}
+
+// Scheduled message queries
+
+const scheduledMessageColumns = `id, room_id, user_id, content, message_type, file_url, parent_id, client_msg_id, undo_send, ttl_seconds, send_at, created_at, updated_at`
+
+func scanScheduledMessage(row pgx.Row, sm *models.ScheduledMessage) error {
+	return row.Scan(&sm.ID, &sm.RoomID, &sm.UserID, &sm.Content, &sm.MessageType, &sm.FileURL, &sm.ParentID, &sm.ClientMsgID,
+		&sm.UndoSend, &sm.TTLSeconds, &sm.SendAt, &sm.CreatedAt, &sm.UpdatedAt)
+}
+
+func scanScheduledMessages(rows pgx.Rows) ([]models.ScheduledMessage, error) {
+	defer rows.Close()
+
+	var scheduled []models.ScheduledMessage
+	for rows.Next() {
+		var sm models.ScheduledMessage
+		if err := scanScheduledMessage(rows, &sm); err != nil {
+			return nil, err
+		}
+		scheduled = append(scheduled, sm)
+	}
+	return scheduled, rows.Err()
+}
+
+// CreateScheduledMessage stores a message to be sent at sm.SendAt and fills in its ID and timestamps.
+// If the sender already scheduled a message with the same client_msg_id in the room, sm is populated
+// with the pending one instead.
+func (db *Database) CreateScheduledMessage(ctx context.Context, sm *models.ScheduledMessage) error {
+	return scanScheduledMessage(db.pool.QueryRow(ctx,
+		`INSERT INTO scheduled_messages (room_id, user_id, content, message_type, file_url, parent_id, client_msg_id, undo_send, ttl_seconds, send_at)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		 ON CONFLICT (room_id, user_id, client_msg_id) DO UPDATE SET client_msg_id = EXCLUDED.client_msg_id
+		 RETURNING `+scheduledMessageColumns,
+		sm.RoomID, sm.UserID, sm.Content, sm.MessageType, sm.FileURL, sm.ParentID, sm.ClientMsgID, sm.UndoSend, sm.TTLSeconds, sm.SendAt,
+	), sm)
+}
+
+// GetScheduledMessages returns the pending sends of a user, soonest first, in a single room unless
+// roomID is uuid.Nil.
+func (db *Database) GetScheduledMessages(ctx context.Context, userID, roomID uuid.UUID) ([]models.ScheduledMessage, error) {
+	rows, err := db.pool.Query(ctx,
+		`SELECT `+scheduledMessageColumns+` FROM scheduled_messages
+		 WHERE user_id = $1 AND ($2 = '00000000-0000-0000-0000-000000000000'::uuid OR room_id = $2)
+		 ORDER BY send_at, id`,
+		userID, roomID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanScheduledMessages(rows)
+}
+
+// GetScheduledMessage returns one of a user's pending sends, or pgx.ErrNoRows if it is not pending.
+func (db *Database) GetScheduledMessage(ctx context.Context, id int64, userID uuid.UUID) (*models.ScheduledMessage, error) {
+	var sm models.ScheduledMessage
+	err := scanScheduledMessage(db.pool.QueryRow(ctx,
+		`SELECT `+scheduledMessageColumns+` FROM scheduled_messages WHERE id = $1 AND user_id = $2`,
+		id, userID,
+	), &sm)
+	return &sm, err
+}
+
+// UpdateScheduledMessage changes the content and send time of a user's pending send, leaving the fields
+// passed as nil unchanged. It returns pgx.ErrNoRows if the message is not pending, such as when it was
+// already sent, or if sendAt is set and the message is held for undo send, whose send time is fixed.
+func (db *Database) UpdateScheduledMessage(ctx context.Context, id int64, userID uuid.UUID, content *string, sendAt *time.Time) (*models.ScheduledMessage, error) {
+	var sm models.ScheduledMessage
+	err := scanScheduledMessage(db.pool.QueryRow(ctx,
+		`UPDATE scheduled_messages
+		 SET content = COALESCE($3, content), send_at = COALESCE($4, send_at), updated_at = NOW()
+		 WHERE id = $1 AND user_id = $2 AND ($4::timestamptz IS NULL OR NOT undo_send)
+		 RETURNING `+scheduledMessageColumns,
+		id, userID, content, sendAt,
+	), &sm)
+	return &sm, err
+}
+
+// CancelScheduledMessage cancels a user's pending send. It returns false if the message is not pending.
+func (db *Database) CancelScheduledMessage(ctx context.Context, id int64, userID uuid.UUID) (bool, error) {
+	tag, err := db.pool.Exec(ctx,
+		`DELETE FROM scheduled_messages WHERE id = $1 AND user_id = $2`,
+		id, userID,
+	)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// ClaimDueScheduledMessages removes up to limit pending sends that are due within tx and returns those
+// whose sender is still a member of the room and not banned from it; the others are dropped. Rows claimed by another open
+// transaction are skipped, so concurrent claimers never get the same message. The sends are pending again
+// if tx is rolled back.
+func (db *Database) ClaimDueScheduledMessages(ctx context.Context, tx pgx.Tx, limit int) ([]models.ScheduledMessage, error) {
+	rows, err := tx.Query(ctx,
+		`WITH claimed AS (
+		   DELETE FROM scheduled_messages
+		   WHERE id IN (
+		     SELECT id FROM scheduled_messages WHERE send_at <= NOW()
+		     ORDER BY send_at LIMIT $1
+		     FOR UPDATE SKIP LOCKED
+		   )
+		   RETURNING `+scheduledMessageColumns+`
+		 )
+		 SELECT `+scheduledMessageColumns+` FROM claimed c
+		 WHERE EXISTS (SELECT 1 FROM room_members rm WHERE rm.room_id = c.room_id AND rm.user_id = c.user_id)
+		   AND NOT EXISTS (SELECT 1 FROM room_bans rb WHERE rb.room_id = c.room_id AND rb.user_id = c.user_id)
+		 ORDER BY send_at, id`,
+		limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanScheduledMessages(rows)
+}
+
+// Disappearing message queries
+
+// SetRoomMessageTTL sets how long the new messages of a room last and whether that is counted from when
+// they are sent or first read. A nil ttlSeconds makes them last forever. Messages already stored keep
+// their lifetime.
+func (db *Database) SetRoomMessageTTL(ctx context.Context, roomID uuid.UUID, ttlSeconds *int, after string) error {
+	_, err := db.pool.Exec(ctx,
+		`UPDATE rooms SET message_ttl_seconds = $2, message_ttl_after = $3, updated_at = NOW() WHERE id = $1`,
+		roomID, ttlSeconds, after,
+	)
+	return err
+}
+
+// StartExpiryOnRead starts the lifetime of the messages of other users in a room that expire once read
+// and that a member read by moving their cursor from after to upTo.
+func (db *Database) StartExpiryOnRead(ctx context.Context, roomID, userID uuid.UUID, after, upTo int64) error {
+	_, err := db.pool.Exec(ctx,
+		`UPDATE messages SET expires_at = NOW() + make_interval(secs => ttl_seconds)
+		 WHERE room_id = $1 AND id > $2 AND id <= $3 AND user_id <> $4 AND expire_on_read AND expires_at IS NULL`,
+		roomID, after, upTo, userID,
+	)
+	return err
+}
+
+// DeleteExpiredMessages deletes up to limit expired messages within tx, along with the replies in their
+// threads, and returns the deleted messages with only their ID, room and parent set. Rows locked by
+// another open transaction are skipped, so concurrent expirers never delete the same message. Nothing is
+// deleted if tx is rolled back.
+func (db *Database) DeleteExpiredMessages(ctx context.Context, tx pgx.Tx, limit int) ([]models.Message, error) {
+	rows, err := tx.Query(ctx,
+		`WITH expired AS (
+		   SELECT id FROM messages
+		   WHERE expires_at <= NOW()
+		   ORDER BY expires_at LIMIT $1
+		   FOR UPDATE SKIP LOCKED
+		 )
+		 DELETE FROM messages m
+		 WHERE m.id IN (SELECT id FROM expired) OR m.parent_id IN (SELECT id FROM expired)
+		 RETURNING m.id, m.room_id, m.parent_id`,
+		limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []models.Message
+	for rows.Next() {
+		var msg models.Message
+		if err := rows.Scan(&msg.ID, &msg.RoomID, &msg.ParentID); err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+	return messages, rows.Err()
+}
+
+// Poll queries
+
+// CreatePollTx stores the poll of a new poll message within tx, numbering its options from 1.
+func (db *Database) CreatePollTx(ctx context.Context, tx pgx.Tx, poll *models.Poll) error {
+	if _, err := tx.Exec(ctx,
+		`INSERT INTO polls (message_id, multiple_choice, anonymous, closes_at) VALUES ($1, $2, $3, $4)`,
+		poll.MessageID, poll.MultipleChoice, poll.Anonymous, poll.ClosesAt,
+	); err != nil {
+		return err
+	}
+	texts := make([]string, len(poll.Options))
+	for i, option := range poll.Options {
+		texts[i] = option.Text
+	}
+	_, err := tx.Exec(ctx,
+		`INSERT INTO poll_options (poll_id, id, text)
+		 SELECT $1, o.ordinality, o.text FROM unnest($2::text[]) WITH ORDINALITY AS o(text, ordinality)`,
+		poll.MessageID, texts,
+	)
+	return err
+}
+
+// GetPoll returns the poll of a message with its tally: the final one if it is closed, the current one
+// otherwise. Voters are only listed for polls with visible votes, and the options userID voted for are
+// set unless it is uuid.Nil. It returns pgx.ErrNoRows if the message has no poll.
+func (db *Database) GetPoll(ctx context.Context, messageID int64, userID uuid.UUID) (*models.Poll, error) {
+	poll := models.Poll{MessageID: messageID}
+	err := db.pool.QueryRow(ctx,
+		`SELECT p.multiple_choice, p.anonymous, p.closes_at, p.closed_at,
+		   COALESCE(p.final_voter_count, (SELECT COUNT(DISTINCT v.user_id) FROM poll_votes v WHERE v.poll_id = p.message_id))
+		 FROM polls p WHERE p.message_id = $1`,
+		messageID,
+	).Scan(&poll.MultipleChoice, &poll.Anonymous, &poll.ClosesAt, &poll.ClosedAt, &poll.VoterCount)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.pool.Query(ctx,
+		`SELECT o.id, o.text,
+		   COALESCE(o.final_vote_count, (SELECT COUNT(*) FROM poll_votes v WHERE v.poll_id = o.poll_id AND v.option_id = o.id))
+		 FROM poll_options o WHERE o.poll_id = $1
+		 ORDER BY o.id`,
+		messageID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	optionIndex := make(map[int]int)
+	for rows.Next() {
+		var option models.PollOption
+		if err := rows.Scan(&option.ID, &option.Text, &option.VoteCount); err != nil {
+			return nil, err
+		}
+		optionIndex[option.ID] = len(poll.Options)
+		poll.Options = append(poll.Options, option)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if poll.Anonymous && userID == uuid.Nil {
+		return &poll, nil
+	}
+	votes, err := db.pool.Query(ctx,
+		`SELECT option_id, user_id FROM poll_votes WHERE poll_id = $1 ORDER BY created_at, user_id`,
+		messageID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer votes.Close()
+	for votes.Next() {
+		var optionID int
+		var voterID uuid.UUID
+		if err := votes.Scan(&optionID, &voterID); err != nil {
+			return nil, err
+		}
+		if voterID == userID {
+			poll.MyOptionIDs = append(poll.MyOptionIDs, optionID)
+		}
+		if i, ok := optionIndex[optionID]; ok && !poll.Anonymous {
+			poll.Options[i].Voters = append(poll.Options[i].Voters, voterID)
+		}
+	}
+	return &poll, votes.Err()
+}
+
+// SetPollVotes replaces the votes of a user in a poll with votes for optionIDs, retracting them if it
+// is empty. It returns false, changing nothing, if the poll is closed or past its close time.
+func (db *Database) SetPollVotes(ctx context.Context, pollID int64, userID uuid.UUID, optionIDs []int) (bool, error) {
+	tx, err := db.pool.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+
+	// Closing the poll waits for the vote, so the frozen tally includes it
+	var open bool
+	err = tx.QueryRow(ctx,
+		`SELECT closed_at IS NULL AND (closes_at IS NULL OR closes_at > NOW()) FROM polls WHERE message_id = $1 FOR SHARE`,
+		pollID,
+	).Scan(&open)
+	if err != nil || !open {
+		return false, err
+	}
+
+	if _, err := tx.Exec(ctx, `DELETE FROM poll_votes WHERE poll_id = $1 AND user_id = $2`, pollID, userID); err != nil {
+		return false, err
+	}
+	if len(optionIDs) > 0 {
+		if _, err := tx.Exec(ctx,
+			`INSERT INTO poll_votes (poll_id, option_id, user_id) SELECT $1, unnest($2::int[]), $3`,
+			pollID, optionIDs, userID,
+		); err != nil {
+			return false, err
+		}
+	}
+	return true, tx.Commit(ctx)
+}
+
+// ClosePoll closes a poll and freezes its tally. It returns false if the poll was already closed.
+func (db *Database) ClosePoll(ctx context.Context, pollID int64) (bool, error) {
+	tx, err := db.pool.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+
+	// Closing waits for the votes being cast, which the counts below then see
+	tag, err := tx.Exec(ctx,
+		`UPDATE polls SET closed_at = NOW() WHERE message_id = $1 AND closed_at IS NULL`,
+		pollID,
+	)
+	if err != nil || tag.RowsAffected() == 0 {
+		return false, err
+	}
+	if _, err := tx.Exec(ctx,
+		`UPDATE polls p
+		 SET final_voter_count = (SELECT COUNT(DISTINCT v.user_id) FROM poll_votes v WHERE v.poll_id = p.message_id)
+		 WHERE p.message_id = $1`,
+		pollID,
+	); err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec(ctx,
+		`UPDATE poll_options o
+		 SET final_vote_count = (SELECT COUNT(*) FROM poll_votes v WHERE v.poll_id = o.poll_id AND v.option_id = o.id)
+		 WHERE o.poll_id = $1`,
+		pollID,
+	); err != nil {
+		return false, err
+	}
+	return true, tx.Commit(ctx)
+}
+
+// GetDuePolls returns up to limit open polls past their close time, with only the ID and room of their
+// message set.
+func (db *Database) GetDuePolls(ctx context.Context, limit int) ([]models.Message, error) {
+	rows, err := db.pool.Query(ctx,
+		`SELECT m.id, m.room_id FROM polls p
+		 INNER JOIN messages m ON m.id = p.message_id
+		 WHERE p.closed_at IS NULL AND p.closes_at <= NOW()
+		 ORDER BY p.closes_at LIMIT $1`,
+		limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []models.Message
+	for rows.Next() {
+		var msg models.Message
+		if err := rows.Scan(&msg.ID, &msg.RoomID); err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+	return messages, rows.Err()
+}
@@ -20,13 +20,29 @@ type User struct {
 
 // Room represents a chat room
 type Room struct {
-	ID         uuid.UUID `json:"id"`
-	Name       string    `json:"name"`
-	Type       string    `json:"type"` // public, private, group, dm
-	CreatorID  uuid.UUID `json:"creator_id"`
-	Topic      string    `json:"topic,omitempty"`
-	IsArchived bool      `json:"is_archived"`
-	CreatedAt  time.Time `json:"created_at"`
+	ID                uuid.UUID `json:"id"`
+	Name              string    `json:"name"`
+	Type              string    `json:"type"` // public, private, group, dm
+	CreatorID         uuid.UUID `json:"creator_id"`
+	Topic             string    `json:"topic,omitempty"`
+	IsArchived        bool      `json:"is_archived"`
+	CreatedAt         time.Time `json:"created_at"`
+	MessageTTLSeconds *int      `json:"message_ttl_seconds,omitempty"` // Lifetime of new messages, nil if they do not expire
+	MessageTTLAfter   string    `json:"message_ttl_after,omitempty"`   // sent, read: when the lifetime starts
+}
+
+// When the lifetime of a disappearing message starts
+const (
+	MessageTTLAfterSent = "sent"
+	MessageTTLAfterRead = "read"
+)
+
+// UserRoom is a room as seen by one of its members, with their read state
+type UserRoom struct {
+	Room
+	LastReadMessageID  int64 `json:"last_read_message_id"`
+	UnreadCount        int   `json:"unread_count"`
+	UnreadMentionCount int   `json:"unread_mention_count"`
 }
 
 // RoomMember represents a user's membership in a room
@@ -37,27 +53,136 @@ type RoomMember struct {
 	JoinedAt  time.Time `json:"joined_at"`
 }
 
+// MessageTypeSystem is the type of messages recorded by the server, such as call history. Clients
+// cannot send, edit or delete them.
+const MessageTypeSystem = "system"
+
+// MessageTypePoll is the type of messages carrying a poll, whose content is the question.
+const MessageTypePoll = "poll"
+
 // Message represents a chat message
 type Message struct {
 	ID          int64     `json:"id"`
 	RoomID      uuid.UUID `json:"room_id"`
 	UserID      uuid.UUID `json:"user_id"`
 	Content     string    `json:"content"`	
-	MessageType string    `json:"message_type"` // text, image, file
+	MessageType string    `json:"message_type"` // text, image, file, system, poll
 	FileURL     string    `json:"file_url,omitempty"`
 	ParentID    *int64    `json:"parent_id,omitempty"` // For threading
+	ClientMsgID string    `json:"client_msg_id,omitempty"` // Client-generated ID used to deduplicate resends
 	EditedAt    *time.Time `json:"edited_at,omitempty"`
+	Revision    int       `json:"revision"` // Incremented by each edit, so clients can tell stale edits apart
 	DeletedAt   *time.Time `json:"deleted_at,omitempty"`
 	CreatedAt   time.Time `json:"created_at"`
+	Thread      *ThreadSummary `json:"thread,omitempty"` // Set on thread roots fetched from history
+	TTLSeconds  *int       `json:"ttl_seconds,omitempty"` // Lifetime of a disappearing message
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`  // Unset until read for messages that expire after being read
+	Poll        *Poll      `json:"poll,omitempty"`        // Set on polls when they are sent and in history
+}
+
+// Poll is the poll of a message of type poll, with its tally. Once it is closed, the tally is frozen.
+type Poll struct {
+	MessageID      int64        `json:"message_id"`
+	MultipleChoice bool         `json:"multiple_choice"`
+	Anonymous      bool         `json:"anonymous"` // Voters are never shown
+	ClosesAt       *time.Time   `json:"closes_at,omitempty"`
+	ClosedAt       *time.Time   `json:"closed_at,omitempty"`
+	VoterCount     int          `json:"voter_count"`
+	Options        []PollOption `json:"options"`
+	MyOptionIDs    []int        `json:"my_option_ids,omitempty"` // The options voted for by the user the poll was fetched for
 }
 
-// MessageRead represents a read receipt for a message
+// PollOption is an option of a poll with its votes
+type PollOption struct {
+	ID        int         `json:"id"`
+	Text      string      `json:"text"`
+	VoteCount int         `json:"vote_count"`
+	Voters    []uuid.UUID `json:"voters,omitempty"` // Only for polls with visible votes
+}
+
+// MessageRevision is a version of a message's content. Revision 0 is what the message was sent with.
+type MessageRevision struct {
+	MessageID int64     `json:"message_id"`
+	Revision  int       `json:"revision"`
+	Content   string    `json:"content"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ScheduledMessage represents a message waiting to be sent at SendAt
+type ScheduledMessage struct {
+	ID          int64     `json:"id"`
+	RoomID      uuid.UUID `json:"room_id"`
+	UserID      uuid.UUID `json:"user_id"`
+	Content     string    `json:"content"`
+	MessageType string    `json:"message_type"` // text, image, file
+	FileURL     string    `json:"file_url,omitempty"`
+	ParentID    *int64    `json:"parent_id,omitempty"`
+	ClientMsgID string    `json:"client_msg_id"`
+	UndoSend    bool      `json:"undo_send"` // Held for the undo send window rather than scheduled by the sender
+	TTLSeconds  *int      `json:"ttl_seconds,omitempty"`
+	SendAt      time.Time `json:"send_at"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// ThreadSummary describes the replies to the root message of a thread
+type ThreadSummary struct {
+	ReplyCount      int       `json:"reply_count"`
+	LastReplyID     int64     `json:"last_reply_id,omitempty"`
+	LastReplyUserID uuid.UUID `json:"last_reply_user_id,omitzero"`
+	LastReplyAt     time.Time `json:"last_reply_at,omitzero"`
+}
+
+// PinnedMessage represents a message pinned in its room
+type PinnedMessage struct {
+	Message  Message   `json:"message"`
+	PinnedBy uuid.UUID `json:"pinned_by"`
+	PinnedAt time.Time `json:"pinned_at"`
+}
+
+// MessageRead represents a member whose read cursor has passed a message
 type MessageRead struct {
 	MessageID int64     `json:"message_id"`
 	UserID    uuid.UUID `json:"user_id"`
 	ReadAt    time.Time `json:"read_at"`
 }
 
+// MessageDelivery represents a message reaching one of its recipients
+type MessageDelivery struct {
+	MessageID   int64     `json:"message_id"`
+	UserID      uuid.UUID `json:"user_id"`
+	DeliveredAt time.Time `json:"delivered_at"`
+}
+
+// ReceiptSummary counts the recipients a message was delivered to and read by
+type ReceiptSummary struct {
+	MessageID      int64     `json:"message_id"`
+	RoomID         uuid.UUID `json:"room_id"`
+	SenderID       uuid.UUID `json:"sender_id"`
+	RecipientCount int       `json:"recipient_count"`
+	DeliveredCount int       `json:"delivered_count"`
+	ReadCount      int       `json:"read_count"`
+}
+
+// Mention kinds: a user mentioned by name, or one of the members reached by @here or @room
+const (
+	MentionKindUser = "user"
+	MentionKindHere = "here"
+	MentionKindRoom = "room"
+)
+
+// Mention represents a user being mentioned in a message
+type Mention struct {
+	MessageID   int64      `json:"message_id"`
+	RoomID      uuid.UUID  `json:"room_id"`
+	UserID      uuid.UUID  `json:"user_id"`
+	MentionedBy uuid.UUID  `json:"mentioned_by"`
+	Kind        string     `json:"kind"` // user, here, room
+	Content     string     `json:"content"`
+	SeenAt      *time.Time `json:"seen_at,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
 // Reaction represents a message reaction
 type Reaction struct {
 	MessageID int64     `json:"message_id"`
@@ -0,0 +1,165 @@
+package persistence
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/dukepan/multi-rooms-chat-back/internal/cache"
+	"github.com/dukepan/multi-rooms-chat-back/internal/db"
+	"github.com/dukepan/multi-rooms-chat-back/internal/rooms"
+	"github.com/google/uuid"
+)
+
+// Expirer deletes disappearing messages for good once they expire, from the database and from the event
+// logs of their rooms, and tells the rooms so that clients remove them. Every node runs one: each claims
+// the messages it deletes in the database, so that a message is deleted and announced once.
+type Expirer struct {
+	db      *db.Database
+	cache   *cache.Cache
+	roomMgr *rooms.Manager
+	done    chan struct{}
+	wg      sync.WaitGroup
+
+	batchSize    int
+	pollInterval time.Duration
+}
+
+// NewExpirer creates a new expirer
+func NewExpirer(database *db.Database, redisCache *cache.Cache, roomMgr *rooms.Manager) *Expirer {
+	return &Expirer{
+		db:           database,
+		cache:        redisCache,
+		roomMgr:      roomMgr,
+		done:         make(chan struct{}),
+		batchSize:    500,
+		pollInterval: 5 * time.Second,
+	}
+}
+
+// Start begins polling for expired messages
+func (e *Expirer) Start(ctx context.Context) {
+	e.wg.Add(1)
+	go e.run(ctx)
+}
+
+// Stop stops the expirer, returning once the batch being deleted is done
+func (e *Expirer) Stop() {
+	close(e.done)
+	e.wg.Wait()
+}
+
+// run deletes expired messages every poll interval, batch after batch until none are left
+func (e *Expirer) run(ctx context.Context) {
+	defer e.wg.Done()
+
+	ticker := time.NewTicker(e.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-e.done:
+			return
+		case <-ticker.C:
+			for {
+				deleted, err := e.expire(ctx)
+				if err != nil {
+					log.Printf("Error deleting expired messages: %v", err)
+					break
+				}
+				if deleted < e.batchSize {
+					break
+				}
+			}
+		}
+	}
+}
+
+// expiredRoom holds the messages of a room deleted in a batch
+type expiredRoom struct {
+	messageIDs    []int64
+	threadRootIDs []int64
+}
+
+// expire deletes a batch of expired messages and returns how many were deleted. The deletion only
+// commits once the messages are gone from the event logs too, so that replay never brings them back;
+// otherwise the batch is retried on the next run. Clients are told once the deletion is committed.
+func (e *Expirer) expire(ctx context.Context) (int, error) {
+	tx, err := e.db.GetPool().Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	deleted, err := e.db.DeleteExpiredMessages(ctx, tx, e.batchSize)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete expired messages: %w", err)
+	}
+	if len(deleted) == 0 {
+		return 0, nil
+	}
+
+	isDeleted := make(map[int64]bool, len(deleted))
+	for _, msg := range deleted {
+		isDeleted[msg.ID] = true
+	}
+	expired := make(map[uuid.UUID]*expiredRoom)
+	threadRoots := make(map[int64]bool)
+	for _, msg := range deleted {
+		room := expired[msg.RoomID]
+		if room == nil {
+			room = &expiredRoom{}
+			expired[msg.RoomID] = room
+		}
+		room.messageIDs = append(room.messageIDs, msg.ID)
+		// Threads that remain lost a reply, so their summaries change
+		if msg.ParentID != nil && !isDeleted[*msg.ParentID] && !threadRoots[*msg.ParentID] {
+			threadRoots[*msg.ParentID] = true
+			room.threadRootIDs = append(room.threadRootIDs, *msg.ParentID)
+		}
+	}
+
+	for roomID := range expired {
+		match := func(event string) bool { return isDeleted[eventMessageID(event)] }
+		if _, err := e.cache.RemoveRoomEvents(ctx, roomID, match); err != nil {
+			return 0, fmt.Errorf("failed to remove expired messages of room %s from its event log: %w", roomID, err)
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("failed to commit expired messages: %w", err)
+	}
+
+	for roomID, room := range expired {
+		if err := e.roomMgr.PublishMessagesExpired(ctx, roomID, room.messageIDs, room.threadRootIDs); err != nil {
+			log.Printf("Error publishing expired messages of room %s: %v", roomID, err)
+		}
+	}
+	return len(deleted), nil
+}
+
+// eventMessageID returns the ID of the message an encoded room event is about, or 0 if it is not about
+// a message. Message frames carry the message itself; other events, such as reactions and pins, refer
+// to it by message_id.
+func eventMessageID(event string) int64 {
+	var frame struct {
+		Type    string `json:"type"`
+		Payload struct {
+			ID        int64 `json:"id"`
+			MessageID int64 `json:"message_id"`
+		} `json:"payload"`
+	}
+	if err := json.Unmarshal([]byte(event), &frame); err != nil {
+		return 0
+	}
+	switch frame.Type {
+	case rooms.FrameMessage, rooms.FrameMessageEdited, rooms.FrameMessageDeleted:
+		return frame.Payload.ID
+	default:
+		return frame.Payload.MessageID
+	}
+}
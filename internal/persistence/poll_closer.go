@@ -0,0 +1,122 @@
+package persistence
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/dukepan/multi-rooms-chat-back/internal/db"
+	"github.com/dukepan/multi-rooms-chat-back/internal/rooms"
+	"github.com/google/uuid"
+)
+
+// maxPublishAttempts bounds how many times the closer publishes the results of a poll it closed
+const maxPublishAttempts = 5
+
+// unpublishedPoll is a poll the closer closed without publishing its results
+type unpublishedPoll struct {
+	roomID   uuid.UUID
+	attempts int
+}
+
+// PollCloser closes polls once their close time passes, freezing their results. Every node runs one:
+// closing a poll is recorded in the database, so the final results are published by whichever node
+// closes it first. A closed poll is no longer due, so results that fail to publish are retried from
+// memory and lost if the node stops first; clients still see them when they fetch the poll.
+type PollCloser struct {
+	db          *db.Database
+	roomMgr     *rooms.Manager
+	done        chan struct{}
+	wg          sync.WaitGroup
+	unpublished map[int64]*unpublishedPoll
+
+	batchSize    int
+	pollInterval time.Duration
+}
+
+// NewPollCloser creates a new poll closer
+func NewPollCloser(database *db.Database, roomMgr *rooms.Manager) *PollCloser {
+	return &PollCloser{
+		db:           database,
+		roomMgr:      roomMgr,
+		done:         make(chan struct{}),
+		unpublished:  make(map[int64]*unpublishedPoll),
+		batchSize:    100,
+		pollInterval: time.Second,
+	}
+}
+
+// Start begins polling for polls past their close time
+func (pc *PollCloser) Start(ctx context.Context) {
+	pc.wg.Add(1)
+	go pc.run(ctx)
+}
+
+// Stop stops the poll closer, returning once the batch being closed is done
+func (pc *PollCloser) Stop() {
+	close(pc.done)
+	pc.wg.Wait()
+}
+
+// run closes due polls every poll interval, batch after batch until none are left
+func (pc *PollCloser) run(ctx context.Context) {
+	defer pc.wg.Done()
+
+	ticker := time.NewTicker(pc.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-pc.done:
+			return
+		case <-ticker.C:
+			pc.republish(ctx)
+			for {
+				due, err := pc.db.GetDuePolls(ctx, pc.batchSize)
+				if err != nil {
+					log.Printf("Error fetching polls to close: %v", err)
+					break
+				}
+				failed := 0
+				for _, msg := range due {
+					err := pc.roomMgr.FinalizePoll(ctx, msg.RoomID, msg.ID)
+					switch {
+					case err == nil, errors.Is(err, rooms.ErrPollClosed):
+					case errors.Is(err, rooms.ErrPollNotPublished):
+						log.Printf("Error closing poll %d: %v", msg.ID, err)
+						pc.unpublished[msg.ID] = &unpublishedPoll{roomID: msg.RoomID, attempts: 1}
+					default:
+						log.Printf("Error closing poll %d: %v", msg.ID, err)
+						failed++
+					}
+				}
+				// Polls that failed to close are still due, so they are retried on the next run
+				if len(due) < pc.batchSize || failed > 0 {
+					break
+				}
+			}
+		}
+	}
+}
+
+// republish publishes again the results of the polls this closer closed without publishing them
+func (pc *PollCloser) republish(ctx context.Context) {
+	for messageID, poll := range pc.unpublished {
+		err := pc.roomMgr.PublishPollClosed(ctx, poll.roomID, messageID)
+		if err == nil || errors.Is(err, rooms.ErrPollNotFound) {
+			delete(pc.unpublished, messageID)
+			continue
+		}
+		poll.attempts++
+		if poll.attempts >= maxPublishAttempts {
+			log.Printf("Giving up publishing results of poll %d, which are lost: %v", messageID, err)
+			delete(pc.unpublished, messageID)
+			continue
+		}
+		log.Printf("Error publishing results of poll %d: %v", messageID, err)
+	}
+}
@@ -0,0 +1,172 @@
+package persistence
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/dukepan/multi-rooms-chat-back/internal/db"
+	"github.com/dukepan/multi-rooms-chat-back/internal/rooms"
+)
+
+// maxReadReceiptMessages bounds how many of the messages passed by a read cursor move are treated as
+// newly read, so that catching up on a long backlog only updates the senders of its latest messages.
+const maxReadReceiptMessages = 100
+
+// ReceiptWriter batches delivery and read receipts, stores the deliveries and sends each affected
+// message's sender its updated receipt counts, so that a burst of receipts becomes one update per message.
+type ReceiptWriter struct {
+	db      *db.Database
+	roomMgr *rooms.Manager
+	queue   chan rooms.Receipt
+	done    chan struct{}
+	wg      sync.WaitGroup
+
+	batchSize     int
+	flushInterval time.Duration
+}
+
+// NewReceiptWriter creates a new receipt writer
+func NewReceiptWriter(database *db.Database, roomMgr *rooms.Manager) *ReceiptWriter {
+	return &ReceiptWriter{
+		db:            database,
+		roomMgr:       roomMgr,
+		queue:         make(chan rooms.Receipt, 10000),
+		done:          make(chan struct{}),
+		batchSize:     500,
+		flushInterval: 250 * time.Millisecond,
+	}
+}
+
+// Start begins the writer's batch processing loop
+func (rw *ReceiptWriter) Start(ctx context.Context) {
+	rw.wg.Add(1)
+	go rw.batchWriter(ctx)
+}
+
+// Stop gracefully shuts down the writer, returning once every queued receipt has been written
+func (rw *ReceiptWriter) Stop() {
+	close(rw.done)
+	rw.wg.Wait()
+}
+
+// RecordReceipt queues a receipt. It never blocks the connection it is called for: receipts are
+// dropped while the queue is full, and the recipient's next receipt catches the sender up.
+func (rw *ReceiptWriter) RecordReceipt(receipt rooms.Receipt) {
+	select {
+	case rw.queue <- receipt:
+	default:
+		log.Printf("Receipt queue full, dropping receipt of message %d for user %s", receipt.MessageID, receipt.UserID)
+	}
+}
+
+// batchWriter processes receipts in batches
+func (rw *ReceiptWriter) batchWriter(ctx context.Context) {
+	defer rw.wg.Done()
+
+	batch := make([]rooms.Receipt, 0, rw.batchSize)
+	ticker := time.NewTicker(rw.flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			rw.writeBatch(context.Background(), batch)
+			return
+
+		case <-rw.done:
+			// Flush remaining receipts, including those still waiting in the queue
+			for {
+				select {
+				case receipt := <-rw.queue:
+					batch = append(batch, receipt)
+					if len(batch) < rw.batchSize {
+						continue
+					}
+				default:
+				}
+				rw.writeBatch(ctx, batch)
+				if len(batch) < rw.batchSize {
+					return
+				}
+				batch = batch[:0]
+			}
+
+		case receipt := <-rw.queue:
+			batch = append(batch, receipt)
+			if len(batch) >= rw.batchSize {
+				rw.writeBatch(ctx, batch)
+				batch = batch[:0]
+				ticker.Reset(rw.flushInterval)
+			}
+
+		case <-ticker.C:
+			if len(batch) > 0 {
+				rw.writeBatch(ctx, batch)
+				batch = batch[:0]
+			}
+		}
+	}
+}
+
+// writeBatch stores the deliveries of a batch of receipts and notifies the senders of the messages
+// whose counts changed. Read cursors are already stored, so the messages they passed always count as
+// changed, and as delivered.
+func (rw *ReceiptWriter) writeBatch(ctx context.Context, batch []rooms.Receipt) {
+	if len(batch) == 0 {
+		return
+	}
+
+	messageIDs := make([]int64, 0, len(batch))
+	userIDs := make([]uuid.UUID, 0, len(batch))
+	changed := make(map[int64]struct{})
+	for _, receipt := range batch {
+		if !receipt.Read {
+			messageIDs = append(messageIDs, receipt.MessageID)
+			userIDs = append(userIDs, receipt.UserID)
+			continue
+		}
+
+		read, err := rw.db.GetMessagesReadInRange(ctx, receipt.RoomID, receipt.UserID, receipt.ReadAfter, receipt.MessageID, maxReadReceiptMessages)
+		if err != nil {
+			log.Printf("Error fetching messages read by user %s in room %s: %v", receipt.UserID, receipt.RoomID, err)
+			continue
+		}
+		for _, messageID := range read {
+			messageIDs = append(messageIDs, messageID)
+			userIDs = append(userIDs, receipt.UserID)
+			changed[messageID] = struct{}{}
+		}
+	}
+
+	delivered, err := rw.db.RecordDeliveries(ctx, messageIDs, userIDs)
+	if err != nil {
+		log.Printf("Error recording %d message deliveries: %v", len(batch), err)
+		return
+	}
+	for _, messageID := range delivered {
+		changed[messageID] = struct{}{}
+	}
+	if len(changed) == 0 {
+		return
+	}
+
+	changedIDs := make([]int64, 0, len(changed))
+	for messageID := range changed {
+		changedIDs = append(changedIDs, messageID)
+	}
+	summaries, err := rw.db.GetReceiptSummaries(ctx, changedIDs)
+	if err != nil {
+		log.Printf("Error counting receipts of %d messages: %v", len(changedIDs), err)
+		return
+	}
+	for _, summary := range summaries {
+		frame := rooms.NewRoomFrame(rooms.FrameReceiptUpdate, summary.RoomID, summary)
+		if err := rw.roomMgr.SendToUser(ctx, summary.SenderID, frame); err != nil {
+			log.Printf("Error sending receipts of message %d to user %s: %v", summary.MessageID, summary.SenderID, err)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package persistence
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/dukepan/multi-rooms-chat-back/internal/db"
+	"github.com/dukepan/multi-rooms-chat-back/internal/models"
+	"github.com/dukepan/multi-rooms-chat-back/internal/rooms"
+	"github.com/google/uuid"
+)
+
+// Scheduler hands scheduled messages to the message writer once they are due. Every node runs one:
+// each claims the messages it hands over in the database, so that a message is sent by exactly one of
+// them.
+type Scheduler struct {
+	db            *db.Database
+	messageWriter rooms.MessageWriterService
+	done          chan struct{}
+	wg            sync.WaitGroup
+
+	batchSize    int
+	pollInterval time.Duration
+}
+
+// NewScheduler creates a new scheduler
+func NewScheduler(database *db.Database, messageWriter rooms.MessageWriterService) *Scheduler {
+	return &Scheduler{
+		db:            database,
+		messageWriter: messageWriter,
+		done:          make(chan struct{}),
+		batchSize:     100,
+		pollInterval:  time.Second,
+	}
+}
+
+// Start begins polling for due messages
+func (s *Scheduler) Start(ctx context.Context) {
+	s.wg.Add(1)
+	go s.run(ctx)
+}
+
+// Stop stops the scheduler, returning once the batch being handed over is done. It must be called
+// before the message writer is stopped.
+func (s *Scheduler) Stop() {
+	close(s.done)
+	s.wg.Wait()
+}
+
+// run hands over due messages every poll interval, batch after batch until none are left
+func (s *Scheduler) run(ctx context.Context) {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.done:
+			return
+		case <-ticker.C:
+			for {
+				sent, err := s.sendDue(ctx)
+				if err != nil {
+					log.Printf("Error sending scheduled messages: %v", err)
+					break
+				}
+				if sent < s.batchSize {
+					break
+				}
+			}
+		}
+	}
+}
+
+// sendDue claims a batch of due messages and stores them, returning how many were claimed. The claim
+// only commits once the whole batch is stored. Otherwise the batch stays pending for the next run, and
+// the messages already stored are stored only once thanks to their client_msg_id. The messages of each
+// room are stored in the order they were due, and the rooms concurrently.
+func (s *Scheduler) sendDue(ctx context.Context) (int, error) {
+	tx, err := s.db.GetPool().Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	due, err := s.db.ClaimDueScheduledMessages(ctx, tx, s.batchSize)
+	if err != nil {
+		return 0, fmt.Errorf("failed to claim due messages: %w", err)
+	}
+
+	byRoom := make(map[uuid.UUID][]*models.ScheduledMessage)
+	for i := range due {
+		byRoom[due[i].RoomID] = append(byRoom[due[i].RoomID], &due[i])
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, len(byRoom))
+	for _, scheduled := range byRoom {
+		wg.Add(1)
+		go func(scheduled []*models.ScheduledMessage) {
+			defer wg.Done()
+			for _, sm := range scheduled {
+				if err := s.messageWriter.PersistMessage(ctx, scheduledMessage(sm)); err != nil {
+					errs <- fmt.Errorf("failed to store scheduled message %d: %w", sm.ID, err)
+					return
+				}
+			}
+		}(scheduled)
+	}
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("failed to commit claimed messages: %w", err)
+	}
+	return len(due), nil
+}
+
+// scheduledMessage creates the message sent for a scheduled message
+func scheduledMessage(scheduled *models.ScheduledMessage) *models.Message {
+	return &models.Message{
+		RoomID:      scheduled.RoomID,
+		UserID:      scheduled.UserID,
+		Content:     scheduled.Content,
+		MessageType: scheduled.MessageType,
+		FileURL:     scheduled.FileURL,
+		ParentID:    scheduled.ParentID,
+		ClientMsgID: scheduled.ClientMsgID,
+		TTLSeconds:  scheduled.TTLSeconds,
+		CreatedAt:   time.Now(),
+	}
+}
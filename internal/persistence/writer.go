@@ -3,10 +3,10 @@ package persistence
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"math"
-	"strconv"
 	"sync"
 	"time"
 
@@ -15,7 +15,7 @@ import (
 	"github.com/dukepan/multi-rooms-chat-back/internal/cache"
 	"github.com/dukepan/multi-rooms-chat-back/internal/db"
 	"github.com/dukepan/multi-rooms-chat-back/internal/models"
-	"github.com/redis/go-redis/v9"
+	"github.com/dukepan/multi-rooms-chat-back/internal/rooms"
 )
 
 const (
@@ -23,11 +23,21 @@ const (
 	initialBackoff = 100 * time.Millisecond // 100ms
 )
 
+// ErrWriterStopped is returned when a message is queued after the writer has been stopped.
+var ErrWriterStopped = errors.New("message writer stopped")
+
+// pendingMessage is a queued message and, if the caller is waiting for it, the channel its outcome is reported on.
+type pendingMessage struct {
+	msg    *models.Message
+	result chan error
+}
+
 // MessageWriter batches and persists messages to database
 type MessageWriter struct {
 	db           *db.Database
 	cache        *cache.Cache
-	messageQueue chan *models.Message
+	syncEngine   *SyncEngine
+	messageQueue chan *pendingMessage
 	done         chan struct{}
 	wg           sync.WaitGroup
 
@@ -40,30 +50,58 @@ func NewMessageWriter(database *db.Database, redisCache *cache.Cache) *MessageWr
 	return &MessageWriter{
 		db:            database,
 		cache:         redisCache,
-		messageQueue:  make(chan *models.Message, 1000),
+		messageQueue:  make(chan *pendingMessage, 1000),
 		done:          make(chan struct{}),
 		batchSize:     50,
 		flushInterval: 100 * time.Millisecond,
 	}
 }
 
+// SetSyncEngine sets the sync engine used to deliver persisted messages. This is used for circular dependencies.
+func (mw *MessageWriter) SetSyncEngine(syncEngine *SyncEngine) {
+	mw.syncEngine = syncEngine
+}
+
 // Start begins the writer's batch processing loop
 func (mw *MessageWriter) Start(ctx context.Context) {
 	mw.wg.Add(1)
 	go mw.batchWriter(ctx)
 }
 
-// Stop gracefully shuts down the writer
+// Stop gracefully shuts down the writer, returning once every queued message has been written
 func (mw *MessageWriter) Stop() {
 	close(mw.done)
 	mw.wg.Wait()
 }
 
 // QueueMessage adds a message to the write queue
-func (mw *MessageWriter) QueueMessage(msg *models.Message) {
+func (mw *MessageWriter) QueueMessage(msg *models.Message) error {
 	select {
-	case mw.messageQueue <- msg:
+	case mw.messageQueue <- &pendingMessage{msg: msg}:
+		return nil
 	case <-mw.done:
+		return ErrWriterStopped
+	}
+}
+
+// PersistMessage queues a message and waits until its batch has been written.
+// On success msg holds the canonical server ID and creation time. If the message was a resend
+// of one already stored under the same client_msg_id, those of the original message are used instead.
+func (mw *MessageWriter) PersistMessage(ctx context.Context, msg *models.Message) error {
+	pending := &pendingMessage{msg: msg, result: make(chan error, 1)}
+	select {
+	case mw.messageQueue <- pending:
+	case <-mw.done:
+		return ErrWriterStopped
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case err := <-pending.result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
 
@@ -71,7 +109,7 @@ func (mw *MessageWriter) QueueMessage(msg *models.Message) {
 func (mw *MessageWriter) batchWriter(ctx context.Context) {
 	defer mw.wg.Done()
 
-	batch := make([]*models.Message, 0, mw.batchSize)
+	batch := make([]*pendingMessage, 0, mw.batchSize)
 	ticker := time.NewTicker(mw.flushInterval)
 	defer ticker.Stop()
 
@@ -85,15 +123,32 @@ func (mw *MessageWriter) batchWriter(ctx context.Context) {
 			return
 
 		case <-mw.done:
-			// Flush remaining messages
-			if len(batch) > 0 {
+			// Flush remaining messages, including those still waiting in the queue
+			for {
+				select {
+				case pending := <-mw.messageQueue:
+					if pending == nil {
+						continue
+					}
+					batch = append(batch, pending)
+					if len(batch) < mw.batchSize {
+						continue
+					}
+				default:
+				}
+				if len(batch) == 0 {
+					return
+				}
 				mw.writeBatch(ctx, batch)
+				if len(batch) < mw.batchSize {
+					return
+				}
+				batch = batch[:0]
 			}
-			return
 
-		case msg := <-mw.messageQueue:
-			if msg != nil {
-				batch = append(batch, msg)
+		case pending := <-mw.messageQueue:
+			if pending != nil {
+				batch = append(batch, pending)
 				if len(batch) >= mw.batchSize {
 					mw.writeBatch(ctx, batch)
 					batch = batch[:0]
@@ -111,7 +166,7 @@ func (mw *MessageWriter) batchWriter(ctx context.Context) {
 }
 
 // writeBatch persists a batch of messages to database
-func (mw *MessageWriter) writeBatch(ctx context.Context, batch []*models.Message) {
+func (mw *MessageWriter) writeBatch(ctx context.Context, batch []*pendingMessage) {
 	if len(batch) == 0 {
 		return
 	}
@@ -126,16 +181,36 @@ func (mw *MessageWriter) writeBatch(ctx context.Context, batch []*models.Message
 			continue
 		}
 
+		// created tracks which messages were newly inserted, as opposed to resends of a stored message
+		created := make([]bool, len(batch))
+		// firstByClientID deduplicates resends that land in the same batch before hitting the database
+		firstByClientID := make(map[string]*models.Message)
 		allMessagesPersisted := true
-		for _, msg := range batch {
-			// Create message within the transaction
-			if err := mw.db.CreateMessage(ctx, msg); err != nil {
+		for j, pending := range batch {
+			msg := pending.msg
+			if msg.ClientMsgID != "" {
+				key := clientMsgKey(msg)
+				if _, seen := firstByClientID[key]; seen {
+					// Resolved from the first copy once the batch is committed
+					continue
+				}
+				firstByClientID[key] = msg
+			}
+
+			// Create message within the transaction, along with the poll of a new poll
+			isNew, err := mw.db.CreateMessageTx(ctx, x, msg)
+			if err == nil && isNew && msg.Poll != nil {
+				msg.Poll.MessageID = msg.ID
+				err = mw.db.CreatePollTx(ctx, x, msg.Poll)
+			}
+			if err != nil {
 				log.Printf("Error persisting message in batch (attempt %d/%d): %v", i+1, maxRetries, err)
 				x.Rollback(ctx) // Rollback the entire batch if any message fails
 				lastErr = err
 				allMessagesPersisted = false
 				break // Exit inner loop and retry the whole batch
 			}
+			created[j] = isNew
 		}
 
 		if allMessagesPersisted {
@@ -146,21 +221,33 @@ func (mw *MessageWriter) writeBatch(ctx context.Context, batch []*models.Message
 			}
 
 			// If committed, process cache and Pub/Sub
-			for _, msg := range batch {
-				// Cache the message
-				mw.cacheMessage(ctx, msg)
-
-				// Publish to Redis Pub/Sub for cross-node sync
-				event := map[string]interface{}{
-					"type":       "message_delivered",
-					"message_id": msg.ID,
-					"room_id":    msg.RoomID,
-					"user_id":    msg.UserID,
-					"timestamp":  msg.CreatedAt,
-					"content":    msg.Content,
+			for j, pending := range batch {
+				msg := pending.msg
+				if msg.ClientMsgID != "" {
+					if first := firstByClientID[clientMsgKey(msg)]; first != msg {
+						// In-batch duplicate: adopt the identity of the copy that was inserted
+						msg.ID = first.ID
+						msg.CreatedAt = first.CreatedAt
+					}
+				}
+
+				if created[j] {
+					// Cache the message and publish it to Redis Pub/Sub for cross-node sync
+					if err := mw.cacheMessage(ctx, msg); err != nil {
+						log.Printf("Error publishing message %d: %v", msg.ID, err)
+					}
+				}
+
+				if pending.result != nil {
+					pending.result <- nil
+				}
+			}
+
+			// Mentions and threads are updated once every sender has its ack
+			for j, pending := range batch {
+				if created[j] {
+					mw.notifyNewMessage(ctx, pending.msg)
 				}
-				eventJSON, _ := json.Marshal(event)
-				mw.cache.Publish(ctx, "messages_delivered", string(eventJSON))
 			}
 			return // Successfully persisted and published
 		}
@@ -172,54 +259,71 @@ func (mw *MessageWriter) writeBatch(ctx context.Context, batch []*models.Message
 		log.Printf("Failed to persist message batch after %d retries: %v", maxRetries, lastErr)
 		// TODO: Consider a dead-letter queue or other failure handling for unrecoverable errors
 	}
+	for _, pending := range batch {
+		if pending.result != nil {
+			pending.result <- fmt.Errorf("failed to persist message: %w", lastErr)
+		}
+	}
 }
 
-// cacheMessage caches a message in Redis
-func (mw *MessageWriter) cacheMessage(ctx context.Context, msg *models.Message) {
-	// Store message in Redis sorted set for quick retrieval
-	client := mw.cache.GetClient()
-	key := "room:" + msg.RoomID.String() + ":messages"
+// clientMsgKey identifies a client-generated message ID within its room and sender.
+func clientMsgKey(msg *models.Message) string {
+	return msg.RoomID.String() + ":" + msg.UserID.String() + ":" + msg.ClientMsgID
+}
 
-	// Add to sorted set with timestamp as score
-	client.ZAdd(ctx, key, redis.Z{
-		Score:  float64(msg.CreatedAt.UnixMilli()),
-		Member: msg.ID,
-	})
+// cacheMessage records a persisted message in the room's event log in Redis, which clients replay
+// from when they resume, and delivers it to the room's clients on every node
+func (mw *MessageWriter) cacheMessage(ctx context.Context, msg *models.Message) error {
+	if mw.syncEngine == nil {
+		return errors.New("sync engine not set")
+	}
+	return mw.syncEngine.publishRoomFrame(ctx, rooms.NewRoomFrame(rooms.FrameMessage, msg.RoomID, msg))
+}
 
-	// Set expiration on key (e.g., 24 hours)
-	client.Expire(ctx, key, 24*time.Hour)
+// notifyNewMessage records the mentions of a newly stored message and, for a reply, updates its thread
+// and notifies the thread's followers. The message is stored, so failures are only logged.
+func (mw *MessageWriter) notifyNewMessage(ctx context.Context, msg *models.Message) {
+	if mw.syncEngine == nil || mw.syncEngine.roomMgr == nil {
+		log.Printf("Error notifying about message %d: room manager not set", msg.ID)
+		return
+	}
+	roomMgr := mw.syncEngine.roomMgr
+	if err := roomMgr.RecordMentions(ctx, msg); err != nil {
+		log.Printf("Error recording mentions in message %d: %v", msg.ID, err)
+	}
+	if msg.ParentID != nil {
+		if err := roomMgr.RecordThreadReply(ctx, msg); err != nil {
+			log.Printf("Error updating thread of reply %d: %v", msg.ID, err)
+		}
+	}
 }
 
-// GetCachedMessages retrieves cached messages from Redis
+// GetCachedMessages retrieves the IDs of the most recent cached messages of a room from Redis
 func (mw *MessageWriter) GetCachedMessages(ctx context.Context, roomID uuid.UUID, limit int) ([]int64, error) {
 	client := mw.cache.GetClient()
-	key := "room:" + roomID.String() + ":messages"
 
-	// Get last N message IDs from sorted set
-	vals, err := client.ZRevRange(ctx, key, 0, int64(limit-1)).Result()
+	// The event log also holds edits, deletes and reactions, so scan it newest first for messages
+	vals, err := client.ZRevRange(ctx, cache.RoomEventsKey(roomID), 0, -1).Result()
 	if err != nil {
 		return nil, err
 	}
 
-	messageIDs := make([]int64, len(vals))
-	for i, v := range vals {
-		var id int64
-		_, err := parseMessageID(v, &id)
-		if err != nil {
+	messageIDs := make([]int64, 0, limit)
+	for _, v := range vals {
+		if len(messageIDs) >= limit {
+			break
+		}
+		var event struct {
+			Type    string `json:"type"`
+			Payload struct {
+				ID int64 `json:"id"`
+			} `json:"payload"`
+		}
+		if err := json.Unmarshal([]byte(v), &event); err != nil || event.Type != rooms.FrameMessage {
 			continue
 		}
-		messageIDs[i] = id
+		messageIDs = append(messageIDs, event.Payload.ID)
 	}
 
 	return messageIDs, nil
 }
-
-// parseMessageID parses a message ID from cache
-func parseMessageID(s string, id *int64) (int64, error) {
-	parsedID, err := strconv.ParseInt(s, 10, 64)
-	if err != nil {
-		return 0, fmt.Errorf("failed to parse message ID from cache: %w", err)
-	}
-	*id = parsedID
-	return parsedID, nil
-}
@@ -0,0 +1,210 @@
+package rooms
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// SlowConsumerPolicy decides what happens to a room frame when a client's send buffer is full.
+type SlowConsumerPolicy string
+
+const (
+	// PolicyDrop drops the frame and later sends the client a gap notice.
+	PolicyDrop SlowConsumerPolicy = "drop"
+	// PolicyDisconnect closes the connection with CloseSlowConsumer; the client resumes with its last event ID.
+	PolicyDisconnect SlowConsumerPolicy = "disconnect"
+	// PolicyBuffer holds the frame in a bounded per-client overflow queue, dropping it once the queue is full.
+	PolicyBuffer SlowConsumerPolicy = "buffer"
+)
+
+// DefaultOverflowSize is the default number of frames a client's overflow queue holds under PolicyBuffer.
+const DefaultOverflowSize = 1024
+
+// droppedFrames counts the room frames that were not delivered to a slow client.
+var droppedFrames = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "chat_room_dropped_frames_total",
+	Help: "Number of room frames dropped because a client could not keep up.",
+}, []string{"room_id"})
+
+// ParseSlowConsumerPolicy parses a policy name.
+func ParseSlowConsumerPolicy(s string) (SlowConsumerPolicy, error) {
+	switch policy := SlowConsumerPolicy(strings.TrimSpace(s)); policy {
+	case PolicyDrop, PolicyDisconnect, PolicyBuffer:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown slow consumer policy %q", s)
+	}
+}
+
+// ParseRoomPolicies parses per-room policy overrides written as "<room_id>=<policy>,...".
+func ParseRoomPolicies(s string) (map[uuid.UUID]SlowConsumerPolicy, error) {
+	policies := make(map[uuid.UUID]SlowConsumerPolicy)
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		roomStr, policyStr, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid room policy %q", entry)
+		}
+		roomID, err := uuid.Parse(strings.TrimSpace(roomStr))
+		if err != nil {
+			return nil, fmt.Errorf("invalid room ID in room policy %q: %w", entry, err)
+		}
+		policy, err := ParseSlowConsumerPolicy(policyStr)
+		if err != nil {
+			return nil, err
+		}
+		policies[roomID] = policy
+	}
+	return policies, nil
+}
+
+// BackpressureConfig configures how rooms treat clients that cannot keep up with their broadcasts.
+type BackpressureConfig struct {
+	Policy       SlowConsumerPolicy
+	RoomPolicies map[uuid.UUID]SlowConsumerPolicy
+	OverflowSize int
+}
+
+// SetBackpressureConfig sets the slow-consumer policies of the manager's rooms.
+func (m *Manager) SetBackpressureConfig(cfg BackpressureConfig) {
+	if cfg.Policy == "" {
+		cfg.Policy = PolicyDrop
+	}
+	if cfg.OverflowSize <= 0 {
+		cfg.OverflowSize = DefaultOverflowSize
+	}
+	m.backpressureMu.Lock()
+	m.backpressure = cfg
+	m.backpressureMu.Unlock()
+}
+
+// SetRoomSlowConsumerPolicy overrides the slow-consumer policy of a single room.
+func (m *Manager) SetRoomSlowConsumerPolicy(roomID uuid.UUID, policy SlowConsumerPolicy) {
+	m.backpressureMu.Lock()
+	defer m.backpressureMu.Unlock()
+	if m.backpressure.RoomPolicies == nil {
+		m.backpressure.RoomPolicies = make(map[uuid.UUID]SlowConsumerPolicy)
+	}
+	m.backpressure.RoomPolicies[roomID] = policy
+}
+
+// slowConsumerPolicy returns the policy of a room and the overflow queue size to use with PolicyBuffer.
+func (m *Manager) slowConsumerPolicy(roomID uuid.UUID) (SlowConsumerPolicy, int) {
+	m.backpressureMu.RLock()
+	defer m.backpressureMu.RUnlock()
+	if policy, ok := m.backpressure.RoomPolicies[roomID]; ok {
+		return policy, m.backpressure.OverflowSize
+	}
+	return m.backpressure.Policy, m.backpressure.OverflowSize
+}
+
+// sendLive queues a live room frame for the client, applying the room's slow-consumer policy when the
+// send buffer is full. Any gap the client has in the room is reported before the frame. deliverMu must be held.
+func (c *Client) sendLive(frame *ServerFrame, policy SlowConsumerPolicy, overflowSize int) bool {
+	if len(c.overflow) > 0 {
+		// Frames already waiting in the overflow queue go first to keep the room order
+		return c.enqueueOverflow(frame, overflowSize)
+	}
+
+	if gap, pending := c.gaps[frame.RoomID]; pending {
+		select {
+		case c.send <- NewRoomFrame(FrameGap, frame.RoomID, *gap):
+			delete(c.gaps, frame.RoomID)
+		default:
+			c.dropFrame(frame)
+			return false
+		}
+	}
+
+	select {
+	case c.send <- frame:
+		return true
+	default:
+	}
+
+	switch policy {
+	case PolicyBuffer:
+		return c.enqueueOverflow(frame, overflowSize)
+	case PolicyDisconnect:
+		droppedFrames.WithLabelValues(frame.RoomID.String()).Inc()
+		log.Printf("Disconnecting slow client of user %s in room %s", c.userID, frame.RoomID)
+		// Stop removes the client from its rooms, which must not happen while the room is broadcasting
+		go c.CloseWith(CloseSlowConsumer, "slow consumer: resubscribe with last_event_id")
+		return false
+	default:
+		c.dropFrame(frame)
+		return false
+	}
+}
+
+// enqueueOverflow appends a frame to the client's overflow queue, dropping it if the queue is full.
+func (c *Client) enqueueOverflow(frame *ServerFrame, overflowSize int) bool {
+	if len(c.overflow) >= overflowSize {
+		c.dropFrame(frame)
+		return false
+	}
+	c.overflow = append(c.overflow, frame)
+	return true
+}
+
+// dropFrame records a frame the client will not receive so that it gets a gap notice for its room.
+func (c *Client) dropFrame(frame *ServerFrame) {
+	droppedFrames.WithLabelValues(frame.RoomID.String()).Inc()
+
+	gap, pending := c.gaps[frame.RoomID]
+	if !pending {
+		gap = &GapPayload{FromEventID: frame.EventID}
+		c.gaps[frame.RoomID] = gap
+	}
+	if gap.FromEventID == 0 {
+		gap.FromEventID = frame.EventID
+	}
+	if frame.EventID != 0 {
+		gap.ToEventID = frame.EventID
+	}
+	gap.Dropped++
+}
+
+// drainOverflow moves frames from the overflow queue into the send buffer while it has room, and then
+// sends the gap notices still pending so clients learn about a gap even if their room goes quiet.
+func (c *Client) drainOverflow() {
+	c.deliverMu.Lock()
+	defer c.deliverMu.Unlock()
+
+	for len(c.overflow) > 0 {
+		frame := c.overflow[0]
+		if gap, pending := c.gaps[frame.RoomID]; pending {
+			select {
+			case c.send <- NewRoomFrame(FrameGap, frame.RoomID, *gap):
+				delete(c.gaps, frame.RoomID)
+			default:
+				return
+			}
+		}
+		select {
+		case c.send <- frame:
+			c.overflow[0] = nil
+			c.overflow = c.overflow[1:]
+		default:
+			return
+		}
+	}
+	c.overflow = nil
+
+	for roomID, gap := range c.gaps {
+		select {
+		case c.send <- NewRoomFrame(FrameGap, roomID, *gap):
+			delete(c.gaps, roomID)
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package rooms
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/google/uuid"
+)
+
+// UsersChannel is the Pub/Sub channel carrying user-level events that are not bound to a single room.
+const UsersChannel = "chat:users"
+
+// RoomChannel returns the Pub/Sub channel carrying the events of a room. A node only subscribes to the
+// channels of the rooms it has loaded.
+func RoomChannel(roomID uuid.UUID) string {
+	return "chat:room:" + roomID.String()
+}
+
+// Kinds of events exchanged between nodes.
+const (
+	// BusKindRoomFrame carries a ServerFrame to broadcast to a room's clients.
+	BusKindRoomFrame = "room_frame"
+	// BusKindUserStatus carries a UserStatusPayload.
+	BusKindUserStatus = "user_status"
+	// BusKindMembership carries a MembershipChange.
+	BusKindMembership = "membership"
+	// BusKindTokenRevoked carries a TokenRevocation.
+	BusKindTokenRevoked = "token_revoked"
+	// BusKindDirectFrame carries a DirectFrame for a single connection, published on its room's channel.
+	BusKindDirectFrame = "direct_frame"
+	// BusKindUserFrame carries a UserFrame for every connection of a user.
+	BusKindUserFrame = "user_frame"
+)
+
+// BusEvent is the envelope of every event exchanged between nodes over Redis Pub/Sub.
+// NodeID identifies the publishing node, which has already delivered the event to its own clients.
+type BusEvent struct {
+	NodeID string          `json:"node_id"`
+	Kind   string          `json:"kind"`
+	Data   json.RawMessage `json:"data"`
+}
+
+// NodeID returns the ID this node stamps on the events it publishes.
+func (m *Manager) NodeID() string {
+	return m.nodeID
+}
+
+// PublishFrame delivers a room frame to this node's clients and publishes it to the other nodes
+// that have the room loaded.
+func (m *Manager) PublishFrame(ctx context.Context, frame *ServerFrame) error {
+	m.BroadcastFrame(frame)
+	return m.publishBusEvent(ctx, RoomChannel(frame.RoomID), BusKindRoomFrame, frame)
+}
+
+// PublishUserStatus delivers a user status change to this node's rooms and publishes it to all other nodes.
+func (m *Manager) PublishUserStatus(ctx context.Context, status UserStatusPayload) error {
+	m.handleUserStatus(ctx, status)
+	return m.publishBusEvent(ctx, UsersChannel, BusKindUserStatus, status)
+}
+
+// publishBusEvent wraps data in a BusEvent stamped with this node's ID and publishes it on channel.
+func (m *Manager) publishBusEvent(ctx context.Context, channel, kind string, data interface{}) error {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s event: %w", kind, err)
+	}
+	event, err := json.Marshal(BusEvent{NodeID: m.nodeID, Kind: kind, Data: encoded})
+	if err != nil {
+		return fmt.Errorf("failed to marshal bus event: %w", err)
+	}
+	return m.cache.Publish(ctx, channel, string(event))
+}
+
+// syncRoomChannel subscribes to the channel of a room if it is loaded and unsubscribes from it otherwise.
+// Rooms are loaded and evicted under roomsMu but their channels change outside it, so the room is looked
+// up again under channelsMu: whichever of a concurrent eviction and reload syncs last sees the room's
+// final state.
+func (m *Manager) syncRoomChannel(ctx context.Context, roomID uuid.UUID) {
+	m.channelsMu.Lock()
+	defer m.channelsMu.Unlock()
+
+	m.roomsMu.RLock()
+	_, loaded := m.rooms[roomID]
+	m.roomsMu.RUnlock()
+
+	if loaded {
+		m.subscribeRoomChannel(ctx, roomID)
+	} else {
+		m.unsubscribeRoomChannel(ctx, roomID)
+	}
+}
+
+// subscribeRoomChannel starts receiving the events other nodes publish for a room.
+func (m *Manager) subscribeRoomChannel(ctx context.Context, roomID uuid.UUID) {
+	if err := m.pubsub.Subscribe(ctx, RoomChannel(roomID)); err != nil {
+		log.Printf("Error subscribing to channel of room %s: %v", roomID, err)
+	}
+}
+
+// unsubscribeRoomChannel stops receiving the events other nodes publish for a room.
+func (m *Manager) unsubscribeRoomChannel(ctx context.Context, roomID uuid.UUID) {
+	if err := m.pubsub.Unsubscribe(ctx, RoomChannel(roomID)); err != nil {
+		log.Printf("Error unsubscribing from channel of room %s: %v", roomID, err)
+	}
+}
+
+// subscribeToPubSub receives events published by other nodes until ctx is cancelled
+func (m *Manager) subscribeToPubSub(ctx context.Context) {
+	ch := m.pubsub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-ch:
+			if !ok || msg == nil {
+				return
+			}
+			// Handle sync messages from other nodes
+			m.handleSyncMessage(ctx, msg.Channel, msg.Payload)
+		}
+	}
+}
+
+// handleSyncMessage handles sync messages from Redis, dropping the ones this node published itself
+func (m *Manager) handleSyncMessage(ctx context.Context, channel, payload string) {
+	var event BusEvent
+	if err := json.Unmarshal([]byte(payload), &event); err != nil {
+		log.Printf("Error unmarshaling bus event on %s: %v", channel, err)
+		return
+	}
+	if event.NodeID == m.nodeID {
+		return
+	}
+
+	switch event.Kind {
+	case BusKindRoomFrame:
+		frame, err := DecodeServerFrame(event.Data)
+		if err != nil {
+			log.Printf("Error unmarshaling room frame on %s: %v", channel, err)
+			return
+		}
+		if frame.RoomID == uuid.Nil {
+			log.Printf("Missing room_id in room frame on %s", channel)
+			return
+		}
+		m.BroadcastFrame(frame)
+	case BusKindUserStatus:
+		var status UserStatusPayload
+		if err := json.Unmarshal(event.Data, &status); err != nil {
+			log.Printf("Error unmarshaling user status on %s: %v", channel, err)
+			return
+		}
+		m.handleUserStatus(ctx, status)
+	case BusKindMembership:
+		var change MembershipChange
+		if err := json.Unmarshal(event.Data, &change); err != nil {
+			log.Printf("Error unmarshaling membership change on %s: %v", channel, err)
+			return
+		}
+		m.handleMembershipChange(change)
+	case BusKindTokenRevoked:
+		var revocation TokenRevocation
+		if err := json.Unmarshal(event.Data, &revocation); err != nil {
+			log.Printf("Error unmarshaling token revocation on %s: %v", channel, err)
+			return
+		}
+		m.handleTokenRevocation(revocation)
+	case BusKindDirectFrame:
+		var direct DirectFrame
+		if err := json.Unmarshal(event.Data, &direct); err != nil {
+			log.Printf("Error unmarshaling direct frame on %s: %v", channel, err)
+			return
+		}
+		m.handleDirectFrame(direct)
+	case BusKindUserFrame:
+		var userFrame UserFrame
+		if err := json.Unmarshal(event.Data, &userFrame); err != nil {
+			log.Printf("Error unmarshaling user frame on %s: %v", channel, err)
+			return
+		}
+		m.handleUserFrame(userFrame)
+	default:
+		log.Printf("Unknown bus event kind %q on %s", event.Kind, channel)
+	}
+}
+
+// handleUserStatus broadcasts a user's status change to the rooms loaded on this node that the user is a member of.
+func (m *Manager) handleUserStatus(ctx context.Context, status UserStatusPayload) {
+	memberRooms, err := m.db.GetRoomsByUser(ctx, status.UserID)
+	if err != nil {
+		log.Printf("Error fetching rooms of user %s: %v", status.UserID, err)
+		return
+	}
+	for _, room := range memberRooms {
+		m.BroadcastEvent(room.ID, FrameStatusChange, status)
+	}
+}
@@ -0,0 +1,422 @@
+package rooms
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/dukepan/multi-rooms-chat-back/internal/cache"
+	"github.com/dukepan/multi-rooms-chat-back/internal/models"
+	"github.com/google/uuid"
+)
+
+// callTTL is how long a call's state is kept in Redis after its last join, so that calls left behind
+// by a node that died do not stay active forever.
+const callTTL = 12 * time.Hour
+
+// Kinds of calls.
+const (
+	CallKindAudio = "audio"
+	CallKindVideo = "video"
+)
+
+// Types of the WebRTC signals relayed between call participants.
+const (
+	SignalOffer        = "offer"
+	SignalAnswer       = "answer"
+	SignalICECandidate = "ice_candidate"
+)
+
+// CallEventContent is the content of the system messages that record a room's call history.
+type CallEventContent struct {
+	Event           string `json:"event"` // call_started, call_ended
+	CallID          string `json:"call_id"`
+	Kind            string `json:"kind,omitempty"`
+	DurationSeconds int64  `json:"duration_seconds,omitempty"`
+}
+
+// activeCall is the call a client takes part in.
+type activeCall struct {
+	ID        string
+	RoomID    uuid.UUID
+	Kind      string
+	StartedAt time.Time
+}
+
+// DirectFrame is a frame addressed to a single connection, which may be on another node.
+type DirectFrame struct {
+	ConnID uuid.UUID       `json:"conn_id"`
+	Frame  json.RawMessage `json:"frame"`
+}
+
+// SendToConnection delivers a frame to a single connection, publishing it on the channel of the frame's
+// room when the connection is not on this node.
+func (m *Manager) SendToConnection(ctx context.Context, connID uuid.UUID, frame *ServerFrame) error {
+	if m.deliverToConnection(connID, frame) {
+		return nil
+	}
+	encoded, err := json.Marshal(frame)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s frame: %w", frame.Type, err)
+	}
+	return m.publishBusEvent(ctx, RoomChannel(frame.RoomID), BusKindDirectFrame, DirectFrame{ConnID: connID, Frame: encoded})
+}
+
+// deliverToConnection queues a frame for a connection of this node, reporting false if it is not here.
+func (m *Manager) deliverToConnection(connID uuid.UUID, frame *ServerFrame) bool {
+	m.connsMu.Lock()
+	var target *Client
+	for conn := range m.conns {
+		if client, ok := conn.(*Client); ok && client.id == connID {
+			target = client
+			break
+		}
+	}
+	m.connsMu.Unlock()
+
+	if target == nil {
+		return false
+	}
+	target.queue(frame)
+	return true
+}
+
+// handleDirectFrame delivers a frame another node addressed to a connection, if it is on this node.
+func (m *Manager) handleDirectFrame(direct DirectFrame) {
+	frame, err := DecodeServerFrame(direct.Frame)
+	if err != nil {
+		log.Printf("Error unmarshaling direct frame for connection %s: %v", direct.ConnID, err)
+		return
+	}
+	m.deliverToConnection(direct.ConnID, frame)
+}
+
+// handleCallFrame dispatches the call frames of a room the client is subscribed to.
+func (c *Client) handleCallFrame(ctx context.Context, frame *ClientFrame, room *Room) (interface{}, error) {
+	switch frame.Type {
+	case FrameCallStart:
+		var payload CallStartPayload
+		if len(frame.Payload) > 0 {
+			if err := decodePayload(frame, &payload); err != nil {
+				return nil, err
+			}
+		}
+		if payload.Kind == "" {
+			payload.Kind = CallKindAudio
+		}
+		if payload.Kind != CallKindAudio && payload.Kind != CallKindVideo {
+			return nil, newProtocolError(ErrCodeBadRequest, "kind must be %s or %s", CallKindAudio, CallKindVideo)
+		}
+		return c.startCall(ctx, room.ID, payload.Kind)
+	case FrameCallJoin:
+		var payload CallPayload
+		if err := decodePayload(frame, &payload); err != nil {
+			return nil, err
+		}
+		if payload.CallID == "" {
+			return nil, newProtocolError(ErrCodeBadRequest, "call_id is required")
+		}
+		return c.joinCall(ctx, room.ID, payload.CallID)
+	case FrameCallLeave:
+		call, err := c.currentCall(ctx, room.ID)
+		if err != nil {
+			return nil, err
+		}
+		if call == nil {
+			return nil, newProtocolError(ErrCodeNotFound, "not in a call in room %s", room.ID)
+		}
+		return nil, c.leaveCall(ctx)
+	case FrameCallEnd:
+		return nil, c.endCall(ctx, room.ID)
+	case FrameCallSignal:
+		var payload CallSignalPayload
+		if err := decodePayload(frame, &payload); err != nil {
+			return nil, err
+		}
+		return nil, c.relaySignal(ctx, room.ID, payload)
+	default:
+		return nil, newProtocolError(ErrCodeUnknownType, "unknown frame type %q", frame.Type)
+	}
+}
+
+// startCall starts a call in a room with the client as its first participant.
+func (c *Client) startCall(ctx context.Context, roomID uuid.UUID, kind string) (*CallStatePayload, error) {
+	if err := c.checkNotInCall(ctx); err != nil {
+		return nil, err
+	}
+
+	call := cache.Call{
+		ID:        uuid.NewString(),
+		RoomID:    roomID,
+		Kind:      kind,
+		StartedBy: c.userID,
+		StartedAt: time.Now(),
+	}
+	active, err := c.manager.cache.StartCall(ctx, call, c.id, callTTL)
+	if err != nil {
+		return nil, err
+	}
+	if active != call.ID {
+		return nil, newProtocolError(ErrCodeConflict, "room %s already has an active call %s", roomID, active)
+	}
+
+	c.setCall(&activeCall{ID: call.ID, RoomID: roomID, Kind: kind, StartedAt: call.StartedAt})
+
+	c.publishCallEvent(ctx, roomID, FrameCallStarted, map[string]interface{}{
+		"call_id":    call.ID,
+		"kind":       kind,
+		"started_by": c.userID,
+		"started_at": call.StartedAt,
+	})
+	c.recordCallEvent(roomID, CallEventContent{Event: FrameCallStarted, CallID: call.ID, Kind: kind})
+
+	return &CallStatePayload{
+		CallID:         call.ID,
+		Kind:           kind,
+		StartedBy:      c.userID,
+		StartedAt:      call.StartedAt,
+		ParticipantIDs: []uuid.UUID{c.userID},
+	}, nil
+}
+
+// joinCall adds the client to a room's active call. If the user already takes part in it from another
+// connection, this connection replaces it.
+func (c *Client) joinCall(ctx context.Context, roomID uuid.UUID, callID string) (*CallStatePayload, error) {
+	if err := c.checkNotInCall(ctx); err != nil {
+		return nil, err
+	}
+
+	joined, err := c.manager.cache.JoinCall(ctx, roomID, callID, c.userID, c.id, callTTL)
+	if err != nil {
+		return nil, err
+	}
+	if !joined {
+		return nil, newProtocolError(ErrCodeNotFound, "call %s is not active in room %s", callID, roomID)
+	}
+	state, err := c.manager.cache.GetCall(ctx, callID)
+	if err != nil {
+		return nil, err
+	}
+	if state == nil {
+		// The call ended right after the join
+		return nil, newProtocolError(ErrCodeNotFound, "call %s is not active in room %s", callID, roomID)
+	}
+
+	c.setCall(&activeCall{ID: callID, RoomID: roomID, Kind: state.Kind, StartedAt: state.StartedAt})
+
+	c.publishCallEvent(ctx, roomID, FrameCallJoined, map[string]interface{}{
+		"call_id": callID,
+		"user_id": c.userID,
+	})
+
+	return newCallStatePayload(state), nil
+}
+
+// leaveCall removes the client from its call, if any, ending the call if it was the last participant.
+func (c *Client) leaveCall(ctx context.Context) error {
+	c.callMu.Lock()
+	call := c.call
+	c.call = nil
+	c.callMu.Unlock()
+	if call == nil {
+		return nil
+	}
+
+	left, ended, err := c.manager.cache.LeaveCall(ctx, call.RoomID, call.ID, c.userID, c.id)
+	if err != nil {
+		return err
+	}
+	if !left {
+		// The call already ended, or another connection of the user took this one's place
+		return nil
+	}
+
+	c.publishCallEvent(ctx, call.RoomID, FrameCallLeft, map[string]interface{}{
+		"call_id": call.ID,
+		"user_id": c.userID,
+	})
+	if ended {
+		c.publishCallEnded(ctx, call)
+	}
+	return nil
+}
+
+// endCall ends the client's call in a room for every participant. Only the user who started it can end it.
+func (c *Client) endCall(ctx context.Context, roomID uuid.UUID) error {
+	call, err := c.currentCall(ctx, roomID)
+	if err != nil {
+		return err
+	}
+	if call == nil {
+		return newProtocolError(ErrCodeNotFound, "not in a call in room %s", roomID)
+	}
+	state, err := c.manager.cache.GetCall(ctx, call.ID)
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		c.setCall(nil)
+		return newProtocolError(ErrCodeNotFound, "call %s is not active", call.ID)
+	}
+	if state.StartedBy != c.userID {
+		return newProtocolError(ErrCodeForbidden, "only the user who started call %s can end it", call.ID)
+	}
+
+	ended, err := c.manager.cache.EndCall(ctx, roomID, call.ID)
+	if err != nil {
+		return err
+	}
+	c.setCall(nil)
+	if ended {
+		c.publishCallEnded(ctx, call)
+	}
+	return nil
+}
+
+// relaySignal forwards a WebRTC signal from the client to the connection another participant takes
+// part in the call with. Signals are never broadcast to the room.
+func (c *Client) relaySignal(ctx context.Context, roomID uuid.UUID, payload CallSignalPayload) error {
+	switch payload.SignalType {
+	case SignalOffer, SignalAnswer, SignalICECandidate:
+	default:
+		return newProtocolError(ErrCodeBadRequest, "signal_type must be %s, %s or %s", SignalOffer, SignalAnswer, SignalICECandidate)
+	}
+	if payload.CallID == "" || payload.ToUserID == uuid.Nil || len(payload.Data) == 0 {
+		return newProtocolError(ErrCodeBadRequest, "call_id, to_user_id and data are required")
+	}
+	if payload.ToUserID == c.userID {
+		return newProtocolError(ErrCodeBadRequest, "cannot signal yourself")
+	}
+
+	state, err := c.manager.cache.GetCall(ctx, payload.CallID)
+	if err != nil {
+		return err
+	}
+	if state == nil || state.RoomID != roomID || state.Participants[c.userID] != c.id {
+		return newProtocolError(ErrCodeNotFound, "not in call %s", payload.CallID)
+	}
+	target, ok := state.Participants[payload.ToUserID]
+	if !ok {
+		return newProtocolError(ErrCodeNotFound, "user %s is not in call %s", payload.ToUserID, payload.CallID)
+	}
+
+	frame := &ServerFrame{
+		Version: ProtocolVersion,
+		Type:    FrameCallSignal,
+		RoomID:  roomID,
+		Payload: CallSignalPayload{
+			CallID:     payload.CallID,
+			FromUserID: c.userID,
+			SignalType: payload.SignalType,
+			Data:       payload.Data,
+		},
+	}
+	return c.manager.SendToConnection(ctx, target, frame)
+}
+
+// currentCall returns the client's call in a room, or nil if it takes part in none there. A call that
+// has ended, or that another connection of the user has taken over, is cleared.
+func (c *Client) currentCall(ctx context.Context, roomID uuid.UUID) (*activeCall, error) {
+	c.callMu.Lock()
+	call := c.call
+	c.callMu.Unlock()
+	if call == nil || call.RoomID != roomID {
+		return nil, nil
+	}
+
+	state, err := c.manager.cache.GetCall(ctx, call.ID)
+	if err != nil {
+		return nil, err
+	}
+	if state == nil || state.Participants[c.userID] != c.id {
+		c.callMu.Lock()
+		if c.call == call {
+			c.call = nil
+		}
+		c.callMu.Unlock()
+		return nil, nil
+	}
+	return call, nil
+}
+
+// checkNotInCall reports an error if the client still takes part in a call. A connection takes part
+// in at most one call at a time.
+func (c *Client) checkNotInCall(ctx context.Context) error {
+	c.callMu.Lock()
+	call := c.call
+	c.callMu.Unlock()
+	if call == nil {
+		return nil
+	}
+
+	current, err := c.currentCall(ctx, call.RoomID)
+	if err != nil {
+		return err
+	}
+	if current != nil {
+		return newProtocolError(ErrCodeConflict, "already in call %s in room %s", current.ID, current.RoomID)
+	}
+	return nil
+}
+
+// setCall records the call the client takes part in.
+func (c *Client) setCall(call *activeCall) {
+	c.callMu.Lock()
+	c.call = call
+	c.callMu.Unlock()
+}
+
+// publishCallEnded tells the room a call ended and records it in the room's history.
+func (c *Client) publishCallEnded(ctx context.Context, call *activeCall) {
+	duration := int64(time.Since(call.StartedAt).Seconds())
+	c.publishCallEvent(ctx, call.RoomID, FrameCallEnded, map[string]interface{}{
+		"call_id":          call.ID,
+		"ended_by":         c.userID,
+		"duration_seconds": duration,
+	})
+	c.recordCallEvent(call.RoomID, CallEventContent{Event: FrameCallEnded, CallID: call.ID, Kind: call.Kind, DurationSeconds: duration})
+}
+
+// publishCallEvent delivers a call event to the room on every node. The call state is already stored,
+// so a failure to publish is only logged.
+func (c *Client) publishCallEvent(ctx context.Context, roomID uuid.UUID, eventType string, data map[string]interface{}) {
+	if err := c.manager.syncEngine.PublishRoomEvent(ctx, roomID, eventType, data); err != nil {
+		log.Printf("Error publishing %s event for room %s: %v", eventType, roomID, err)
+	}
+}
+
+// recordCallEvent queues a system message recording a call event in the room's history.
+func (c *Client) recordCallEvent(roomID uuid.UUID, event CallEventContent) {
+	content, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Error marshaling %s event of call %s: %v", event.Event, event.CallID, err)
+		return
+	}
+	msg := &models.Message{
+		RoomID:      roomID,
+		UserID:      c.userID,
+		Content:     string(content),
+		MessageType: models.MessageTypeSystem,
+		CreatedAt:   time.Now(),
+	}
+	if err := c.messageWriter.QueueMessage(msg); err != nil {
+		log.Printf("Error recording %s event of call %s in room %s: %v", event.Event, event.CallID, roomID, err)
+	}
+}
+
+// newCallStatePayload converts the stored state of a call into the payload sent to clients.
+func newCallStatePayload(state *cache.Call) *CallStatePayload {
+	payload := &CallStatePayload{
+		CallID:         state.ID,
+		Kind:           state.Kind,
+		StartedBy:      state.StartedBy,
+		StartedAt:      state.StartedAt,
+		ParticipantIDs: make([]uuid.UUID, 0, len(state.Participants)),
+	}
+	for userID := range state.Participants {
+		payload.ParticipantIDs = append(payload.ParticipantIDs, userID)
+	}
+	return payload
+}
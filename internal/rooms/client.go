@@ -3,10 +3,12 @@ package rooms
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"log"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/dukepan/multi-rooms-chat-back/internal/cache"
 	"github.com/dukepan/multi-rooms-chat-back/internal/models"
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
@@ -24,37 +26,118 @@ const (
 
 	// Maximum message size allowed from peer.
 	maxMessageSize = 512
+
+	// Maximum size of a call_signal frame, which carries SDP offers and answers of a few kilobytes.
+	maxSignalFrameSize = 16 * 1024
+
+	// Maximum size of a reauth frame, which carries a signed JWT of under a kilobyte.
+	maxReauthFrameSize = 4 * 1024
+
+	// Maximum size of a message frame carrying a poll, which fits the most options validatePoll allows
+	// with room to spare for the question.
+	maxPollFrameSize = 4 * 1024
+
+	// Maximum length of a client-generated message ID.
+	maxClientMsgIDLength = 64
+
+	// Time allowed for a chat message to be persisted before its send is reported as failed.
+	persistTimeout = 10 * time.Second
 )
 
-// Client is a middleman between the websocket connection and the room.
+// Client is a middleman between the websocket connection and the rooms it is subscribed to.
+// A single connection can be subscribed to any number of rooms at the same time.
 type Client struct {
-	room          *Room
+	id            uuid.UUID // Identifies this connection among the user's connections
+	deviceID      string    // Identifies the device the connection comes from
+	manager       *Manager
 	conn          *websocket.Conn
-	send          chan interface{}
+	send          chan *ServerFrame
 	userID        uuid.UUID
 	messageWriter MessageWriterService
+	version       int
+
+	rooms   map[uuid.UUID]*Room
+	roomsMu sync.RWMutex
+
+	// replaying holds back live frames of rooms whose missed events are being replayed
+	replaying map[uuid.UUID]*replayBuffer
+	// overflow queues live frames under PolicyBuffer while the send buffer is full
+	overflow []*ServerFrame
+	// gaps records, per room, the frames dropped since the client was last told about a gap
+	gaps      map[uuid.UUID]*GapPayload
+	deliverMu sync.Mutex
+
+	done     chan struct{}
+	stopOnce sync.Once
+	// closeCode and closeReason are sent in the close frame once done is closed
+	closeCode   int
+	closeReason string
+
+	// violations counts the frames rejected by flood control since lastViolation's window started
+	violations    int
+	lastViolation time.Time
+
+	// lastActive is when the client last sent a frame, in Unix nanoseconds
+	lastActive atomic.Int64
+	// presenceRemoved is set once the connection has been removed from the user's presence
+	presenceRemoved bool
+	presenceMu      sync.Mutex
+
+	// token is the token the connection is authenticated with, replaced by reauth frames
+	token          TokenInfo
+	tokenMu        sync.Mutex
+	tokenRefreshed chan struct{}
+
+	// call is the call the connection takes part in, if any
+	call   *activeCall
+	callMu sync.Mutex
 }
 
-// NewClient creates a new client for a room
-func NewClient(room *Room, conn *websocket.Conn, userID uuid.UUID, messageWriter MessageWriterService) *Client {
-	return &Client{
-		room:          room,
+// NewClient creates a new client for a WebSocket connection. The client is not subscribed to any room
+// until Subscribe is called. The protocol version is taken from the subprotocol negotiated during the upgrade.
+// deviceID groups the connections of one device in the user's presence; if empty, the connection is
+// counted as a device of its own. The connection is closed once token expires unless the client reauthenticates.
+func NewClient(manager *Manager, conn *websocket.Conn, userID uuid.UUID, deviceID string, token TokenInfo, messageWriter MessageWriterService) *Client {
+	version, ok := ProtocolVersionFor(conn.Subprotocol())
+	if !ok {
+		version = ProtocolVersion
+	}
+	id := uuid.New()
+	if deviceID == "" {
+		deviceID = id.String()
+	}
+	client := &Client{
+		id:            id,
+		deviceID:      deviceID,
+		manager:       manager,
 		conn:          conn,
-		send:          make(chan interface{}, 256),
+		send:          make(chan *ServerFrame, 256),
 		userID:        userID,
 		messageWriter: messageWriter,
+		version:       version,
+		rooms:         make(map[uuid.UUID]*Room),
+		replaying:     make(map[uuid.UUID]*replayBuffer),
+		gaps:          make(map[uuid.UUID]*GapPayload),
+		done:          make(chan struct{}),
+
+		token:          token,
+		tokenRefreshed: make(chan struct{}, 1),
 	}
+	client.lastActive.Store(time.Now().UnixNano())
+	return client
+}
+
+// UserID returns the ID of the user the client is authenticated as.
+func (c *Client) UserID() uuid.UUID {
+	return c.userID
 }
 
-// readPump pumps messages from the websocket connection to the room.
+// readPump pumps messages from the websocket connection to the rooms.
 // A goroutine is started for each connection. The application ensures that there is at most one reader per connection by invoking this as a goroutine.
 func (c *Client) readPump() {
-	defer func() {
-		c.room.unregister <- c
-		c.conn.Close()
-	}()
+	defer c.Stop()
 
-	c.conn.SetReadLimit(maxMessageSize)
+	c.conn.SetReadLimit(maxSignalFrameSize)
 	c.conn.SetReadDeadline(time.Now().Add(pongWait))
 	c.conn.SetPongHandler(func(string) error { c.conn.SetReadDeadline(time.Now().Add(pongWait)); return nil })
 
@@ -67,58 +150,237 @@ func (c *Client) readPump() {
 			break
 		}
 
-		var msg map[string]interface{}
-		if err := json.Unmarshal(message, &msg); err != nil {
-			log.Printf("error unmarshaling message: %v", err)
+		c.markActive()
+
+		var frame ClientFrame
+		if err := json.Unmarshal(message, &frame); err != nil {
+			c.reply(&frame, nil, newProtocolError(ErrCodeBadRequest, "malformed frame: %v", err))
 			continue
 		}
-
-		messageType, ok := msg["type"].(string)
-		if !ok {
-			log.Printf("message type not found or invalid")
+		if limit := frameSizeLimit(&frame); len(message) > limit {
+			c.reply(&frame, nil, newProtocolError(ErrCodeBadRequest, "frame exceeds %d bytes", limit))
 			continue
 		}
 
-		switch messageType {
-		case "message":
-			content, ok := msg["content"].(string)
-			if !ok {
-				log.Printf("message content not found or invalid")
-				continue
+		// Flood control: rate-limited frames get an error, and clients that keep flooding are disconnected
+		if disconnect, err := c.checkFlood(context.Background(), frame.Type); err != nil {
+			c.reply(&frame, nil, err)
+			if disconnect {
+				c.closeForFlood()
+				break
 			}
-			fileURL, _ := msg["file_url"].(string)             // Optional
-			chatMessageType, _ := msg["message_type"].(string) // text, image, file
-			c.handleChatMessage(context.Background(), content, chatMessageType, fileURL)
-		case "typing_start":
-			c.room.HandleTypingEvent(c.userID, true)
-		case "typing_stop":
-			c.room.HandleTypingEvent(c.userID, false)
-		case "read":
-			messageID, ok := msg["message_id"].(float64)
-			if !ok {
-				log.Printf("message_id for read receipt not found or invalid")
-				continue
+			continue
+		}
+
+		result, err := c.handleFrame(context.Background(), &frame)
+		if err == errReplyPending {
+			continue
+		}
+		c.reply(&frame, result, err)
+	}
+}
+
+// frameSizeLimit returns the maximum size of a frame of the given type. The connection's read limit
+// is the largest of them.
+func frameSizeLimit(frame *ClientFrame) int {
+	switch frame.Type {
+	case FrameCallSignal:
+		return maxSignalFrameSize
+	case FrameReauth:
+		return maxReauthFrameSize
+	case FrameMessage:
+		var payload struct {
+			Poll json.RawMessage `json:"poll"`
+		}
+		if json.Unmarshal(frame.Payload, &payload) == nil && len(payload.Poll) > 0 && string(payload.Poll) != "null" {
+			return maxPollFrameSize
+		}
+		return maxMessageSize
+	default:
+		return maxMessageSize
+	}
+}
+
+// handleFrame dispatches a single client command and returns the payload for its ack.
+func (c *Client) handleFrame(ctx context.Context, frame *ClientFrame) (interface{}, error) {
+	if frame.Version != 0 && frame.Version != c.version {
+		return nil, newProtocolError(ErrCodeUnsupportedVersion, "frame version %d does not match negotiated version %d", frame.Version, c.version)
+	}
+	if frame.Type == "" {
+		return nil, newProtocolError(ErrCodeBadRequest, "missing frame type")
+	}
+	if frame.Type == FrameReauth {
+		var payload ReauthPayload
+		if err := decodePayload(frame, &payload); err != nil {
+			return nil, err
+		}
+		return c.handleReauth(ctx, payload)
+	}
+	if frame.RoomID == uuid.Nil {
+		return nil, newProtocolError(ErrCodeBadRequest, "missing room_id")
+	}
+
+	switch frame.Type {
+	case FrameSubscribe:
+		var payload SubscribePayload
+		if len(frame.Payload) > 0 {
+			if err := decodePayload(frame, &payload); err != nil {
+				return nil, err
 			}
-			c.handleRead(context.Background(), int64(messageID))
-		case "message_edited", "message_deleted":
-			// For edited/deleted messages, simply re-broadcast the raw message to the room
-			// The client-side will interpret the 'edited_at' or 'deleted_at' fields
-			c.room.broadcast <- msg
-		case "reaction_added", "reaction_removed":
-			// For reaction updates, simply re-broadcast the raw event to the room
-			// The client-side will update the UI accordingly
-			c.room.broadcast <- msg
+		}
+		lastEventID, err := c.Subscribe(ctx, frame.RoomID, payload.LastEventID)
+		if err != nil {
+			return nil, err
+		}
+		activeCallID, err := c.manager.cache.GetRoomCall(ctx, frame.RoomID)
+		if err != nil {
+			log.Printf("Error fetching active call of room %s: %v", frame.RoomID, err)
+		}
+		return SubscribeAckPayload{LastEventID: lastEventID, ActiveCallID: activeCallID}, nil
+	case FrameUnsubscribe:
+		c.Unsubscribe(frame.RoomID)
+		return nil, nil
+	}
+
+	room := c.subscribedRoom(frame.RoomID)
+	if room == nil {
+		return nil, newProtocolError(ErrCodeNotSubscribed, "not subscribed to room %s", frame.RoomID)
+	}
+
+	switch frame.Type {
+	case FrameMessage:
+		var payload ChatMessagePayload
+		if err := decodePayload(frame, &payload); err != nil {
+			return nil, err
+		}
+		if payload.Content == "" && payload.FileURL == "" {
+			return nil, newProtocolError(ErrCodeBadRequest, "message content is required")
+		}
+		switch payload.MessageType {
+		case "", "text", "image", "file", models.MessageTypePoll:
 		default:
-			log.Printf("unknown message type: %s", messageType)
+			return nil, newProtocolError(ErrCodeBadRequest, "message_type must be text, image, file or poll")
+		}
+		if err := validatePoll(payload); err != nil {
+			return nil, err
+		}
+		if len(payload.ClientMsgID) > maxClientMsgIDLength {
+			return nil, newProtocolError(ErrCodeBadRequest, "client_msg_id exceeds %d characters", maxClientMsgIDLength)
+		}
+		if payload.TTLSeconds != nil && !ValidMessageTTL(*payload.TTLSeconds) {
+			return nil, newProtocolError(ErrCodeBadRequest, "ttl_seconds must be between 1 and %d", MaxMessageTTLSeconds)
+		}
+		if payload.SendAt != nil || (payload.UndoSend && c.manager.undoSendWindow > 0) {
+			return c.scheduleMessage(ctx, room, payload)
+		}
+		// Persistence is awaited off the read loop; the ack is sent once the message is stored
+		go c.handleChatMessage(ctx, frame, room, payload)
+		return nil, errReplyPending
+	case FrameCancelSend:
+		var payload CancelSendPayload
+		if err := decodePayload(frame, &payload); err != nil {
+			return nil, err
+		}
+		if payload.ScheduledID <= 0 {
+			return nil, newProtocolError(ErrCodeBadRequest, "invalid scheduled_id")
+		}
+		return nil, actionError(c.manager.CancelScheduledMessage(ctx, c.userID, payload.ScheduledID))
+	case FrameTypingStart:
+		room.HandleTypingEvent(c.userID, true)
+		return nil, nil
+	case FrameTypingStop:
+		room.HandleTypingEvent(c.userID, false)
+		return nil, nil
+	case FrameRead:
+		var payload ReadPayload
+		if err := decodePayload(frame, &payload); err != nil {
+			return nil, err
+		}
+		return c.handleRead(ctx, room, payload.MessageID)
+	case FrameMessageEdited:
+		// Edits, deletes and reactions are applied by the server, which broadcasts the stored result
+		var payload EditMessagePayload
+		if err := decodePayload(frame, &payload); err != nil {
+			return nil, err
+		}
+		if payload.MessageID <= 0 || payload.Content == "" {
+			return nil, newProtocolError(ErrCodeBadRequest, "message_id and content are required")
+		}
+		updated, err := c.manager.EditMessage(ctx, c.userID, room.ID, payload.MessageID, payload.Content)
+		if err != nil {
+			return nil, actionError(err)
+		}
+		return updated, nil
+	case FrameMessageDeleted:
+		var payload DeleteMessagePayload
+		if err := decodePayload(frame, &payload); err != nil {
+			return nil, err
+		}
+		if payload.MessageID <= 0 {
+			return nil, newProtocolError(ErrCodeBadRequest, "invalid message_id")
+		}
+		if _, err := c.manager.DeleteMessage(ctx, c.userID, room.ID, payload.MessageID); err != nil {
+			return nil, actionError(err)
+		}
+		return nil, nil
+	case FrameReactionAdded, FrameReactionRemoved:
+		var payload ReactionPayload
+		if err := decodePayload(frame, &payload); err != nil {
+			return nil, err
+		}
+		if payload.MessageID <= 0 || payload.Emoji == "" || len(payload.Emoji) > maxEmojiLength {
+			return nil, newProtocolError(ErrCodeBadRequest, "message_id and an emoji of at most %d bytes are required", maxEmojiLength)
+		}
+		var err error
+		if frame.Type == FrameReactionAdded {
+			err = c.manager.AddReaction(ctx, c.userID, room.ID, payload.MessageID, payload.Emoji)
+		} else {
+			err = c.manager.RemoveReaction(ctx, c.userID, room.ID, payload.MessageID, payload.Emoji)
 		}
+		return nil, actionError(err)
+	case FrameCallStart, FrameCallJoin, FrameCallLeave, FrameCallEnd, FrameCallSignal:
+		return c.handleCallFrame(ctx, frame, room)
+	default:
+		return nil, newProtocolError(ErrCodeUnknownType, "unknown frame type %q", frame.Type)
 	}
 }
 
-// writePump pumps messages from the room to the websocket connection.
+// reply answers a client command with an ack carrying result, or an error frame if err is set.
+func (c *Client) reply(frame *ClientFrame, result interface{}, err error) {
+	if err == nil {
+		if result == nil {
+			result = AckPayload{Status: "ok"}
+		}
+		c.queue(&ServerFrame{Version: c.version, ID: frame.ID, Type: FrameAck, RoomID: frame.RoomID, Payload: result})
+		return
+	}
+
+	protoErr, ok := err.(*ProtocolError)
+	if !ok {
+		log.Printf("error handling %s frame from user %s: %v", frame.Type, c.userID, err)
+		protoErr = newProtocolError(ErrCodeInternal, "failed to process %s", frame.Type)
+	}
+	c.queue(&ServerFrame{
+		Version: c.version,
+		ID:      frame.ID,
+		Type:    FrameError,
+		RoomID:  frame.RoomID,
+		Payload: ErrorPayload{Code: protoErr.Code, Message: protoErr.Message},
+	})
+}
+
+// SendError sends the error frame a frameType command for roomID would have been answered with, for
+// commands the client did not send itself, such as subscribing to the room given when connecting.
+func (c *Client) SendError(frameType string, roomID uuid.UUID, err error) {
+	c.reply(&ClientFrame{Type: frameType, RoomID: roomID}, nil, err)
+}
+
+// writePump pumps messages from the rooms to the websocket connection.
 // A goroutine is started for each connection. The application ensures that there is at most one writer per connection by invoking this as a goroutine.
 func (c *Client) writePump() {
 	defer func() {
 		c.conn.Close()
+		c.manager.removeConnection(c)
 	}()
 
 	ticker := time.NewTicker(pingPeriod)
@@ -126,78 +388,244 @@ func (c *Client) writePump() {
 
 	for {
 		select {
-		case message, ok := <-c.send:
+		case message := <-c.send:
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if !ok {
-				// The room closed the channel.
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
-				return
-			}
 			err := c.conn.WriteJSON(message)
 			if err != nil {
 				log.Printf("error writing message: %v", err)
 				return
 			}
+			c.manager.RecordDelivery(c.userID, message)
+			c.drainOverflow()
 
 		case <-ticker.C:
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
 				return
 			}
+
+		case <-c.done:
+			// The client was stopped. Frames already queued, such as a server_draining notice, go out
+			// before the close frame.
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			for flushed := false; !flushed; {
+				select {
+				case message := <-c.send:
+					if err := c.conn.WriteJSON(message); err != nil {
+						return
+					}
+					c.manager.RecordDelivery(c.userID, message)
+				default:
+					flushed = true
+				}
+			}
+			c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(c.closeCode, c.closeReason))
+			return
+		}
+	}
+}
+
+// Subscribe adds the client to a room after verifying the user is a member of it.
+// If lastEventID is non-zero, the room events the client missed since then are replayed before live
+// delivery starts. It returns the ID of the latest event of the room, which the client can resume from.
+// Subscribing to a room the client already belongs to is a no-op.
+func (c *Client) Subscribe(ctx context.Context, roomID uuid.UUID, lastEventID int64) (int64, error) {
+	if c.subscribedRoom(roomID) != nil {
+		return c.manager.cache.LastRoomEventID(ctx, roomID)
+	}
+
+	isMember, err := c.manager.db.IsRoomMember(ctx, roomID, c.userID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to check room membership: %w", err)
+	}
+	if !isMember {
+		return 0, newProtocolError(ErrCodeNotMember, "not a member of room %s", roomID)
+	}
+
+	if lastEventID > 0 {
+		c.beginReplay(roomID)
+	}
+
+	// A room that has just been unloaded for being empty is loaded again
+	room := c.manager.GetOrCreateRoom(roomID)
+	for !room.addClient(c) {
+		room = c.manager.GetOrCreateRoom(roomID)
+	}
+
+	c.roomsMu.Lock()
+	c.rooms[roomID] = room
+	c.roomsMu.Unlock()
+
+	c.joinPresence(ctx, room)
+
+	if lastEventID > 0 {
+		return c.replayMissedEvents(ctx, room, lastEventID)
+	}
+	return c.manager.cache.LastRoomEventID(ctx, roomID)
+}
+
+// Unsubscribe removes the client from a room, leaving its call there if it takes part in one.
+// Unsubscribing from a room the client does not belong to is a no-op.
+func (c *Client) Unsubscribe(roomID uuid.UUID) {
+	c.roomsMu.Lock()
+	room, exists := c.rooms[roomID]
+	delete(c.rooms, roomID)
+	c.roomsMu.Unlock()
+
+	if !exists {
+		return
+	}
+
+	c.callMu.Lock()
+	inCall := c.call != nil && c.call.RoomID == roomID
+	c.callMu.Unlock()
+	if inCall {
+		if err := c.leaveCall(context.Background()); err != nil {
+			log.Printf("Error leaving call of user %s in room %s: %v", c.userID, roomID, err)
 		}
 	}
+	c.leaveRoom(context.Background(), room)
+}
+
+// subscribedRoom returns the room with the given ID if the client is subscribed to it, or nil otherwise.
+func (c *Client) subscribedRoom(roomID uuid.UUID) *Room {
+	c.roomsMu.RLock()
+	defer c.roomsMu.RUnlock()
+	return c.rooms[roomID]
 }
 
-// handleChatMessage processes incoming chat messages from a client
-func (c *Client) handleChatMessage(ctx context.Context, content string, messageType string, fileURL string) {
+// queue sends a frame to this client only, dropping it if the client's buffer is full.
+func (c *Client) queue(frame *ServerFrame) {
+	select {
+	case c.send <- frame:
+	default:
+		log.Printf("send buffer full for user %s, dropping %s frame", c.userID, frame.Type)
+	}
+}
+
+// handleChatMessage persists an incoming chat message and acks it with the stored message's server identity
+func (c *Client) handleChatMessage(ctx context.Context, frame *ClientFrame, room *Room, payload ChatMessagePayload) {
+	ctx, cancel := context.WithTimeout(ctx, persistTimeout)
+	defer cancel()
+	msg, err := c.newChatMessage(ctx, room, payload)
+	if err != nil {
+		c.reply(frame, nil, actionError(err))
+		return
+	}
+	if err := c.messageWriter.PersistMessage(ctx, msg); err != nil {
+		c.reply(frame, nil, newProtocolError(ErrCodeUnavailable, "message could not be stored: %v", err))
+		return
+	}
+	c.reply(frame, MessageAckPayload{ID: msg.ID, ClientMsgID: msg.ClientMsgID, CreatedAt: msg.CreatedAt}, nil)
+}
+
+// scheduleMessage stores a chat message to be sent at its send_at, or once the undo send window has
+// passed, and returns the scheduled message for the ack
+func (c *Client) scheduleMessage(ctx context.Context, room *Room, payload ChatMessagePayload) (interface{}, error) {
+	msg, err := c.newChatMessage(ctx, room, payload)
+	if err != nil {
+		return nil, actionError(err)
+	}
+	sendAt, undoSend := time.Now().Add(c.manager.undoSendWindow), true
+	if payload.SendAt != nil {
+		sendAt, undoSend = *payload.SendAt, false
+	}
+	scheduled, err := c.manager.ScheduleMessage(ctx, msg, sendAt, undoSend)
+	if err != nil {
+		return nil, actionError(err)
+	}
+	return scheduled, nil
+}
+
+// newChatMessage creates the message sent by a message frame. A reply is posted in the thread of its parent.
+func (c *Client) newChatMessage(ctx context.Context, room *Room, payload ChatMessagePayload) (*models.Message, error) {
+	messageType := payload.MessageType
+	if messageType == "" {
+		messageType = "text"
+	}
 	msg := &models.Message{
-		RoomID:      c.room.ID,
+		RoomID:      room.ID,
 		UserID:      c.userID,
-		Content:     content,
+		Content:     payload.Content,
 		MessageType: messageType,
-		FileURL:     fileURL,
+		FileURL:     payload.FileURL,
+		ClientMsgID: payload.ClientMsgID,
+		TTLSeconds:  payload.TTLSeconds,
 		CreatedAt:   time.Now(),
 	}
-
-	// Queue message for persistence
-	c.messageWriter.QueueMessage(msg)
+	if payload.Poll != nil {
+		msg.Poll = newPoll(payload.Poll)
+	}
+	if payload.ParentID != nil {
+		rootID, err := c.manager.resolveThreadRoot(ctx, room.ID, *payload.ParentID)
+		if err != nil {
+			return nil, err
+		}
+		msg.ParentID = &rootID
+	}
+	return msg, nil
 }
 
-// handleRead processes read receipts from a client
-func (c *Client) handleRead(ctx context.Context, messageID int64) {
-	// Persist read receipt to database
-	// Assuming MarkMessageRead is a method on db.Database
-	_ = c.room.manager.db.MarkMessageRead(ctx, messageID, c.userID)
+// handleRead moves the user's read cursor in a room forward, replying with the resulting cursor
+func (c *Client) handleRead(ctx context.Context, room *Room, messageID int64) (interface{}, error) {
+	if messageID <= 0 {
+		return nil, newProtocolError(ErrCodeBadRequest, "invalid message_id")
+	}
+	cursor, err := c.manager.MarkRead(ctx, c.userID, room.ID, messageID)
+	if err != nil {
+		return nil, actionError(err)
+	}
+	return ReadCursorPayload{LastReadMessageID: cursor}, nil
 }
 
 // Start begins the client's read and write pumps
 func (c *Client) Start() {
-	// Update user presence to online
-	c.room.manager.cache.SetUserPresence(context.Background(), c.userID, cache.PresenceState{
-		Status:   "online",
-		LastSeen: time.Now(),
-	})
+	if !c.manager.addConnection(c) {
+		// The node started draining after the upgrade, so send the client elsewhere right away
+		c.closeForDrain()
+		go c.writePump()
+		return
+	}
 
-	// Publish user status change
-	c.room.manager.syncEngine.PublishUserStatus(context.Background(), c.userID, "online")
+	// Count this connection in the user's presence, publishing the change if the user was offline
+	c.updatePresence(context.Background(), false)
 
 	go c.writePump()
 	go c.readPump()
-	// Register the client with the room after starting pumps
-	c.room.register <- c
+	go c.presenceLoop()
+	go c.tokenLoop()
 }
 
-// Stop gracefully shuts down the client
+// Stop gracefully shuts down the client, removing it from every room it is subscribed to.
+// It is safe to call Stop more than once.
 func (c *Client) Stop() {
-	// Update user presence to offline and last_seen
-	c.room.manager.cache.SetUserPresence(context.Background(), c.userID, cache.PresenceState{
-		Status:   "offline",
-		LastSeen: time.Now(),
-	})
+	c.CloseWith(websocket.CloseNormalClosure, "")
+}
+
+// CloseWith shuts down the client like Stop, closing the connection with the given close code and reason.
+// Only the first call to Stop or CloseWith has an effect.
+func (c *Client) CloseWith(code int, reason string) {
+	c.stopOnce.Do(func() {
+		c.closeCode = code
+		c.closeReason = reason
+
+		if err := c.leaveCall(context.Background()); err != nil {
+			log.Printf("Error leaving call of user %s: %v", c.userID, err)
+		}
 
-	// Publish user status change
-	c.room.manager.syncEngine.PublishUserStatus(context.Background(), c.userID, "offline")
+		c.roomsMu.Lock()
+		subscribed := c.rooms
+		c.rooms = make(map[uuid.UUID]*Room)
+		c.roomsMu.Unlock()
 
-	// Close the connection
-	c.conn.Close()
+		for _, room := range subscribed {
+			c.leaveRoom(context.Background(), room)
+		}
+
+		// The user only goes offline once this was their last connection on any node
+		c.updatePresence(context.Background(), true)
+
+		// Signal the write pump to close the connection
+		close(c.done)
+	})
 }
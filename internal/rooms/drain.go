@@ -0,0 +1,167 @@
+package rooms
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand/v2"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ErrDraining is returned when a connection is opened on a node that is draining.
+var ErrDraining = errors.New("server is draining")
+
+// DrainConfig configures how connections are moved off a node that is shutting down.
+type DrainConfig struct {
+	// WaveSize is the number of connections closed at once.
+	WaveSize int
+	// WaveInterval is the time between two waves.
+	WaveInterval time.Duration
+	// ReconnectWindow spreads the reconnects of the node's clients: each client is told to wait a random
+	// time within it before reconnecting, so that the remaining nodes are not hit all at once.
+	ReconnectWindow time.Duration
+}
+
+// DefaultDrainConfig returns the drain settings used unless configured otherwise.
+func DefaultDrainConfig() DrainConfig {
+	return DrainConfig{
+		WaveSize:        200,
+		WaveInterval:    500 * time.Millisecond,
+		ReconnectWindow: 10 * time.Second,
+	}
+}
+
+// connection is a client connection of any transport held open on this node.
+type connection interface {
+	// notifyDraining tells the connection that the node is going away.
+	notifyDraining(frame *ServerFrame)
+	// closeForDrain closes the connection so that its client reconnects to another node.
+	closeForDrain()
+}
+
+// SetDrainConfig sets how the manager drains its connections on shutdown.
+func (m *Manager) SetDrainConfig(cfg DrainConfig) {
+	defaults := DefaultDrainConfig()
+	if cfg.WaveSize <= 0 {
+		cfg.WaveSize = defaults.WaveSize
+	}
+	if cfg.WaveInterval < 0 {
+		cfg.WaveInterval = 0
+	}
+	if cfg.ReconnectWindow < 0 {
+		cfg.ReconnectWindow = 0
+	}
+	m.connsMu.Lock()
+	m.drain = cfg
+	m.connsMu.Unlock()
+}
+
+// Draining reports whether the node is draining and no longer accepts connections.
+func (m *Manager) Draining() bool {
+	return m.draining.Load()
+}
+
+// addConnection tracks a connection so that it is drained on shutdown. It returns false if the node is draining.
+func (m *Manager) addConnection(conn connection) bool {
+	m.connsMu.Lock()
+	defer m.connsMu.Unlock()
+	if m.draining.Load() {
+		return false
+	}
+	m.conns[conn] = struct{}{}
+	m.connsWG.Add(1)
+	return true
+}
+
+// removeConnection stops tracking a connection once it has been closed.
+func (m *Manager) removeConnection(conn connection) {
+	m.connsMu.Lock()
+	defer m.connsMu.Unlock()
+	if _, ok := m.conns[conn]; ok {
+		delete(m.conns, conn)
+		m.connsWG.Done()
+	}
+}
+
+// Drain moves the node's clients to other nodes ahead of a shutdown or deploy. It stops accepting
+// connections, sends every client a server_draining frame with a reconnect hint, and then closes the
+// connections in waves with code 1012 (service restart). It returns once every connection has been
+// closed, or when ctx is done, after closing all remaining connections at once.
+func (m *Manager) Drain(ctx context.Context) {
+	m.connsMu.Lock()
+	m.draining.Store(true)
+	cfg := m.drain
+	conns := make([]connection, 0, len(m.conns))
+	for conn := range m.conns {
+		conns = append(conns, conn)
+	}
+	m.connsMu.Unlock()
+
+	log.Printf("Draining %d connections in waves of %d", len(conns), cfg.WaveSize)
+
+	for _, conn := range conns {
+		var reconnectAfter time.Duration
+		if cfg.ReconnectWindow > 0 {
+			reconnectAfter = rand.N(cfg.ReconnectWindow)
+		}
+		conn.notifyDraining(&ServerFrame{
+			Version: ProtocolVersion,
+			Type:    FrameServerDraining,
+			Payload: DrainingPayload{ReconnectAfterMs: reconnectAfter.Milliseconds()},
+		})
+	}
+
+	for start := 0; start < len(conns); start += cfg.WaveSize {
+		if start > 0 {
+			select {
+			case <-time.After(cfg.WaveInterval):
+			case <-ctx.Done():
+				// Out of time: close everything that is left
+				cfg.WaveSize = len(conns)
+			}
+		}
+		end := min(start+cfg.WaveSize, len(conns))
+		for _, conn := range conns[start:end] {
+			conn.closeForDrain()
+		}
+	}
+
+	// Wait for the connections to flush their close frames
+	closed := make(chan struct{})
+	go func() {
+		m.connsWG.Wait()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+		log.Printf("All connections drained")
+	case <-ctx.Done():
+		log.Printf("Timed out waiting for connections to drain: %v", ctx.Err())
+	}
+}
+
+// notifyDraining queues the server_draining frame for the client.
+func (c *Client) notifyDraining(frame *ServerFrame) {
+	frame.Version = c.version
+	c.queue(frame)
+}
+
+// closeForDrain closes the client's connection with code 1012 (service restart).
+func (c *Client) closeForDrain() {
+	c.CloseWith(websocket.CloseServiceRestart, "server draining")
+}
+
+// notifyDraining queues the server_draining frame ahead of the stream's close.
+func (s *Stream) notifyDraining(frame *ServerFrame) {
+	select {
+	case s.frames <- frame:
+	default:
+	}
+}
+
+// closeForDrain closes the stream, ending its request.
+func (s *Stream) closeForDrain() {
+	s.Close()
+}
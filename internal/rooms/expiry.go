@@ -0,0 +1,34 @@
+package rooms
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+// MaxMessageTTLSeconds is the longest a disappearing message can last.
+const MaxMessageTTLSeconds = 365 * 24 * 60 * 60
+
+// ValidMessageTTL reports whether messages can be made to disappear after the given number of seconds.
+func ValidMessageTTL(seconds int) bool {
+	return seconds > 0 && seconds <= MaxMessageTTLSeconds
+}
+
+// PublishMessagesExpired tells a room on every node that disappearing messages were deleted, so that
+// clients remove them right away. threadRootIDs are the remaining thread roots that lost replies, whose
+// new summaries are published as well.
+func (m *Manager) PublishMessagesExpired(ctx context.Context, roomID uuid.UUID, messageIDs []int64, threadRootIDs []int64) error {
+	err := m.syncEngine.PublishRoomEvent(ctx, roomID, FrameMessagesExpired, map[string]interface{}{
+		"message_ids": messageIDs,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to publish %s event: %w", FrameMessagesExpired, err)
+	}
+	for _, rootID := range threadRootIDs {
+		if err := m.publishThreadUpdate(ctx, roomID, rootID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package rooms
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dukepan/multi-rooms-chat-back/internal/cache"
+	"github.com/gorilla/websocket"
+)
+
+// AnyFrameType is the key of the flood limit applied to frame types without a limit of their own.
+const AnyFrameType = "*"
+
+// FloodLimit is a token bucket limit: Burst frames at once, refilled at Rate frames per second.
+type FloodLimit struct {
+	Burst float64
+	Rate  float64
+}
+
+// FloodControlConfig configures the flood control applied to the frames clients send.
+// Limits are keyed by frame type, with AnyFrameType as the fallback; a frame type without a limit in
+// either map is not limited. Connection limits apply to each WebSocket connection, user limits to all
+// of a user's connections on every node.
+type FloodControlConfig struct {
+	Connection map[string]FloodLimit
+	User       map[string]FloodLimit
+
+	// MaxViolations is the number of rate-limited frames after which the client is disconnected
+	// with a policy violation. Violations are forgotten after ViolationWindow without any.
+	MaxViolations   int
+	ViolationWindow time.Duration
+}
+
+// DefaultFloodControlConfig returns the flood control used unless configured otherwise.
+func DefaultFloodControlConfig() FloodControlConfig {
+	return FloodControlConfig{
+		Connection: map[string]FloodLimit{
+			FrameMessage:     {Burst: 10, Rate: 2},
+			FrameTypingStart: {Burst: 5, Rate: 1},
+			FrameCallSignal:  {Burst: 50, Rate: 10}, // ICE candidates trickle in bursts
+			AnyFrameType:     {Burst: 30, Rate: 10},
+		},
+		User: map[string]FloodLimit{
+			FrameMessage:     {Burst: 20, Rate: 4},
+			FrameTypingStart: {Burst: 10, Rate: 2},
+			FrameCallSignal:  {Burst: 100, Rate: 20},
+			AnyFrameType:     {Burst: 60, Rate: 20},
+		},
+		MaxViolations:   5,
+		ViolationWindow: 30 * time.Second,
+	}
+}
+
+// ParseFloodLimits parses flood limits written as "<frame type>=<burst>:<rate per second>,...",
+// using "*" as the frame type of the fallback limit.
+func ParseFloodLimits(s string) (map[string]FloodLimit, error) {
+	limits := make(map[string]FloodLimit)
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		frameType, limit, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid flood limit %q", entry)
+		}
+		burstStr, rateStr, ok := strings.Cut(limit, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid flood limit %q: expected <burst>:<rate>", entry)
+		}
+		burst, err := strconv.ParseFloat(strings.TrimSpace(burstStr), 64)
+		if err != nil || burst < 1 {
+			return nil, fmt.Errorf("invalid burst in flood limit %q", entry)
+		}
+		rate, err := strconv.ParseFloat(strings.TrimSpace(rateStr), 64)
+		if err != nil || rate <= 0 {
+			return nil, fmt.Errorf("invalid rate in flood limit %q", entry)
+		}
+		limits[strings.TrimSpace(frameType)] = FloodLimit{Burst: burst, Rate: rate}
+	}
+	return limits, nil
+}
+
+// SetFloodControlConfig sets the flood control applied to the frames of the manager's clients.
+func (m *Manager) SetFloodControlConfig(cfg FloodControlConfig) {
+	m.floodMu.Lock()
+	m.flood = cfg
+	m.floodMu.Unlock()
+}
+
+// floodBuckets returns the token buckets a frame of the given type sent by client is charged to.
+func (m *Manager) floodBuckets(client *Client, frameType string) []cache.TokenBucket {
+	m.floodMu.RLock()
+	defer m.floodMu.RUnlock()
+
+	var buckets []cache.TokenBucket
+	if limit, key, ok := floodLimitFor(m.flood.Connection, frameType); ok {
+		buckets = append(buckets, cache.TokenBucket{
+			Key:      "ws_rate:conn:" + client.id.String() + ":" + key,
+			Capacity: limit.Burst,
+			Rate:     limit.Rate,
+		})
+	}
+	if limit, key, ok := floodLimitFor(m.flood.User, frameType); ok {
+		buckets = append(buckets, cache.TokenBucket{
+			Key:      "ws_rate:user:" + client.userID.String() + ":" + key,
+			Capacity: limit.Burst,
+			Rate:     limit.Rate,
+		})
+	}
+	return buckets
+}
+
+// floodLimitFor returns the limit of a frame type, falling back to AnyFrameType, and the key of its bucket.
+func floodLimitFor(limits map[string]FloodLimit, frameType string) (FloodLimit, string, bool) {
+	if limit, ok := limits[frameType]; ok {
+		return limit, frameType, true
+	}
+	limit, ok := limits[AnyFrameType]
+	return limit, "any", ok
+}
+
+// floodViolationLimits returns the number of violations tolerated and the window they are counted in.
+func (m *Manager) floodViolationLimits() (int, time.Duration) {
+	m.floodMu.RLock()
+	defer m.floodMu.RUnlock()
+	return m.flood.MaxViolations, m.flood.ViolationWindow
+}
+
+// checkFlood charges a frame to the client's token buckets. It returns a rate_limited error if the
+// frame exceeds a limit, and reports whether the client has now exceeded its violations and must be
+// disconnected. If Redis is unavailable frames are let through. It is only called from readPump.
+func (c *Client) checkFlood(ctx context.Context, frameType string) (disconnect bool, err error) {
+	buckets := c.manager.floodBuckets(c, frameType)
+	if len(buckets) == 0 {
+		return false, nil
+	}
+
+	empty, err := c.manager.cache.TakeTokens(ctx, buckets...)
+	if err != nil {
+		log.Printf("Error checking flood control for user %s: %v", c.userID, err)
+		return false, nil
+	}
+	if empty < 0 {
+		return false, nil
+	}
+
+	maxViolations, window := c.manager.floodViolationLimits()
+	now := time.Now()
+	if now.Sub(c.lastViolation) > window {
+		c.violations = 0
+	}
+	c.violations++
+	c.lastViolation = now
+
+	scope := "connection"
+	if strings.HasPrefix(buckets[empty].Key, "ws_rate:user:") {
+		scope = "user"
+	}
+	return maxViolations > 0 && c.violations > maxViolations,
+		newProtocolError(ErrCodeRateLimited, "too many %s frames for this %s", frameType, scope)
+}
+
+// closeForFlood disconnects a client that kept exceeding its flood limits.
+func (c *Client) closeForFlood() {
+	log.Printf("Disconnecting user %s after %d flood control violations", c.userID, c.violations)
+	c.CloseWith(websocket.ClosePolicyViolation, "rate limit exceeded")
+}
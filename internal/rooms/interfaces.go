@@ -4,12 +4,13 @@ import (
 	"context"
 
 	"github.com/google/uuid"
+	"github.com/dukepan/multi-rooms-chat-back/internal/auth"
 	"github.com/dukepan/multi-rooms-chat-back/internal/models"
 )
 
 // SyncEngineService defines the interface for synchronization operations.
 type SyncEngineService interface {
-	PublishMessage(ctx context.Context, message *models.Message) error
+	PublishMessage(ctx context.Context, message *models.Message) error // Publishes an edited or deleted message
 	PublishUserStatus(ctx context.Context, userID uuid.UUID, status string) error
 	PublishRoomEvent(ctx context.Context, roomID uuid.UUID, eventType string, data map[string]interface{}) error // Added for room events
 	Stop()
@@ -18,7 +19,21 @@ type SyncEngineService interface {
 
 // MessageWriterService defines the interface for message persistence.
 type MessageWriterService interface {
-	QueueMessage(message *models.Message)
+	QueueMessage(message *models.Message) error
+	// PersistMessage queues a message and blocks until it is stored, filling in its canonical ID and creation time.
+	PersistMessage(ctx context.Context, message *models.Message) error
 	Stop()
 	// Add other message writing methods as needed
 }
+
+// ReceiptRecorderService defines the interface for recording delivery and read receipts.
+type ReceiptRecorderService interface {
+	// RecordReceipt queues a receipt. The message's sender is sent the updated counts once it is stored.
+	RecordReceipt(receipt Receipt)
+	Stop()
+}
+
+// TokenValidator validates the JWTs clients authenticate with.
+type TokenValidator interface {
+	ValidateToken(token string) (*auth.Claims, error)
+}
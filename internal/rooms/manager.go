@@ -4,43 +4,99 @@ import (
 	"context"
 	"log"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/dukepan/multi-rooms-chat-back/internal/cache"
 	"github.com/dukepan/multi-rooms-chat-back/internal/db"
 	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
 )
 
+// subscriber receives the frames broadcast to the rooms it is added to. It is implemented by WebSocket
+// clients and by the streams behind the SSE and long-poll transports.
+type subscriber interface {
+	deliver(frame *ServerFrame, policy SlowConsumerPolicy, overflowSize int) bool
+	UserID() uuid.UUID
+	// evict disconnects the subscriber after its user lost access to the room.
+	evict(reason string)
+}
+
 // Room represents an active chat room
 type Room struct {
 	ID             uuid.UUID
-	clients        map[*Client]bool
-	broadcast      chan interface{}
-	register       chan *Client
-	unregister     chan *Client
+	clients        map[subscriber]bool
+	broadcast      chan *ServerFrame
+	register       chan subscriber
+	unregister     chan subscriber
 	typingTrackers map[uuid.UUID]time.Time
 	mu             sync.RWMutex
 	manager        *Manager // Add a reference to the Manager
+
+	// quit is closed when the room is unloaded; closed is set under mu at the same time
+	quit   chan struct{}
+	closed bool
+}
+
+// addClient adds a client to the room synchronously, so every event broadcast after it returns reaches
+// the client, and then notifies the room's event loop of the join. It returns false if the room has
+// already been unloaded, in which case the caller should load it again.
+func (r *Room) addClient(client subscriber) bool {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return false
+	}
+	r.clients[client] = true
+	r.mu.Unlock()
+
+	select {
+	case r.register <- client:
+	case <-r.quit:
+	}
+	return true
+}
+
+// removeClient removes a client from the room synchronously and notifies the room's event loop of the leave.
+func (r *Room) removeClient(client subscriber) {
+	r.mu.Lock()
+	_, exists := r.clients[client]
+	delete(r.clients, client)
+	r.mu.Unlock()
+
+	if !exists {
+		return
+	}
+	select {
+	case r.unregister <- client:
+	case <-r.quit:
+	}
+}
+
+// publish queues a frame for this node's clients in the room. Frames published after the room
+// has been unloaded are dropped.
+func (r *Room) publish(frame *ServerFrame) {
+	select {
+	case r.broadcast <- frame:
+	case <-r.quit:
+	}
 }
 
 // HandleTypingEvent updates the typing status for a user in the room.
 func (r *Room) HandleTypingEvent(userID uuid.UUID, isTyping bool) {
 	r.mu.Lock()
-	defer r.mu.Unlock()
-
 	if isTyping {
 		r.typingTrackers[userID] = time.Now()
 	} else {
 		delete(r.typingTrackers, userID)
 	}
+	r.mu.Unlock()
 
-	// Broadcast the typing event to all clients in the room
-	event := map[string]interface{}{
-		"type":      "typing_update",
-		"user_id":   userID.String(),
-		"is_typing": isTyping,
+	// Broadcast the typing event to all clients in the room, on every node
+	frame := NewRoomFrame(FrameTypingUpdate, r.ID, TypingPayload{UserID: userID, IsTyping: isTyping})
+	if err := r.manager.PublishFrame(context.Background(), frame); err != nil {
+		log.Printf("Error publishing typing event for room %s: %v", r.ID, err)
 	}
-	r.broadcast <- event
 }
 
 // Manager manages all active rooms
@@ -49,16 +105,42 @@ type Manager struct {
 	db             *db.Database
 	cache          *cache.Cache
 	syncEngine     SyncEngineService // Use interface
+	tokens         TokenValidator
+	receipts       ReceiptRecorderService
 	roomsMu        sync.RWMutex
 	registerRoom   chan uuid.UUID
 	unregisterRoom chan uuid.UUID
 	pubsubCancel   context.CancelFunc
 
+	// nodeID identifies this node on the cross-node bus
+	nodeID string
+	// pubsub receives the users channel plus the channel of every loaded room
+	pubsub *redis.PubSub
+	// channelsMu serializes subscribing and unsubscribing room channels, so that a room reloaded
+	// while it was being evicted keeps its channel
+	channelsMu sync.Mutex
+	stopOnce   sync.Once
+
+	// backpressure holds the slow-consumer policies of the rooms
+	backpressure   BackpressureConfig
+	backpressureMu sync.RWMutex
+
+	// flood holds the flood control applied to the frames clients send
+	flood   FloodControlConfig
+	floodMu sync.RWMutex
+
+	// conns holds the open connections of every transport, which are drained on shutdown
+	conns    map[connection]struct{}
+	connsMu  sync.Mutex
+	connsWG  sync.WaitGroup
+	draining atomic.Bool
+	drain    DrainConfig
+
+	// undoSendWindow is how long messages sent with undo_send are held before they are sent
+	undoSendWindow time.Duration
+
 	// Add a map to track last activity time for LRU eviction
 	lastActivity map[uuid.UUID]time.Time
-	// A channel to signal eviction for cold rooms
-	evictSignal chan struct{}
-	evictDone   chan struct{}
 }
 
 // SetSyncEngine sets the sync engine for the manager. This is used for circular dependencies.
@@ -69,7 +151,6 @@ func (m *Manager) SetSyncEngine(syncEngine SyncEngineService) {
 // NewManager creates a new room manager
 func NewManager(database *db.Database, redisCache *cache.Cache, syncEngine SyncEngineService) *Manager {
 	ctx, cancel := context.WithCancel(context.Background())
-	_ = ctx // Mark as used to satisfy linter
 	m := &Manager{
 		rooms:          make(map[uuid.UUID]*Room),
 		db:             database,
@@ -78,9 +159,13 @@ func NewManager(database *db.Database, redisCache *cache.Cache, syncEngine SyncE
 		registerRoom:   make(chan uuid.UUID, 100),
 		unregisterRoom: make(chan uuid.UUID, 100),
 		pubsubCancel:   cancel,
+		nodeID:         uuid.New().String(),
+		pubsub:         redisCache.Subscribe(ctx, UsersChannel),
 		lastActivity:   make(map[uuid.UUID]time.Time),
-		evictSignal:    make(chan struct{}),
-		evictDone:      make(chan struct{}),
+		backpressure:   BackpressureConfig{Policy: PolicyDrop, OverflowSize: DefaultOverflowSize},
+		flood:          DefaultFloodControlConfig(),
+		conns:          make(map[connection]struct{}),
+		drain:          DefaultDrainConfig(),
 	}
 	return m
 }
@@ -91,12 +176,15 @@ func (m *Manager) Start(ctx context.Context) {
 	ctx, cancel := context.WithCancel(ctx)
 	m.pubsubCancel = cancel // Use this to cancel pubsub as well
 
-	// Subscribe to Redis Pub/Sub for cross-node sync
+	// Receive events from other nodes over Redis Pub/Sub
 	go m.subscribeToPubSub(ctx)
 
 	// Start room eviction job
 	go m.evictColdRooms(ctx, 1*time.Minute, 10*time.Minute)
 
+	// Start presence sweeper, which turns the users of nodes that died offline
+	go m.sweepPresence(ctx, presenceTTL)
+
 	for {
 		select {
 		case <-ctx.Done():
@@ -110,70 +198,77 @@ func (m *Manager) Start(ctx context.Context) {
 	}
 }
 
-// Stop gracefully shuts down the manager
+// Stop gracefully shuts down the manager, unloading every room. It is safe to call Stop more than once.
 func (m *Manager) Stop() {
-	m.roomsMu.Lock()
-	defer m.roomsMu.Unlock()
-
-	for _, room := range m.rooms {
-		close(room.broadcast)
-	}
+	m.stopOnce.Do(func() {
+		m.roomsMu.Lock()
+		for roomID, room := range m.rooms {
+			room.close()
+			delete(m.rooms, roomID)
+			delete(m.lastActivity, roomID)
+		}
+		m.roomsMu.Unlock()
 
-	if m.pubsubCancel != nil {
-		m.pubsubCancel() // Cancel context for pubsub and eviction
-	}
+		if m.pubsubCancel != nil {
+			m.pubsubCancel() // Cancel context for pubsub and eviction
+		}
+		if err := m.pubsub.Close(); err != nil {
+			log.Printf("Error closing Pub/Sub subscription: %v", err)
+		}
+	})
 }
 
 // broadcastUserEvent broadcasts join/leave events
 func (m *Manager) BroadcastUserEvent(roomID uuid.UUID, userID uuid.UUID, eventType string) {
-	m.roomsMu.RLock()
-	room, exists := m.rooms[roomID]
-	m.roomsMu.RUnlock()
-
-	if exists && room != nil {
-		event := map[string]interface{}{
-			"type":    eventType,
-			"user_id": userID.String(),
-			"room_id": roomID.String(),
-		}
-		room.broadcast <- event
+	frame := NewRoomFrame(eventType, roomID, UserEventPayload{UserID: userID, Timestamp: time.Now()})
+	if err := m.PublishFrame(context.Background(), frame); err != nil {
+		log.Printf("Error publishing %s event for room %s: %v", eventType, roomID, err)
 	}
 }
 
-// BroadcastMessage broadcasts a message to all clients in a specific room.
-func (m *Manager) BroadcastMessage(roomID uuid.UUID, message interface{}) {
+// BroadcastEvent broadcasts an event with the given type and payload to this node's clients in a specific room.
+func (m *Manager) BroadcastEvent(roomID uuid.UUID, eventType string, payload interface{}) {
+	m.BroadcastFrame(NewRoomFrame(eventType, roomID, payload))
+}
+
+// BroadcastFrame broadcasts an already built frame to this node's clients in the frame's room.
+// Use PublishFrame to reach the clients on every node.
+func (m *Manager) BroadcastFrame(frame *ServerFrame) {
 	m.roomsMu.RLock()
-	room, exists := m.rooms[roomID]
+	room, exists := m.rooms[frame.RoomID]
 	m.roomsMu.RUnlock()
 
 	if exists && room != nil {
-		room.broadcast <- message
+		room.publish(frame)
 	}
 }
 
-// GetOrCreateRoom gets an existing room or creates a new one
+// GetOrCreateRoom gets an existing room or loads a new one, subscribing to its cross-node channel
 func (m *Manager) GetOrCreateRoom(roomID uuid.UUID) *Room {
 	m.roomsMu.Lock()
-	defer m.roomsMu.Unlock()
-
 	if room, exists := m.rooms[roomID]; exists {
 		// Update activity on access
 		m.lastActivity[roomID] = time.Now()
+		m.roomsMu.Unlock()
 		return room
 	}
 
 	room := &Room{
 		ID:             roomID,
-		clients:        make(map[*Client]bool),
-		broadcast:      make(chan interface{}, 256),
-		register:       make(chan *Client, 16),
-		unregister:     make(chan *Client, 16),
+		clients:        make(map[subscriber]bool),
+		broadcast:      make(chan *ServerFrame, 256),
+		register:       make(chan subscriber, 16),
+		unregister:     make(chan subscriber, 16),
 		typingTrackers: make(map[uuid.UUID]time.Time),
 		manager:        m,
+		quit:           make(chan struct{}),
 	}
 
 	m.rooms[roomID] = room
 	m.lastActivity[roomID] = time.Now() // Set initial activity
+	m.roomsMu.Unlock()
+
+	m.syncRoomChannel(context.Background(), roomID)
 	go m.handleRoom(room)
 	return room
 }
@@ -183,17 +278,50 @@ func (m *Manager) createRoom(roomID uuid.UUID) {
 	m.GetOrCreateRoom(roomID)
 }
 
-// removeRoom removes a room and closes all client connections
+// removeRoom unloads a room if no client is subscribed to it anymore
 func (m *Manager) removeRoom(roomID uuid.UUID) {
 	m.roomsMu.Lock()
+	evicted := m.evictRoomLocked(roomID)
+	m.roomsMu.Unlock()
+
+	if evicted {
+		m.syncRoomChannel(context.Background(), roomID)
+	}
+}
+
+// evictRoomLocked unloads a room if it has no clients and reports whether it did. roomsMu must be held.
+func (m *Manager) evictRoomLocked(roomID uuid.UUID) bool {
 	room, exists := m.rooms[roomID]
-	if exists {
-		delete(m.rooms, roomID)
+	if !exists || !room.closeIfEmpty() {
+		return false
 	}
-	m.roomsMu.Unlock()
+	delete(m.rooms, roomID)
+	delete(m.lastActivity, roomID)
+	return true
+}
 
-	if exists && room != nil {
-		close(room.broadcast)
+// closeIfEmpty closes the room if no client is subscribed to it and reports whether it did.
+func (r *Room) closeIfEmpty() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.clients) > 0 {
+		return false
+	}
+	r.closeLocked()
+	return true
+}
+
+// close stops the room's event loop. Clients still subscribed to it stop receiving its events.
+func (r *Room) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closeLocked()
+}
+
+func (r *Room) closeLocked() {
+	if !r.closed {
+		r.closed = true
+		close(r.quit)
 	}
 }
 
@@ -204,32 +332,20 @@ func (m *Manager) handleRoom(room *Room) {
 
 	for {
 		select {
-		case client := <-room.register:
-			room.mu.Lock()
-			room.clients[client] = true
-			room.mu.Unlock()
+		case <-room.quit:
+			return
+
+		case <-room.register:
+			// The client was already added by addClient, and its join is published by the
+			// presence roster once it is the user's first connection in the room on any node
 			// Update room activity on client register
 			m.roomsMu.Lock()
 			m.lastActivity[room.ID] = time.Now()
 			m.roomsMu.Unlock()
-			// Notify others that user joined
-			m.BroadcastUserEvent(room.ID, client.userID, "join")
-
-		case client := <-room.unregister:
-			room.mu.Lock()
-			if _, exists := room.clients[client]; exists {
-				delete(room.clients, client)
-				close(client.send)
-				m.BroadcastUserEvent(room.ID, client.userID, "leave")
-			}
-			room.mu.Unlock()
-
-			// If room is empty, schedule for cleanup (now managed by LRU eviction)
-			// No need for explicit 10-minute sleep here, LRU will handle it.
-			// m.roomsMu.Lock()
-			// delete(m.lastActivity, room.ID) // Remove from activity tracking if no clients
-			// m.roomsMu.Unlock()
 
+		case <-room.unregister:
+			// The client was already removed by removeClient. It owns its send channel and may
+			// still be subscribed to other rooms, so the channel is never closed here.
 			room.mu.RLock()
 			isEmpty := len(room.clients) == 0
 			room.mu.RUnlock()
@@ -246,13 +362,11 @@ func (m *Manager) handleRoom(room *Room) {
 			m.roomsMu.Lock()
 			m.lastActivity[room.ID] = time.Now()
 			m.roomsMu.Unlock()
+			policy, overflowSize := m.slowConsumerPolicy(room.ID)
 			room.mu.RLock()
 			for client := range room.clients {
-				select {
-				case client.send <- message:
-				default:
-					// Client's send channel is full, skip
-				}
+				// Clients whose send channel is full are handled according to the room's policy
+				client.deliver(message, policy, overflowSize)
 			}
 			room.mu.RUnlock()
 
@@ -270,42 +384,8 @@ func (m *Manager) handleRoom(room *Room) {
 	}
 }
 
-// subscribeToPubSub subscribes to Redis Pub/Sub for cross-node sync
-func (m *Manager) subscribeToPubSub(ctx context.Context) {
-	// Mark ctx as used to satisfy linter
-	_ = ctx
-
-	ctx, cancel := context.WithCancel(ctx)
-	m.pubsubCancel = cancel
-
-	pubsub := m.cache.Subscribe(ctx, "messages", "rooms", "users")
-	defer pubsub.Close()
-
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case msg := <-pubsub.Channel():
-			if msg == nil {
-				return
-			}
-			// Handle sync messages from other nodes
-			m.handleSyncMessage(msg.Channel, msg.Payload)
-		}
-	}
-}
-
-// handleSyncMessage handles sync messages from Redis
-func (m *Manager) handleSyncMessage(channel, payload string) {
-	// Implementation for cross-node sync
-	// Parse channel and payload and broadcast to relevant rooms
-}
-
 // evictColdRooms periodically removes inactive rooms from memory
 func (m *Manager) evictColdRooms(ctx context.Context, evictionInterval, inactivityThreshold time.Duration) {
-	// Mark ctx as used to satisfy linter
-	_ = ctx
-
 	ticker := time.NewTicker(evictionInterval)
 	defer ticker.Stop()
 
@@ -314,19 +394,21 @@ func (m *Manager) evictColdRooms(ctx context.Context, evictionInterval, inactivi
 		case <-ctx.Done():
 			return
 		case <-ticker.C:
+			var evicted []uuid.UUID
 			m.roomsMu.Lock()
 			now := time.Now()
 			for roomID, lastActive := range m.lastActivity {
-				if now.Sub(lastActive) > inactivityThreshold {
-					// Check if room is actually empty before evicting
-					if room, exists := m.rooms[roomID]; exists && len(room.clients) == 0 {
-						log.Printf("Evicting cold room: %s", roomID)
-						delete(m.rooms, roomID)
-						delete(m.lastActivity, roomID)
-					}
+				// Only rooms that are actually empty are evicted
+				if now.Sub(lastActive) > inactivityThreshold && m.evictRoomLocked(roomID) {
+					log.Printf("Evicting cold room: %s", roomID)
+					evicted = append(evicted, roomID)
 				}
 			}
 			m.roomsMu.Unlock()
+
+			for _, roomID := range evicted {
+				m.syncRoomChannel(ctx, roomID)
+			}
 		}
 	}
 }
@@ -0,0 +1,93 @@
+package rooms
+
+import (
+	"context"
+	"log"
+
+	"github.com/google/uuid"
+)
+
+// Kinds of membership changes.
+const (
+	MembershipAdded   = "added"
+	MembershipRemoved = "removed"
+	MembershipBanned  = "banned"
+)
+
+// MembershipChange describes a user being added to, removed from or banned from a room.
+type MembershipChange struct {
+	RoomID uuid.UUID `json:"room_id"`
+	UserID uuid.UUID `json:"user_id"`
+	Change string    `json:"change"`
+	Role   string    `json:"role,omitempty"`
+	// By is the user who made the change.
+	By uuid.UUID `json:"by,omitzero"`
+}
+
+// PublishMembershipChange applies a membership change, already stored in the database, to the
+// connections of this node and of every other node. Connections of a user who was removed or banned
+// are evicted from the room; those of a user who was added are sent a room_joined frame.
+func (m *Manager) PublishMembershipChange(ctx context.Context, change MembershipChange) error {
+	m.handleMembershipChange(change)
+	return m.publishBusEvent(ctx, UsersChannel, BusKindMembership, change)
+}
+
+// handleMembershipChange applies a membership change to this node's connections.
+func (m *Manager) handleMembershipChange(change MembershipChange) {
+	switch change.Change {
+	case MembershipAdded:
+		m.connsMu.Lock()
+		var clients []*Client
+		for conn := range m.conns {
+			if client, ok := conn.(*Client); ok && client.userID == change.UserID {
+				clients = append(clients, client)
+			}
+		}
+		m.connsMu.Unlock()
+
+		for _, client := range clients {
+			client.queue(&ServerFrame{
+				Version: client.version,
+				Type:    FrameRoomJoined,
+				RoomID:  change.RoomID,
+				Payload: RoomJoinedPayload{Role: change.Role, AddedBy: change.By},
+			})
+		}
+
+	case MembershipRemoved, MembershipBanned:
+		m.roomsMu.RLock()
+		room, loaded := m.rooms[change.RoomID]
+		m.roomsMu.RUnlock()
+		if !loaded {
+			return
+		}
+
+		room.mu.Lock()
+		var evicted []subscriber
+		for sub := range room.clients {
+			if sub.UserID() == change.UserID {
+				evicted = append(evicted, sub)
+			}
+		}
+		room.mu.Unlock()
+
+		reason := change.Change + " from room " + change.RoomID.String()
+		for _, sub := range evicted {
+			log.Printf("Evicting user %s from room %s: %s", change.UserID, change.RoomID, change.Change)
+			sub.evict(reason)
+		}
+
+	default:
+		log.Printf("Unknown membership change %q for room %s", change.Change, change.RoomID)
+	}
+}
+
+// evict closes the client's connection with CloseMembershipRevoked, which also removes it from all of its rooms.
+func (c *Client) evict(reason string) {
+	c.CloseWith(CloseMembershipRevoked, reason)
+}
+
+// evict closes the stream, ending its request.
+func (s *Stream) evict(reason string) {
+	s.Close()
+}
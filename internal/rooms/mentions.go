@@ -0,0 +1,112 @@
+package rooms
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+
+	"github.com/dukepan/multi-rooms-chat-back/internal/models"
+	"github.com/google/uuid"
+)
+
+// maxMentionedNames is the maximum number of distinct usernames resolved in a single message.
+const maxMentionedNames = 50
+
+// mentionPattern matches an @ that does not follow a word character, such as in an email address,
+// and the name after it.
+var mentionPattern = regexp.MustCompile(`(?:^|[^\p{L}\p{N}_.@])@([\p{L}\p{N}_.\-]+)`)
+
+// parseMentions returns the lowercased usernames mentioned in a message's content, and whether it
+// mentions @here or @room. Punctuation ending a sentence after a mention is not part of the name.
+func parseMentions(content string) (names []string, here, room bool) {
+	seen := make(map[string]struct{})
+	for _, match := range mentionPattern.FindAllStringSubmatch(content, -1) {
+		name := strings.ToLower(strings.TrimRight(match[1], ".-"))
+		switch name {
+		case "":
+			continue
+		case models.MentionKindHere:
+			here = true
+			continue
+		case models.MentionKindRoom:
+			room = true
+			continue
+		}
+		if _, ok := seen[name]; ok || len(names) >= maxMentionedNames {
+			continue
+		}
+		seen[name] = struct{}{}
+		names = append(names, name)
+	}
+	return names, here, room
+}
+
+// RecordMentions resolves the mentions in a stored message against the members of its room and
+// stores them. @here mentions the members who are online, @room every member, and the sender is never
+// mentioned. Each user mentioned in the message for the first time is sent a mention frame on every
+// node, whether or not they are subscribed to the room.
+func (m *Manager) RecordMentions(ctx context.Context, msg *models.Message) error {
+	if msg.MessageType == models.MessageTypeSystem {
+		return nil
+	}
+	names, here, room := parseMentions(msg.Content)
+	if len(names) == 0 && !here && !room {
+		return nil
+	}
+
+	kinds := make(map[uuid.UUID]string)
+	if here || room {
+		kind := models.MentionKindHere
+		if room {
+			kind = models.MentionKindRoom
+		}
+		memberIDs, err := m.db.GetRoomMemberIDs(ctx, msg.RoomID, !room)
+		if err != nil {
+			return fmt.Errorf("failed to fetch members mentioned by @%s: %w", kind, err)
+		}
+		for _, memberID := range memberIDs {
+			kinds[memberID] = kind
+		}
+	}
+	if len(names) > 0 {
+		memberIDs, err := m.db.GetRoomMemberIDsByUsername(ctx, msg.RoomID, names)
+		if err != nil {
+			return fmt.Errorf("failed to resolve mentioned usernames: %w", err)
+		}
+		// A mention by name takes precedence over @here and @room
+		for _, memberID := range memberIDs {
+			kinds[memberID] = models.MentionKindUser
+		}
+	}
+	delete(kinds, msg.UserID)
+	if len(kinds) == 0 {
+		return nil
+	}
+
+	mentions := make([]models.Mention, 0, len(kinds))
+	for userID, kind := range kinds {
+		mentions = append(mentions, models.Mention{
+			MessageID:   msg.ID,
+			RoomID:      msg.RoomID,
+			UserID:      userID,
+			MentionedBy: msg.UserID,
+			Kind:        kind,
+		})
+	}
+	created, err := m.db.CreateMentions(ctx, mentions)
+	if err != nil {
+		return fmt.Errorf("failed to store mentions: %w", err)
+	}
+
+	// The mentions are stored, so failures to notify the users mentioned are only logged
+	for _, mention := range created {
+		mention.Content = msg.Content
+		frame := NewRoomFrame(FrameMention, msg.RoomID, mention)
+		if err := m.SendToUser(ctx, mention.UserID, frame); err != nil {
+			log.Printf("Error notifying user %s of mention in message %d: %v", mention.UserID, msg.ID, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+package rooms
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/dukepan/multi-rooms-chat-back/internal/models"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// Errors returned by the message actions shared by the HTTP and WebSocket APIs.
+var (
+	ErrMessageNotFound = errors.New("message not found")
+	ErrNotRoomMember   = errors.New("not a member of this room")
+	ErrForbidden       = errors.New("not allowed to modify this message")
+	ErrRevisionsHidden = errors.New("only the author, admins and moderators can view a message's revisions")
+)
+
+// maxEmojiLength is the maximum length in bytes of a reaction emoji.
+const maxEmojiLength = 32
+
+// EditMessage replaces the content of a message on behalf of its author, keeping the previous content
+// in its revisions, and publishes the stored result, with its new revision number, to the room on every
+// node.
+func (m *Manager) EditMessage(ctx context.Context, userID, roomID uuid.UUID, messageID int64, content string) (*models.Message, error) {
+	message, err := m.authorizeMessageAction(ctx, userID, roomID, messageID)
+	if err != nil {
+		return nil, err
+	}
+	// The question of a poll cannot change under its votes
+	if message.UserID != userID || message.MessageType == models.MessageTypeSystem || message.MessageType == models.MessageTypePoll {
+		return nil, ErrForbidden
+	}
+
+	if _, err := m.db.EditMessage(ctx, messageID, userID, content); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			// Deleted meanwhile
+			return nil, ErrMessageNotFound
+		}
+		return nil, fmt.Errorf("failed to edit message: %w", err)
+	}
+
+	// Fetch the updated message to broadcast
+	updated, err := m.db.GetMessageByID(ctx, messageID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch edited message: %w", err)
+	}
+	if err := m.syncEngine.PublishMessage(ctx, updated); err != nil {
+		return nil, fmt.Errorf("failed to publish edited message: %w", err)
+	}
+	// Only users the edit mentions for the first time are notified
+	if err := m.RecordMentions(ctx, updated); err != nil {
+		log.Printf("Error recording mentions in edited message %d: %v", messageID, err)
+	}
+	return updated, nil
+}
+
+// DeleteMessage soft deletes a message on behalf of its author, and publishes the deletion to the
+// room on every node.
+func (m *Manager) DeleteMessage(ctx context.Context, userID, roomID uuid.UUID, messageID int64) (*models.Message, error) {
+	message, err := m.authorizeMessageAction(ctx, userID, roomID, messageID)
+	if err != nil {
+		return nil, err
+	}
+	if message.UserID != userID || message.MessageType == models.MessageTypeSystem {
+		return nil, ErrForbidden
+	}
+
+	if err := m.db.SoftDeleteMessage(ctx, messageID, userID); err != nil {
+		return nil, fmt.Errorf("failed to delete message: %w", err)
+	}
+
+	// Deleted messages are only broadcast with their identity, never their content
+	deletedAt := time.Now()
+	deleted := &models.Message{ID: messageID, RoomID: message.RoomID, UserID: message.UserID, DeletedAt: &deletedAt}
+	if err := m.syncEngine.PublishMessage(ctx, deleted); err != nil {
+		return nil, fmt.Errorf("failed to publish deleted message: %w", err)
+	}
+	if message.ParentID != nil {
+		if err := m.publishThreadUpdate(ctx, message.RoomID, *message.ParentID); err != nil {
+			log.Printf("Error updating thread of deleted reply %d: %v", messageID, err)
+		}
+	}
+	return deleted, nil
+}
+
+// AddReaction adds a user's reaction to a message and publishes it to the room on every node.
+func (m *Manager) AddReaction(ctx context.Context, userID, roomID uuid.UUID, messageID int64, emoji string) error {
+	if _, err := m.authorizeMessageAction(ctx, userID, roomID, messageID); err != nil {
+		return err
+	}
+	if err := m.db.AddMessageReaction(ctx, messageID, userID, emoji); err != nil {
+		return fmt.Errorf("failed to add reaction: %w", err)
+	}
+	return m.publishReaction(ctx, FrameReactionAdded, userID, roomID, messageID, emoji)
+}
+
+// RemoveReaction removes a user's reaction from a message and publishes the removal to the room on every node.
+func (m *Manager) RemoveReaction(ctx context.Context, userID, roomID uuid.UUID, messageID int64, emoji string) error {
+	if _, err := m.authorizeMessageAction(ctx, userID, roomID, messageID); err != nil {
+		return err
+	}
+	if err := m.db.RemoveMessageReaction(ctx, messageID, userID, emoji); err != nil {
+		return fmt.Errorf("failed to remove reaction: %w", err)
+	}
+	return m.publishReaction(ctx, FrameReactionRemoved, userID, roomID, messageID, emoji)
+}
+
+func (m *Manager) publishReaction(ctx context.Context, eventType string, userID, roomID uuid.UUID, messageID int64, emoji string) error {
+	err := m.syncEngine.PublishRoomEvent(ctx, roomID, eventType, map[string]interface{}{
+		"message_id": messageID,
+		"user_id":    userID,
+		"emoji":      emoji,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to publish %s event: %w", eventType, err)
+	}
+	return nil
+}
+
+// GetMessageRevisions returns every version of a message's content, oldest first, to its author or an
+// admin or moderator of its room.
+func (m *Manager) GetMessageRevisions(ctx context.Context, userID, roomID uuid.UUID, messageID int64) ([]models.MessageRevision, error) {
+	message, err := m.authorizeMessageAction(ctx, userID, roomID, messageID)
+	if err != nil {
+		return nil, err
+	}
+	if message.UserID != userID {
+		moderator, err := m.isModerator(ctx, roomID, userID)
+		if err != nil {
+			return nil, err
+		}
+		if !moderator {
+			return nil, ErrRevisionsHidden
+		}
+	}
+
+	revisions, err := m.db.GetMessageRevisions(ctx, messageID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch message revisions: %w", err)
+	}
+	// A message that was never edited is still at the content it was sent with
+	if len(revisions) == 0 {
+		revisions = []models.MessageRevision{{MessageID: message.ID, Content: message.Content, CreatedAt: message.CreatedAt}}
+	}
+	return revisions, nil
+}
+
+// isModerator reports whether a member of a room is one of its admins or moderators.
+func (m *Manager) isModerator(ctx context.Context, roomID, userID uuid.UUID) (bool, error) {
+	role, err := m.db.GetRoomMemberRole(ctx, roomID, userID)
+	if err != nil {
+		return false, fmt.Errorf("failed to fetch member role: %w", err)
+	}
+	return role == "admin" || role == "moderator", nil
+}
+
+// authorizeMessageAction checks that userID is a member of roomID and that the message exists and
+// belongs to that room, and returns the message.
+func (m *Manager) authorizeMessageAction(ctx context.Context, userID, roomID uuid.UUID, messageID int64) (*models.Message, error) {
+	isMember, err := m.db.IsRoomMember(ctx, roomID, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check room membership: %w", err)
+	}
+	if !isMember {
+		return nil, ErrNotRoomMember
+	}
+
+	message, err := m.db.GetMessageByID(ctx, messageID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrMessageNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch message: %w", err)
+	}
+	if message.RoomID != roomID {
+		return nil, ErrMessageNotFound
+	}
+	return message, nil
+}
+
+// actionError converts an error returned by a message action into the error reported to the client.
+func actionError(err error) error {
+	switch {
+	case errors.Is(err, ErrMessageNotFound):
+		return newProtocolError(ErrCodeNotFound, "%v", err)
+	case errors.Is(err, ErrNotRoomMember):
+		return newProtocolError(ErrCodeNotMember, "%v", err)
+	case errors.Is(err, ErrForbidden):
+		return newProtocolError(ErrCodeForbidden, "%v", err)
+	case errors.Is(err, ErrScheduledMessageNotFound):
+		return newProtocolError(ErrCodeNotFound, "%v", err)
+	case errors.Is(err, ErrInvalidSendAt):
+		return newProtocolError(ErrCodeBadRequest, "%v", err)
+	case errors.Is(err, ErrPollNotFound):
+		return newProtocolError(ErrCodeNotFound, "%v", err)
+	case errors.Is(err, ErrPollClosed):
+		return newProtocolError(ErrCodeConflict, "%v", err)
+	case errors.Is(err, ErrInvalidPollVote):
+		return newProtocolError(ErrCodeBadRequest, "%v", err)
+	default:
+		return err
+	}
+}
@@ -0,0 +1,222 @@
+package rooms
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/dukepan/multi-rooms-chat-back/internal/models"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// Limits of the polls sent in message frames.
+const (
+	minPollOptions      = 2
+	maxPollOptions      = 10
+	maxPollOptionLength = 200
+)
+
+// Errors returned by the poll actions.
+var (
+	ErrPollNotFound    = errors.New("poll not found")
+	ErrPollClosed      = errors.New("poll is closed")
+	ErrInvalidPollVote = errors.New("vote for one option of a single choice poll, or one or more distinct options of a multiple choice poll")
+	// ErrPollNotPublished is returned when a poll was closed but its final results could not be
+	// published; PublishPollClosed publishes them again.
+	ErrPollNotPublished = errors.New("poll closed but its results were not published")
+)
+
+// validatePoll checks the poll of a message frame, which poll messages and only they carry.
+func validatePoll(payload ChatMessagePayload) error {
+	if (payload.MessageType == models.MessageTypePoll) != (payload.Poll != nil) {
+		return newProtocolError(ErrCodeBadRequest, "messages of type poll, and only they, carry a poll")
+	}
+	if payload.Poll == nil {
+		return nil
+	}
+	if strings.TrimSpace(payload.Content) == "" {
+		return newProtocolError(ErrCodeBadRequest, "a poll's content is its question, which is required")
+	}
+	if payload.SendAt != nil || payload.UndoSend {
+		return newProtocolError(ErrCodeBadRequest, "polls cannot be scheduled")
+	}
+	if n := len(payload.Poll.Options); n < minPollOptions || n > maxPollOptions {
+		return newProtocolError(ErrCodeBadRequest, "a poll has between %d and %d options", minPollOptions, maxPollOptions)
+	}
+	for _, option := range payload.Poll.Options {
+		if strings.TrimSpace(option) == "" || len(option) > maxPollOptionLength {
+			return newProtocolError(ErrCodeBadRequest, "poll options must be non-empty and at most %d characters", maxPollOptionLength)
+		}
+	}
+	if closesAt := payload.Poll.ClosesAt; closesAt != nil {
+		if now := time.Now(); !closesAt.After(now) || closesAt.After(now.Add(maxScheduleAhead)) {
+			return newProtocolError(ErrCodeBadRequest, "closes_at must be in the future and at most a year ahead")
+		}
+	}
+	return nil
+}
+
+// newPoll creates the poll stored with a poll message, its options numbered from 1.
+func newPoll(payload *PollPayload) *models.Poll {
+	poll := &models.Poll{
+		MultipleChoice: payload.MultipleChoice,
+		Anonymous:      payload.Anonymous,
+		ClosesAt:       payload.ClosesAt,
+		Options:        make([]models.PollOption, len(payload.Options)),
+	}
+	for i, text := range payload.Options {
+		poll.Options[i] = models.PollOption{ID: i + 1, Text: text}
+	}
+	return poll
+}
+
+// GetPoll returns the poll of a message with its tally and the options userID voted for.
+func (m *Manager) GetPoll(ctx context.Context, userID, roomID uuid.UUID, messageID int64) (*models.Poll, error) {
+	if _, err := m.authorizePoll(ctx, userID, roomID, messageID); err != nil {
+		return nil, err
+	}
+	return m.fetchPoll(ctx, messageID, userID)
+}
+
+// VotePoll replaces a user's votes in a poll with votes for optionIDs and publishes the new tally to the
+// room on every node. It returns the poll as seen by the user.
+func (m *Manager) VotePoll(ctx context.Context, userID, roomID uuid.UUID, messageID int64, optionIDs []int) (*models.Poll, error) {
+	if _, err := m.authorizePoll(ctx, userID, roomID, messageID); err != nil {
+		return nil, err
+	}
+	poll, err := m.fetchPoll(ctx, messageID, uuid.Nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(optionIDs) == 0 || (!poll.MultipleChoice && len(optionIDs) > 1) {
+		return nil, ErrInvalidPollVote
+	}
+	chosen := make(map[int]bool, len(optionIDs))
+	for _, optionID := range optionIDs {
+		if optionID < 1 || optionID > len(poll.Options) || chosen[optionID] {
+			return nil, ErrInvalidPollVote
+		}
+		chosen[optionID] = true
+	}
+	return m.setPollVotes(ctx, userID, roomID, messageID, optionIDs)
+}
+
+// RetractPollVote retracts a user's votes in a poll and publishes the new tally to the room on every
+// node. It returns the poll as seen by the user.
+func (m *Manager) RetractPollVote(ctx context.Context, userID, roomID uuid.UUID, messageID int64) (*models.Poll, error) {
+	if _, err := m.authorizePoll(ctx, userID, roomID, messageID); err != nil {
+		return nil, err
+	}
+	return m.setPollVotes(ctx, userID, roomID, messageID, nil)
+}
+
+func (m *Manager) setPollVotes(ctx context.Context, userID, roomID uuid.UUID, messageID int64, optionIDs []int) (*models.Poll, error) {
+	open, err := m.db.SetPollVotes(ctx, messageID, userID, optionIDs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store poll votes: %w", err)
+	}
+	if !open {
+		return nil, ErrPollClosed
+	}
+	// The votes are stored, so a failure to publish the tally is only logged
+	if err := m.publishPoll(ctx, roomID, messageID, FramePollUpdated); err != nil {
+		log.Printf("Error publishing tally of poll %d: %v", messageID, err)
+	}
+	return m.fetchPoll(ctx, messageID, userID)
+}
+
+// ClosePoll closes a poll on behalf of its author or an admin or moderator of its room, freezing its
+// tally, and publishes the final results to the room on every node.
+func (m *Manager) ClosePoll(ctx context.Context, userID, roomID uuid.UUID, messageID int64) (*models.Poll, error) {
+	message, err := m.authorizePoll(ctx, userID, roomID, messageID)
+	if err != nil {
+		return nil, err
+	}
+	if message.UserID != userID {
+		moderator, err := m.isModerator(ctx, roomID, userID)
+		if err != nil {
+			return nil, err
+		}
+		if !moderator {
+			return nil, ErrForbidden
+		}
+	}
+	err = m.FinalizePoll(ctx, roomID, messageID)
+	if errors.Is(err, ErrPollNotPublished) {
+		// The poll is closed, so a failure to publish the results is only logged
+		log.Printf("Error closing poll %d: %v", messageID, err)
+	} else if err != nil {
+		return nil, err
+	}
+	return m.fetchPoll(ctx, messageID, userID)
+}
+
+// FinalizePoll closes a poll, freezing its tally, and publishes the final results to the room on every
+// node. It returns ErrPollClosed if the poll was already closed, such as by another node once its close
+// time passed, and ErrPollNotPublished if it closed the poll but failed to publish the results.
+func (m *Manager) FinalizePoll(ctx context.Context, roomID uuid.UUID, messageID int64) error {
+	closed, err := m.db.ClosePoll(ctx, messageID)
+	if err != nil {
+		return fmt.Errorf("failed to close poll: %w", err)
+	}
+	if !closed {
+		return ErrPollClosed
+	}
+	if err := m.PublishPollClosed(ctx, roomID, messageID); err != nil {
+		return fmt.Errorf("%w: %v", ErrPollNotPublished, err)
+	}
+	return nil
+}
+
+// PublishPollClosed publishes the final results of a closed poll to its room on every node.
+func (m *Manager) PublishPollClosed(ctx context.Context, roomID uuid.UUID, messageID int64) error {
+	return m.publishPoll(ctx, roomID, messageID, FramePollClosed)
+}
+
+// authorizePoll checks that userID is a member of roomID and that the message is a poll of that room,
+// and returns the message.
+func (m *Manager) authorizePoll(ctx context.Context, userID, roomID uuid.UUID, messageID int64) (*models.Message, error) {
+	message, err := m.authorizeMessageAction(ctx, userID, roomID, messageID)
+	if errors.Is(err, ErrMessageNotFound) {
+		return nil, ErrPollNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if message.MessageType != models.MessageTypePoll {
+		return nil, ErrPollNotFound
+	}
+	return message, nil
+}
+
+// fetchPoll returns the poll of a message as seen by userID.
+func (m *Manager) fetchPoll(ctx context.Context, messageID int64, userID uuid.UUID) (*models.Poll, error) {
+	poll, err := m.db.GetPoll(ctx, messageID, userID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrPollNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch poll: %w", err)
+	}
+	return poll, nil
+}
+
+// publishPoll publishes the tally of a poll to its room on every node.
+func (m *Manager) publishPoll(ctx context.Context, roomID uuid.UUID, messageID int64, eventType string) error {
+	poll, err := m.fetchPoll(ctx, messageID, uuid.Nil)
+	if err != nil {
+		return err
+	}
+	err = m.syncEngine.PublishRoomEvent(ctx, roomID, eventType, map[string]interface{}{
+		"message_id": messageID,
+		"poll":       poll,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to publish %s event: %w", eventType, err)
+	}
+	return nil
+}
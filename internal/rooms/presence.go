@@ -0,0 +1,188 @@
+package rooms
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/dukepan/multi-rooms-chat-back/internal/cache"
+	"github.com/google/uuid"
+)
+
+const (
+	// presenceHeartbeatPeriod is how often a client refreshes its presence.
+	presenceHeartbeatPeriod = 30 * time.Second
+
+	// presenceTTL is how long a connection counts as present without a heartbeat, so that the
+	// connections of a node that died expire. Must be greater than presenceHeartbeatPeriod.
+	presenceTTL = 3 * presenceHeartbeatPeriod
+
+	// awayAfter is how long all of a user's connections must be inactive for the user to be away.
+	awayAfter = 5 * time.Minute
+)
+
+// RoomPresence returns the users currently connected to a room on any node. Connections whose node
+// stopped refreshing them are pruned first, publishing a leave for users left with no connection.
+func (m *Manager) RoomPresence(ctx context.Context, roomID uuid.UUID) ([]uuid.UUID, error) {
+	departed, err := m.cache.PruneRoomPresence(ctx, roomID, time.Now().Add(-presenceTTL))
+	if err != nil {
+		log.Printf("Error pruning presence of room %s: %v", roomID, err)
+	}
+	for _, userID := range departed {
+		m.BroadcastUserEvent(roomID, userID, FrameLeave)
+	}
+	return m.cache.GetRoomPresence(ctx, roomID)
+}
+
+// sweepPresence periodically finds users stored as online or away whose connections all expired, which
+// happens when their node dies without disconnecting them, and stores and publishes that they are offline.
+// Every node sweeps; the status is stored as offline once, by the node that publishes it.
+func (m *Manager) sweepPresence(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			userIDs, err := m.db.GetPresentUserIDs(ctx)
+			if err != nil {
+				log.Printf("Error fetching present users: %v", err)
+				continue
+			}
+			for _, userID := range userIDs {
+				status, err := m.cache.RecomputeUserPresence(ctx, userID, awayAfter, presenceTTL)
+				if err != nil {
+					log.Printf("Error recomputing presence of user %s: %v", userID, err)
+					continue
+				}
+				if status != cache.StatusOffline {
+					continue
+				}
+				changed, err := m.db.MarkUserOffline(ctx, userID)
+				if err != nil {
+					log.Printf("Error storing status of user %s: %v", userID, err)
+					continue
+				}
+				if !changed {
+					continue
+				}
+				if err := m.syncEngine.PublishUserStatus(ctx, userID, status); err != nil {
+					log.Printf("Error publishing status of user %s: %v", userID, err)
+				}
+			}
+		}
+	}
+}
+
+// joinPresence adds a client that has just been added to a room to the room's roster, sends the client
+// a snapshot of the roster and, if this is the user's first connection in the room, publishes a join.
+// The snapshot is read after the client was added, so the deltas it receives afterwards converge on it.
+func (c *Client) joinPresence(ctx context.Context, room *Room) {
+	first, err := c.manager.cache.AddRoomPresence(ctx, room.ID, c.userID, c.id)
+	if err != nil {
+		log.Printf("Error adding user %s to presence of room %s: %v", c.userID, room.ID, err)
+	}
+
+	users, err := c.manager.RoomPresence(ctx, room.ID)
+	if err != nil {
+		log.Printf("Error fetching presence of room %s: %v", room.ID, err)
+	} else {
+		c.queue(NewRoomFrame(FramePresence, room.ID, PresencePayload{UserIDs: users}))
+	}
+
+	if first {
+		c.manager.BroadcastUserEvent(room.ID, c.userID, FrameJoin)
+	}
+}
+
+// leaveRoom removes the client from a room and from the room's roster, publishing a leave if this was
+// the user's last connection in the room.
+func (c *Client) leaveRoom(ctx context.Context, room *Room) {
+	room.removeClient(c)
+
+	last, err := c.manager.cache.RemoveRoomPresence(ctx, room.ID, c.userID, c.id)
+	if err != nil {
+		log.Printf("Error removing user %s from presence of room %s: %v", c.userID, room.ID, err)
+		return
+	}
+	if last {
+		c.manager.BroadcastUserEvent(room.ID, c.userID, FrameLeave)
+	}
+}
+
+// markActive records user activity on the connection. A user who was idle on it is updated right away,
+// so that they come back from away without waiting for the next heartbeat.
+func (c *Client) markActive() {
+	now := time.Now()
+	previous := c.lastActive.Swap(now.UnixNano())
+	if now.Sub(time.Unix(0, previous)) >= awayAfter {
+		go c.updatePresence(context.Background(), false)
+	}
+}
+
+// presenceLoop keeps the client's presence alive until the client is stopped. Each heartbeat also
+// lets the user's aggregate presence turn away once all of their connections are idle.
+func (c *Client) presenceLoop() {
+	ticker := time.NewTicker(presenceHeartbeatPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			ctx := context.Background()
+			c.updatePresence(ctx, false)
+
+			c.roomsMu.RLock()
+			subscribed := make([]uuid.UUID, 0, len(c.rooms))
+			for roomID := range c.rooms {
+				subscribed = append(subscribed, roomID)
+			}
+			c.roomsMu.RUnlock()
+			for _, roomID := range subscribed {
+				if err := c.manager.cache.RefreshRoomPresence(ctx, roomID, c.userID, c.id); err != nil {
+					log.Printf("Error refreshing presence of user %s in room %s: %v", c.userID, roomID, err)
+				}
+			}
+		}
+	}
+}
+
+// updatePresence records the state of this connection in the user's presence and, if the user's
+// aggregate presence across all of their devices changed, stores and publishes the new status.
+func (c *Client) updatePresence(ctx context.Context, disconnected bool) {
+	// Updates are serialized so that a late heartbeat cannot bring back a connection that has been removed
+	c.presenceMu.Lock()
+	defer c.presenceMu.Unlock()
+	if c.presenceRemoved {
+		return
+	}
+	c.presenceRemoved = disconnected
+
+	change, err := c.manager.cache.UpdateUserPresence(ctx, cache.PresenceUpdate{
+		UserID:       c.userID,
+		DeviceID:     c.deviceID,
+		ConnID:       c.id,
+		Disconnected: disconnected,
+		LastActive:   time.Unix(0, c.lastActive.Load()),
+		AwayAfter:    awayAfter,
+		TTL:          presenceTTL,
+	})
+	if err != nil {
+		log.Printf("Error updating presence of user %s: %v", c.userID, err)
+		return
+	}
+	if !change.Changed() {
+		return
+	}
+
+	if err := c.manager.db.UpdateUserStatus(ctx, c.userID, change.Current); err != nil {
+		log.Printf("Error storing status of user %s: %v", c.userID, err)
+	}
+	if err := c.manager.syncEngine.PublishUserStatus(ctx, c.userID, change.Current); err != nil {
+		log.Printf("Error publishing status of user %s: %v", c.userID, err)
+	}
+}
@@ -0,0 +1,410 @@
+package rooms
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ProtocolVersion is the current version of the WebSocket protocol spoken by the server.
+const ProtocolVersion = 1
+
+// ProtocolV1 is the Sec-WebSocket-Protocol value clients offer to speak version 1 of the protocol.
+const ProtocolV1 = "gochat.v1"
+
+// SupportedProtocols lists the subprotocols the server accepts, most preferred first.
+var SupportedProtocols = []string{ProtocolV1}
+
+// ProtocolVersionFor returns the protocol version for a negotiated subprotocol.
+// An empty subprotocol (the client did not offer one) falls back to the current version.
+func ProtocolVersionFor(subprotocol string) (int, bool) {
+	switch subprotocol {
+	case "", ProtocolV1:
+		return ProtocolVersion, true
+	default:
+		return 0, false
+	}
+}
+
+// Frame types sent by clients.
+const (
+	FrameSubscribe       = "subscribe"
+	FrameUnsubscribe     = "unsubscribe"
+	FrameMessage         = "message"
+	FrameTypingStart     = "typing_start"
+	FrameTypingStop      = "typing_stop"
+	FrameRead            = "read"
+	FrameMessageEdited   = "message_edited"
+	FrameMessageDeleted  = "message_deleted"
+	FrameReactionAdded   = "reaction_added"
+	FrameReactionRemoved = "reaction_removed"
+	FrameCallStart       = "call_start"
+	FrameCallJoin        = "call_join"
+	FrameCallLeave       = "call_leave"
+	FrameCallEnd         = "call_end"
+	// FrameCallSignal carries a WebRTC offer, answer or ICE candidate for one participant of a call.
+	// The server relays it to that participant only, as a call_signal frame naming the sender.
+	FrameCallSignal = "call_signal"
+	// FrameCancelSend cancels a message scheduled or held for the undo send window before it is sent.
+	FrameCancelSend = "cancel_send"
+	// FrameReauth carries a fresh token for the connection. It is the only frame without a room_id.
+	FrameReauth = "reauth"
+)
+
+// Frame types sent by the server. Room events reuse the client frame types where they match.
+const (
+	FrameAck          = "ack"
+	FrameError        = "error"
+	FrameTypingUpdate = "typing_update"
+	FrameJoin         = "join"
+	FrameLeave        = "leave"
+	FrameStatusChange = "status_change"
+
+	// FramePresence carries a snapshot of a room's roster, sent to a client when it subscribes.
+	// join and leave frames then carry the changes to it.
+	FramePresence = "presence"
+
+	// FrameReplayComplete marks the end of the missed events replayed after a subscribe.
+	FrameReplayComplete = "replay_complete"
+	// FrameGap tells the client it missed events of a room because it could not keep up.
+	FrameGap = "gap"
+	// FrameServerDraining tells the client the node is shutting down and will close the connection.
+	FrameServerDraining = "server_draining"
+	// FrameRoomJoined tells the client its user was added to a room, which it can now subscribe to.
+	FrameRoomJoined = "room_joined"
+	// FrameTokenExpiring tells the client its token expires soon and must be replaced with a reauth frame.
+	FrameTokenExpiring = "token_expiring"
+
+	// Call events broadcast to a room. call_signal frames are only sent to the participant they are for.
+	FrameCallStarted = "call_started"
+	FrameCallJoined  = "call_joined"
+	FrameCallLeft    = "call_left"
+	FrameCallEnded   = "call_ended"
+
+	// FrameReceiptUpdate tells the sender of a message how many of its recipients it was delivered to
+	// and read by. It is sent to the sender's connections only.
+	FrameReceiptUpdate = "receipt_update"
+	// FrameReadCursor tells all of a user's connections that their read cursor in a room moved.
+	FrameReadCursor = "read_cursor"
+	// FrameMention tells a user they were mentioned in a message. It is sent to all of their
+	// connections, whether or not they are subscribed to the room.
+	FrameMention = "mention"
+	// FrameThreadUpdated tells a room that a thread's reply count or latest reply changed.
+	FrameThreadUpdated = "thread_updated"
+	// FrameThreadReply carries a new reply to the followers of its thread, whether or not they are
+	// subscribed to the room.
+	FrameThreadReply = "thread_reply"
+
+	// Pin events broadcast to a room when a moderator pins or unpins one of its messages.
+	FrameMessagePinned   = "message_pinned"
+	FrameMessageUnpinned = "message_unpinned"
+
+	// FrameMessagesExpired tells a room that disappearing messages expired and were deleted for good,
+	// along with the replies in their threads.
+	FrameMessagesExpired = "messages_expired"
+	// FrameMessageTTLUpdated tells a room that a moderator changed how long its new messages last.
+	FrameMessageTTLUpdated = "message_ttl_updated"
+
+	// FramePollUpdated carries the new tally of a poll to its room after a vote or retraction.
+	FramePollUpdated = "poll_updated"
+	// FramePollClosed carries the final results of a poll to its room once it closes.
+	FramePollClosed = "poll_closed"
+)
+
+// Close codes the server uses when it closes a connection, in the range reserved for applications.
+const (
+	// CloseSlowConsumer closes a client that could not keep up with a room using PolicyDisconnect.
+	// The client should reconnect and resubscribe with the last event ID it saw.
+	CloseSlowConsumer = 4000
+	// CloseTokenExpired closes a connection whose token expired without being replaced by a reauth frame.
+	CloseTokenExpired = 4001
+	// CloseTokenRevoked closes a connection whose token was revoked, such as on logout.
+	CloseTokenRevoked = 4002
+	// CloseMembershipRevoked closes the connections of a user removed or banned from a room they were
+	// subscribed to. The reason names the room; the client may reconnect and resubscribe to its other rooms.
+	CloseMembershipRevoked = 4003
+)
+
+// Error codes carried in the payload of error frames.
+const (
+	ErrCodeBadRequest         = "bad_request"
+	ErrCodeUnknownType        = "unknown_type"
+	ErrCodeUnsupportedVersion = "unsupported_version"
+	ErrCodeNotMember          = "not_member"
+	ErrCodeNotSubscribed      = "not_subscribed"
+	ErrCodeNotFound           = "not_found"
+	ErrCodeForbidden          = "forbidden"
+	ErrCodeUnauthorized       = "unauthorized"
+	ErrCodeConflict           = "conflict"
+	ErrCodeRateLimited        = "rate_limited"
+	ErrCodeUnavailable        = "unavailable"
+	ErrCodeInternal           = "internal_error"
+)
+
+// ClientFrame is the envelope of every command sent by a client.
+type ClientFrame struct {
+	Version int             `json:"v"`
+	ID      string          `json:"id"`
+	Type    string          `json:"type"`
+	RoomID  uuid.UUID       `json:"room_id,omitzero"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// ServerFrame is the envelope of every event and reply sent by the server.
+// ID is only set on ack and error frames and echoes the ID of the client frame being answered.
+// EventID is set on replayable room events (messages, edits, deletes and reactions) and increases
+// monotonically per room; clients pass the last one they saw to resume after a reconnect.
+type ServerFrame struct {
+	Version int         `json:"v"`
+	ID      string      `json:"id,omitempty"`
+	Type    string      `json:"type"`
+	RoomID  uuid.UUID   `json:"room_id,omitzero"`
+	EventID int64       `json:"event_id,omitempty"`
+	Payload interface{} `json:"payload,omitempty"`
+}
+
+// DecodeServerFrame decodes an encoded server frame, keeping its payload as raw JSON so it can be
+// forwarded to clients unchanged.
+func DecodeServerFrame(data []byte) (*ServerFrame, error) {
+	var raw struct {
+		ServerFrame
+		Payload json.RawMessage `json:"payload,omitempty"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	frame := raw.ServerFrame
+	if len(raw.Payload) > 0 {
+		frame.Payload = raw.Payload
+	}
+	return &frame, nil
+}
+
+// NewRoomFrame creates a server frame carrying an event for a room.
+func NewRoomFrame(eventType string, roomID uuid.UUID, payload interface{}) *ServerFrame {
+	return &ServerFrame{
+		Version: ProtocolVersion,
+		Type:    eventType,
+		RoomID:  roomID,
+		Payload: payload,
+	}
+}
+
+// SubscribePayload is the optional payload of a subscribe frame. A non-zero LastEventID asks the server
+// to replay the room events the client missed before switching to live delivery.
+type SubscribePayload struct {
+	LastEventID int64 `json:"last_event_id,omitempty"`
+}
+
+// SubscribeAckPayload is the payload of the ack for a subscribe frame. ActiveCallID is the room's
+// active call, which the client can join, if any.
+type SubscribeAckPayload struct {
+	LastEventID  int64  `json:"last_event_id"`
+	ActiveCallID string `json:"active_call_id,omitempty"`
+}
+
+// ReplayCompletePayload is the payload of a replay_complete frame. Truncated is set when the gap was
+// larger than the event log: only the latest messages were replayed, and edits, deletes and reactions
+// in the gap were not, so the client should refetch history over REST.
+type ReplayCompletePayload struct {
+	LastEventID int64 `json:"last_event_id"`
+	Replayed    int   `json:"replayed"`
+	Truncated   bool  `json:"truncated"`
+}
+
+// GapPayload is the payload of a gap frame. FromEventID and ToEventID bound the dropped events that
+// had an event ID (zero if none did); Dropped also counts transient events such as typing updates.
+// Clients should refetch history or resubscribe with the last event ID they saw before the gap.
+type GapPayload struct {
+	FromEventID int64 `json:"from_event_id,omitempty"`
+	ToEventID   int64 `json:"to_event_id,omitempty"`
+	Dropped     int   `json:"dropped"`
+}
+
+// DrainingPayload is the payload of a server_draining frame. The server closes the connection with
+// code 1012 shortly after; the client should wait ReconnectAfterMs before reconnecting and resuming
+// its rooms with the last event IDs it saw.
+type DrainingPayload struct {
+	ReconnectAfterMs int64 `json:"reconnect_after_ms"`
+}
+
+// ChatMessagePayload is the payload of a client message frame.
+// ClientMsgID is optional; resends carrying the same ID are stored only once.
+type ChatMessagePayload struct {
+	Content     string `json:"content"`
+	MessageType string `json:"message_type,omitempty"` // text, image, file
+	FileURL     string `json:"file_url,omitempty"`
+	ClientMsgID string `json:"client_msg_id,omitempty"`
+	// ParentID posts the message as a reply in the thread of another message
+	ParentID *int64 `json:"parent_id,omitempty"`
+	// SendAt schedules the message to be sent later. UndoSend holds it for the server's undo send
+	// window instead, during which it can be canceled. Either way the ack carries the scheduled message.
+	SendAt   *time.Time `json:"send_at,omitempty"`
+	UndoSend bool       `json:"undo_send,omitempty"`
+	// TTLSeconds makes the message disappear after that many seconds, or sooner if the room's
+	// disappearing messages last less
+	TTLSeconds *int `json:"ttl_seconds,omitempty"`
+	// Poll is the poll of a message of type poll, whose content is the question
+	Poll *PollPayload `json:"poll,omitempty"`
+}
+
+// PollPayload describes the poll sent in a message frame.
+type PollPayload struct {
+	Options        []string   `json:"options"`
+	MultipleChoice bool       `json:"multiple_choice,omitempty"`
+	Anonymous      bool       `json:"anonymous,omitempty"`
+	ClosesAt       *time.Time `json:"closes_at,omitempty"`
+}
+
+// CancelSendPayload is the payload of a cancel_send frame.
+type CancelSendPayload struct {
+	ScheduledID int64 `json:"scheduled_id"`
+}
+
+// ReadPayload is the payload of a client read frame. It marks every message of the room up to
+// MessageID as read.
+type ReadPayload struct {
+	MessageID int64 `json:"message_id"`
+}
+
+// ReadCursorPayload is the payload of a read_cursor frame and of the ack of a read frame.
+type ReadCursorPayload struct {
+	LastReadMessageID int64 `json:"last_read_message_id"`
+}
+
+// EditMessagePayload is the payload of a client message_edited frame.
+type EditMessagePayload struct {
+	MessageID int64  `json:"message_id"`
+	Content   string `json:"content"`
+}
+
+// DeleteMessagePayload is the payload of a client message_deleted frame.
+type DeleteMessagePayload struct {
+	MessageID int64 `json:"message_id"`
+}
+
+// ReactionPayload is the payload of client reaction_added and reaction_removed frames.
+type ReactionPayload struct {
+	MessageID int64  `json:"message_id"`
+	Emoji     string `json:"emoji"`
+}
+
+// AckPayload is the payload of an ack frame.
+type AckPayload struct {
+	Status string `json:"status"`
+}
+
+// MessageAckPayload is the payload of the ack for a message frame. It carries the canonical server
+// identity of the stored message so clients can reconcile optimistic entries by client_msg_id.
+type MessageAckPayload struct {
+	ID          int64     `json:"id"`
+	ClientMsgID string    `json:"client_msg_id,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// TypingPayload is the payload of a typing_update frame.
+type TypingPayload struct {
+	UserID   uuid.UUID `json:"user_id"`
+	IsTyping bool      `json:"is_typing"`
+}
+
+// PresencePayload is the payload of a presence frame.
+type PresencePayload struct {
+	UserIDs []uuid.UUID `json:"user_ids"`
+}
+
+// UserEventPayload is the payload of join and leave frames.
+type UserEventPayload struct {
+	UserID    uuid.UUID `json:"user_id"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// UserStatusPayload is the payload of a status_change frame.
+type UserStatusPayload struct {
+	UserID    uuid.UUID `json:"user_id"`
+	Status    string    `json:"status"` // online, offline, away
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// ReauthPayload is the payload of a reauth frame.
+type ReauthPayload struct {
+	Token string `json:"token"`
+}
+
+// TokenExpiryPayload is the payload of a token_expiring frame and of the ack of a reauth frame.
+type TokenExpiryPayload struct {
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// RoomJoinedPayload is the payload of a room_joined frame.
+type RoomJoinedPayload struct {
+	Role    string    `json:"role"`
+	AddedBy uuid.UUID `json:"added_by,omitzero"`
+}
+
+// CallStartPayload is the optional payload of a call_start frame. Kind defaults to audio.
+type CallStartPayload struct {
+	Kind string `json:"kind,omitempty"` // audio, video
+}
+
+// CallPayload is the payload of call_join frames.
+type CallPayload struct {
+	CallID string `json:"call_id"`
+}
+
+// CallStatePayload is the payload of the ack for call_start and call_join frames.
+type CallStatePayload struct {
+	CallID         string      `json:"call_id"`
+	Kind           string      `json:"kind"`
+	StartedBy      uuid.UUID   `json:"started_by"`
+	StartedAt      time.Time   `json:"started_at"`
+	ParticipantIDs []uuid.UUID `json:"participant_ids"`
+}
+
+// CallSignalPayload is the payload of call_signal frames. Clients address it with ToUserID; the server
+// replaces it with FromUserID when relaying it. Data is the SDP or ICE candidate, passed through unchanged.
+type CallSignalPayload struct {
+	CallID     string          `json:"call_id"`
+	ToUserID   uuid.UUID       `json:"to_user_id,omitzero"`
+	FromUserID uuid.UUID       `json:"from_user_id,omitzero"`
+	SignalType string          `json:"signal_type"` // offer, answer, ice_candidate
+	Data       json.RawMessage `json:"data"`
+}
+
+// ErrorPayload is the payload of an error frame.
+type ErrorPayload struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// ProtocolError is a command failure reported back to the client with a machine-readable code.
+type ProtocolError struct {
+	Code    string
+	Message string
+}
+
+func (e *ProtocolError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// newProtocolError creates a ProtocolError with a formatted message.
+func newProtocolError(code, format string, args ...interface{}) *ProtocolError {
+	return &ProtocolError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// errReplyPending is returned by command handlers that reply to the client asynchronously.
+var errReplyPending = errors.New("reply pending")
+
+// decodePayload unmarshals a frame payload, reporting malformed payloads as bad requests.
+func decodePayload(frame *ClientFrame, v interface{}) error {
+	if len(frame.Payload) == 0 {
+		return newProtocolError(ErrCodeBadRequest, "missing payload for %s", frame.Type)
+	}
+	if err := json.Unmarshal(frame.Payload, v); err != nil {
+		return newProtocolError(ErrCodeBadRequest, "invalid payload for %s: %v", frame.Type, err)
+	}
+	return nil
+}
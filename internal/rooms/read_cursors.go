@@ -0,0 +1,57 @@
+package rooms
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// MarkRead moves a user's read cursor in a room forward to messageID, marking every message up to it
+// as read. The new cursor is sent to all of the user's connections so their other devices catch up,
+// and the senders of the messages read get their receipt counts. Messages that disappear after being
+// read start expiring. A cursor already past messageID is left unchanged. It returns the user's cursor.
+func (m *Manager) MarkRead(ctx context.Context, userID, roomID uuid.UUID, messageID int64) (int64, error) {
+	message, err := m.db.GetMessageByID(ctx, messageID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, ErrMessageNotFound
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to fetch message: %w", err)
+	}
+	if message.RoomID != roomID {
+		return 0, ErrMessageNotFound
+	}
+
+	previous, err := m.db.AdvanceReadCursor(ctx, roomID, userID, messageID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		// Already read, or not a member
+		cursor, err := m.db.GetReadCursor(ctx, roomID, userID)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, ErrNotRoomMember
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to fetch read cursor: %w", err)
+		}
+		return cursor, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to advance read cursor: %w", err)
+	}
+
+	// The cursor is stored, so failures to start expiry or to tell other devices or senders are only logged
+	if err := m.db.StartExpiryOnRead(ctx, roomID, userID, previous, messageID); err != nil {
+		log.Printf("Error starting expiry of messages read by user %s in room %s: %v", userID, roomID, err)
+	}
+	frame := NewRoomFrame(FrameReadCursor, roomID, ReadCursorPayload{LastReadMessageID: messageID})
+	if err := m.SendToUser(ctx, userID, frame); err != nil {
+		log.Printf("Error syncing read cursor of user %s in room %s: %v", userID, roomID, err)
+	}
+	if m.receipts != nil {
+		m.receipts.RecordReceipt(Receipt{MessageID: messageID, RoomID: roomID, UserID: userID, Read: true, ReadAfter: previous})
+	}
+	return messageID, nil
+}
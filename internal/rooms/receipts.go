@@ -0,0 +1,130 @@
+package rooms
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/dukepan/multi-rooms-chat-back/internal/models"
+	"github.com/google/uuid"
+)
+
+// Receipt records that a message reached one of its recipients, or that they read up to it.
+type Receipt struct {
+	MessageID int64
+	RoomID    uuid.UUID
+	UserID    uuid.UUID
+	// Read is set when the recipient moved their read cursor from ReadAfter to MessageID, which
+	// marks every message in between as read and delivered.
+	Read      bool
+	ReadAfter int64
+}
+
+// UserFrame is a frame addressed to every connection of a user, on any node.
+type UserFrame struct {
+	UserID uuid.UUID       `json:"user_id"`
+	Frame  json.RawMessage `json:"frame"`
+}
+
+// SetReceiptRecorder sets the recorder of delivery and read receipts. This is used for circular dependencies.
+func (m *Manager) SetReceiptRecorder(receipts ReceiptRecorderService) {
+	m.receipts = receipts
+}
+
+// RecordDelivery records that a frame was written to a connection of userID. Only message frames sent by
+// other users count as deliveries; everything else is ignored.
+func (m *Manager) RecordDelivery(userID uuid.UUID, frame *ServerFrame) {
+	if m.receipts == nil || frame.Type != FrameMessage {
+		return
+	}
+	messageID, senderID, ok := deliveredMessage(frame)
+	if !ok || senderID == userID {
+		return
+	}
+	m.receipts.RecordReceipt(Receipt{MessageID: messageID, RoomID: frame.RoomID, UserID: userID})
+}
+
+// RecordHistoryDelivery records that messages fetched through history reached userID.
+func (m *Manager) RecordHistoryDelivery(userID uuid.UUID, messages []models.Message) {
+	if m.receipts == nil {
+		return
+	}
+	for _, msg := range messages {
+		if msg.UserID == userID || msg.MessageType == models.MessageTypeSystem {
+			continue
+		}
+		m.receipts.RecordReceipt(Receipt{MessageID: msg.ID, RoomID: msg.RoomID, UserID: userID})
+	}
+}
+
+// deliveredMessage returns the ID and sender of the message carried by a message frame. The payload is
+// the stored message for frames published on this node, and raw JSON for frames from other nodes or
+// replayed from the event log.
+func deliveredMessage(frame *ServerFrame) (int64, uuid.UUID, bool) {
+	switch payload := frame.Payload.(type) {
+	case *models.Message:
+		return payload.ID, payload.UserID, payload.MessageType != models.MessageTypeSystem
+	case json.RawMessage:
+		var msg struct {
+			ID          int64     `json:"id"`
+			UserID      uuid.UUID `json:"user_id"`
+			MessageType string    `json:"message_type"`
+		}
+		if err := json.Unmarshal(payload, &msg); err != nil {
+			return 0, uuid.Nil, false
+		}
+		return msg.ID, msg.UserID, msg.ID != 0 && msg.MessageType != models.MessageTypeSystem
+	default:
+		return 0, uuid.Nil, false
+	}
+}
+
+// SendToUser delivers a frame to every connection of a user on this node and every other node. Event
+// streams only get the frames of their own room.
+func (m *Manager) SendToUser(ctx context.Context, userID uuid.UUID, frame *ServerFrame) error {
+	m.deliverToUser(userID, frame)
+	encoded, err := json.Marshal(frame)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s frame: %w", frame.Type, err)
+	}
+	return m.publishBusEvent(ctx, UsersChannel, BusKindUserFrame, UserFrame{UserID: userID, Frame: encoded})
+}
+
+// deliverToUser queues a frame for the connections of a user on this node.
+func (m *Manager) deliverToUser(userID uuid.UUID, frame *ServerFrame) {
+	m.connsMu.Lock()
+	var targets []connection
+	for conn := range m.conns {
+		switch conn := conn.(type) {
+		case *Client:
+			if conn.userID == userID {
+				targets = append(targets, conn)
+			}
+		case *Stream:
+			if conn.userID == userID && conn.roomID == frame.RoomID {
+				targets = append(targets, conn)
+			}
+		}
+	}
+	m.connsMu.Unlock()
+
+	for _, target := range targets {
+		switch target := target.(type) {
+		case *Client:
+			target.queue(frame)
+		case *Stream:
+			target.deliver(frame, PolicyDrop, 0)
+		}
+	}
+}
+
+// handleUserFrame delivers a frame another node addressed to a user to their connections on this node.
+func (m *Manager) handleUserFrame(userFrame UserFrame) {
+	frame, err := DecodeServerFrame(userFrame.Frame)
+	if err != nil {
+		log.Printf("Error unmarshaling frame for user %s: %v", userFrame.UserID, err)
+		return
+	}
+	m.deliverToUser(userFrame.UserID, frame)
+}
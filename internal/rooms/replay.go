@@ -0,0 +1,156 @@
+package rooms
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// replayFallbackLimit is the number of latest messages replayed from the database when the
+	// client's gap is larger than the room's event log.
+	replayFallbackLimit = 50
+
+	// maxReplayBuffer is the number of live frames held back per room while a replay is in progress.
+	maxReplayBuffer = 256
+)
+
+// replayBuffer holds the live frames of a room that arrive while its missed events are being replayed.
+type replayBuffer struct {
+	frames   []*ServerFrame
+	overflow bool
+}
+
+// deliver hands a room frame to the client. While the frame's room is replaying, live frames are held
+// back so that they reach the client after the replayed ones; otherwise the room's slow-consumer policy
+// applies when the client's send buffer is full. It returns false if the frame was dropped.
+func (c *Client) deliver(frame *ServerFrame, policy SlowConsumerPolicy, overflowSize int) bool {
+	c.deliverMu.Lock()
+	defer c.deliverMu.Unlock()
+
+	if buffer, replaying := c.replaying[frame.RoomID]; replaying {
+		if len(buffer.frames) >= maxReplayBuffer {
+			buffer.overflow = true
+			return false
+		}
+		buffer.frames = append(buffer.frames, frame)
+		return true
+	}
+
+	return c.sendLive(frame, policy, overflowSize)
+}
+
+// beginReplay starts holding back live frames of a room. It must be called before the client is added
+// to the room so that no frame slips between the replayed events and live delivery.
+func (c *Client) beginReplay(roomID uuid.UUID) {
+	c.deliverMu.Lock()
+	c.replaying[roomID] = &replayBuffer{}
+	c.deliverMu.Unlock()
+}
+
+// replayMissedEvents sends the client the events of a room after lastEventID, followed by any live
+// frames held back meanwhile, and then switches the room to live delivery. It returns the ID of the
+// last event the client has now seen.
+func (c *Client) replayMissedEvents(ctx context.Context, room *Room, lastEventID int64) (int64, error) {
+	frames, upTo, truncated, err := c.manager.missedEvents(ctx, room.ID, lastEventID)
+	if err != nil {
+		c.endReplay(room.ID, 0)
+		return 0, err
+	}
+
+	for _, frame := range frames {
+		if !c.sendBlocking(frame) {
+			c.endReplay(room.ID, upTo)
+			return upTo, nil
+		}
+	}
+
+	if c.endReplay(room.ID, upTo) {
+		// Live frames were lost while replaying, so the client has a gap it must refetch
+		truncated = true
+	}
+
+	c.sendBlocking(NewRoomFrame(FrameReplayComplete, room.ID, ReplayCompletePayload{
+		LastEventID: upTo,
+		Replayed:    len(frames),
+		Truncated:   truncated,
+	}))
+	return upTo, nil
+}
+
+// missedEvents loads the events of a room after lastEventID from the room's event log in Redis.
+// If the gap is larger than the log it falls back to the latest messages in the database.
+func (m *Manager) missedEvents(ctx context.Context, roomID uuid.UUID, lastEventID int64) (frames []*ServerFrame, upTo int64, truncated bool, err error) {
+	events, complete, err := m.cache.GetRoomEventsSince(ctx, roomID, lastEventID)
+	if err != nil {
+		return nil, 0, false, fmt.Errorf("failed to read room event log: %w", err)
+	}
+
+	if complete {
+		upTo = lastEventID
+		for _, data := range events {
+			frame, err := DecodeServerFrame([]byte(data))
+			if err != nil {
+				log.Printf("Skipping malformed event in log of room %s: %v", roomID, err)
+				continue
+			}
+			frames = append(frames, frame)
+			upTo = frame.EventID
+		}
+		return frames, upTo, false, nil
+	}
+
+	// Messages are stored before their event ID is allocated, so every message up to upTo is in the database
+	upTo, err = m.cache.LastRoomEventID(ctx, roomID)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	messages, err := m.db.GetRoomMessages(ctx, roomID, replayFallbackLimit, 0, false)
+	if err != nil {
+		return nil, 0, false, fmt.Errorf("failed to fetch room messages: %w", err)
+	}
+	// GetRoomMessages returns the newest message first
+	for i := len(messages) - 1; i >= 0; i-- {
+		frames = append(frames, NewRoomFrame(FrameMessage, roomID, messages[i]))
+	}
+	return frames, upTo, true, nil
+}
+
+// endReplay flushes the live frames held back for a room, skipping those already covered by the
+// replay, and switches the room to live delivery. It reports whether any live frame was lost.
+func (c *Client) endReplay(roomID uuid.UUID, upTo int64) bool {
+	c.deliverMu.Lock()
+	defer c.deliverMu.Unlock()
+
+	buffer, replaying := c.replaying[roomID]
+	if !replaying {
+		return false
+	}
+	delete(c.replaying, roomID)
+
+	lost := buffer.overflow
+	for _, frame := range buffer.frames {
+		if frame.EventID != 0 && frame.EventID <= upTo {
+			continue
+		}
+		select {
+		case c.send <- frame:
+		default:
+			lost = true
+		}
+	}
+	return lost
+}
+
+// sendBlocking queues a frame for the client, waiting for room in its send buffer.
+// It returns false if the client was stopped first.
+func (c *Client) sendBlocking(frame *ServerFrame) bool {
+	select {
+	case c.send <- frame:
+		return true
+	case <-c.done:
+		return false
+	}
+}
@@ -0,0 +1,104 @@
+package rooms
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dukepan/multi-rooms-chat-back/internal/models"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// maxScheduleAhead is how far in the future a message can be scheduled.
+const maxScheduleAhead = 365 * 24 * time.Hour
+
+// Errors returned by the scheduled message actions.
+var (
+	ErrScheduledMessageNotFound = errors.New("scheduled message not found or already sent")
+	ErrInvalidSendAt            = errors.New("send_at must be in the future and at most a year ahead")
+	ErrUndoSendFixed            = errors.New("the send time of a message held for undo send cannot be changed")
+)
+
+// SetUndoSendWindow sets how long ordinary messages sent with undo_send are held before they are sent.
+// A zero window sends them right away.
+func (m *Manager) SetUndoSendWindow(window time.Duration) {
+	m.undoSendWindow = window
+}
+
+// validateSendAt checks that a message can be scheduled to be sent at sendAt.
+func validateSendAt(sendAt time.Time) error {
+	now := time.Now()
+	if !sendAt.After(now) || sendAt.After(now.Add(maxScheduleAhead)) {
+		return ErrInvalidSendAt
+	}
+	return nil
+}
+
+// ScheduleMessage stores a message to be sent at sendAt instead of sending it now. With undoSend, the
+// message is an ordinary message held for the undo send window, which sendAt must end. The message is
+// sent with its client_msg_id, which is generated if missing, so that it is stored only once.
+func (m *Manager) ScheduleMessage(ctx context.Context, msg *models.Message, sendAt time.Time, undoSend bool) (*models.ScheduledMessage, error) {
+	if err := validateSendAt(sendAt); err != nil {
+		return nil, err
+	}
+	clientMsgID := msg.ClientMsgID
+	if clientMsgID == "" {
+		clientMsgID = "scheduled-" + uuid.NewString()
+	}
+
+	scheduled := &models.ScheduledMessage{
+		RoomID:      msg.RoomID,
+		UserID:      msg.UserID,
+		Content:     msg.Content,
+		MessageType: msg.MessageType,
+		FileURL:     msg.FileURL,
+		ParentID:    msg.ParentID,
+		ClientMsgID: clientMsgID,
+		UndoSend:    undoSend,
+		TTLSeconds:  msg.TTLSeconds,
+		SendAt:      sendAt,
+	}
+	if err := m.db.CreateScheduledMessage(ctx, scheduled); err != nil {
+		return nil, fmt.Errorf("failed to schedule message: %w", err)
+	}
+	return scheduled, nil
+}
+
+// EditScheduledMessage changes the content or send time of one of a user's pending sends. Fields
+// passed as nil are left unchanged. Messages held for undo send keep their send time, which ends the
+// undo send window, so that they are not turned into scheduled messages.
+func (m *Manager) EditScheduledMessage(ctx context.Context, userID uuid.UUID, id int64, content *string, sendAt *time.Time) (*models.ScheduledMessage, error) {
+	if sendAt != nil {
+		if err := validateSendAt(*sendAt); err != nil {
+			return nil, err
+		}
+	}
+	scheduled, err := m.db.UpdateScheduledMessage(ctx, id, userID, content, sendAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		if sendAt != nil {
+			if pending, err := m.db.GetScheduledMessage(ctx, id, userID); err == nil && pending.UndoSend {
+				return nil, ErrUndoSendFixed
+			}
+		}
+		return nil, ErrScheduledMessageNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to edit scheduled message: %w", err)
+	}
+	return scheduled, nil
+}
+
+// CancelScheduledMessage cancels one of a user's pending sends, such as to undo sending a message
+// within the undo send window.
+func (m *Manager) CancelScheduledMessage(ctx context.Context, userID uuid.UUID, id int64) error {
+	canceled, err := m.db.CancelScheduledMessage(ctx, id, userID)
+	if err != nil {
+		return fmt.Errorf("failed to cancel scheduled message: %w", err)
+	}
+	if !canceled {
+		return ErrScheduledMessageNotFound
+	}
+	return nil
+}
@@ -0,0 +1,231 @@
+package rooms
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// streamBufferSize is the number of live frames held for a stream that is not being read fast enough.
+const streamBufferSize = 256
+
+// ErrStreamClosed is returned by Stream.Next once the stream has been closed or its room unloaded.
+var ErrStreamClosed = errors.New("stream closed")
+
+// Stream receives the frames of a single room over HTTP transports such as Server-Sent Events and
+// long-polling. It is fed by the same room broadcast as WebSocket clients.
+type Stream struct {
+	userID  uuid.UUID
+	roomID  uuid.UUID
+	room    *Room
+	manager *Manager
+
+	// backlog holds the missed events replayed on resume, returned before any live frame
+	backlog []*ServerFrame
+	// lastEventID is the ID of the last event returned, so that live frames already replayed are skipped
+	lastEventID int64
+
+	frames    chan *ServerFrame
+	gapMu     sync.Mutex
+	gap       *GapPayload
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// OpenStream opens a stream of the frames of a room for one of its members. If lastEventID is set the
+// events missed since then are returned first, followed by a replay_complete frame.
+// The stream must be closed once the caller is done with it.
+func (m *Manager) OpenStream(ctx context.Context, roomID, userID uuid.UUID, lastEventID int64) (*Stream, error) {
+	isMember, err := m.db.IsRoomMember(ctx, roomID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if !isMember {
+		return nil, ErrNotRoomMember
+	}
+
+	stream := &Stream{
+		userID:      userID,
+		roomID:      roomID,
+		manager:     m,
+		lastEventID: lastEventID,
+		frames:      make(chan *ServerFrame, streamBufferSize),
+		done:        make(chan struct{}),
+	}
+	if !m.addConnection(stream) {
+		return nil, ErrDraining
+	}
+
+	// The stream is added before the missed events are read so that no event falls between them;
+	// live frames that were also replayed are skipped by event ID
+	room := m.GetOrCreateRoom(roomID)
+	for !room.addClient(stream) {
+		room = m.GetOrCreateRoom(roomID)
+	}
+	stream.room = room
+
+	if lastEventID > 0 {
+		frames, upTo, truncated, err := m.missedEvents(ctx, roomID, lastEventID)
+		if err != nil {
+			stream.Close()
+			return nil, err
+		}
+		stream.backlog = append(frames, NewRoomFrame(FrameReplayComplete, roomID, ReplayCompletePayload{
+			LastEventID: upTo,
+			Replayed:    len(frames),
+			Truncated:   truncated,
+		}))
+		stream.lastEventID = upTo
+	}
+	return stream, nil
+}
+
+// UserID returns the ID of the user reading the stream.
+func (s *Stream) UserID() uuid.UUID {
+	return s.userID
+}
+
+// RoomID returns the ID of the stream's room.
+func (s *Stream) RoomID() uuid.UUID {
+	return s.roomID
+}
+
+// deliver queues a live room frame for the stream. Streams have no overflow queue, so PolicyBuffer
+// behaves like PolicyDrop once the stream's buffer is full.
+func (s *Stream) deliver(frame *ServerFrame, policy SlowConsumerPolicy, overflowSize int) bool {
+	s.gapMu.Lock()
+	defer s.gapMu.Unlock()
+
+	if s.gap != nil {
+		select {
+		case s.frames <- NewRoomFrame(FrameGap, frame.RoomID, *s.gap):
+			s.gap = nil
+		default:
+			s.dropFrame(frame)
+			return false
+		}
+	}
+
+	select {
+	case s.frames <- frame:
+		return true
+	default:
+	}
+
+	if policy == PolicyDisconnect {
+		droppedFrames.WithLabelValues(frame.RoomID.String()).Inc()
+		log.Printf("Closing slow stream of user %s in room %s", s.userID, frame.RoomID)
+		// Close removes the stream from its room, which must not happen while the room is broadcasting
+		go s.Close()
+		return false
+	}
+	s.dropFrame(frame)
+	return false
+}
+
+// dropFrame records a frame the stream will not receive so that the reader gets a gap notice. gapMu must be held.
+func (s *Stream) dropFrame(frame *ServerFrame) {
+	droppedFrames.WithLabelValues(frame.RoomID.String()).Inc()
+
+	if s.gap == nil {
+		s.gap = &GapPayload{}
+	}
+	if s.gap.FromEventID == 0 {
+		s.gap.FromEventID = frame.EventID
+	}
+	if frame.EventID != 0 {
+		s.gap.ToEventID = frame.EventID
+	}
+	s.gap.Dropped++
+}
+
+// Next returns the next frame of the stream, waiting for one until ctx is done.
+// It returns ErrStreamClosed once the stream has been closed.
+func (s *Stream) Next(ctx context.Context) (*ServerFrame, error) {
+	return s.next(ctx, true)
+}
+
+// Buffered returns the frames of the stream that are available without waiting.
+func (s *Stream) Buffered() []*ServerFrame {
+	var frames []*ServerFrame
+	for {
+		frame, err := s.next(context.Background(), false)
+		if err != nil || frame == nil {
+			return frames
+		}
+		frames = append(frames, frame)
+	}
+}
+
+// next returns the next frame of the stream. Unless wait is set it returns nil when no frame is available.
+func (s *Stream) next(ctx context.Context, wait bool) (*ServerFrame, error) {
+	if len(s.backlog) > 0 {
+		frame := s.backlog[0]
+		s.backlog[0] = nil
+		s.backlog = s.backlog[1:]
+		return frame, nil
+	}
+
+	for {
+		var frame *ServerFrame
+		select {
+		case frame = <-s.frames:
+		default:
+			// A gap still pending once the buffer has been read is reported even if the room went quiet
+			if gap := s.takeGap(); gap != nil {
+				return gap, nil
+			}
+			if !wait {
+				return nil, nil
+			}
+			select {
+			case frame = <-s.frames:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-s.done:
+				return nil, ErrStreamClosed
+			case <-s.room.quit:
+				return nil, ErrStreamClosed
+			}
+		}
+
+		if frame.EventID != 0 {
+			if frame.EventID <= s.lastEventID {
+				continue
+			}
+			s.lastEventID = frame.EventID
+		}
+		return frame, nil
+	}
+}
+
+// LastEventID returns the ID of the last event returned by the stream.
+func (s *Stream) LastEventID() int64 {
+	return s.lastEventID
+}
+
+// takeGap returns the gap notice pending for the stream, if any.
+func (s *Stream) takeGap() *ServerFrame {
+	s.gapMu.Lock()
+	defer s.gapMu.Unlock()
+	if s.gap == nil {
+		return nil
+	}
+	frame := NewRoomFrame(FrameGap, s.room.ID, *s.gap)
+	s.gap = nil
+	return frame
+}
+
+// Close removes the stream from its room. Frames already queued can still be read with Buffered.
+func (s *Stream) Close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		if s.room != nil {
+			s.room.removeClient(s)
+		}
+		s.manager.removeConnection(s)
+	})
+}
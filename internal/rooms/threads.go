@@ -0,0 +1,138 @@
+package rooms
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/dukepan/multi-rooms-chat-back/internal/models"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// Thread is the root message of a thread, with its summary, and a page of its replies.
+type Thread struct {
+	Root      *models.Message  `json:"root"`
+	Replies   []models.Message `json:"replies"`
+	Following bool             `json:"following"`
+}
+
+// resolveThreadRoot returns the root of the thread that a reply to parentID is posted in. Threads are
+// one level deep, so a reply to a reply joins the thread of its parent.
+func (m *Manager) resolveThreadRoot(ctx context.Context, roomID uuid.UUID, parentID int64) (int64, error) {
+	parent, err := m.db.GetMessageByID(ctx, parentID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, ErrMessageNotFound
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to fetch parent message: %w", err)
+	}
+	if parent.RoomID != roomID {
+		return 0, ErrMessageNotFound
+	}
+	if parent.ParentID != nil {
+		return *parent.ParentID, nil
+	}
+	return parent.ID, nil
+}
+
+// GetThread returns the thread a message belongs to, with the replies after the given reply ID, oldest
+// first and at most limit of them, and whether userID follows it.
+func (m *Manager) GetThread(ctx context.Context, userID, roomID uuid.UUID, messageID int64, after int64, limit int) (*Thread, error) {
+	message, err := m.authorizeMessageAction(ctx, userID, roomID, messageID)
+	if err != nil {
+		return nil, err
+	}
+	root := message
+	if message.ParentID != nil {
+		if root, err = m.db.GetMessageByID(ctx, *message.ParentID); err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				return nil, ErrMessageNotFound
+			}
+			return nil, fmt.Errorf("failed to fetch thread root: %w", err)
+		}
+	}
+
+	if root.Thread, err = m.db.GetThreadSummary(ctx, root.ID); err != nil {
+		return nil, fmt.Errorf("failed to summarize thread: %w", err)
+	}
+	replies, err := m.db.GetThreadReplies(ctx, root.ID, after, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch thread replies: %w", err)
+	}
+	following, err := m.db.IsFollowingThread(ctx, root.ID, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check thread follow: %w", err)
+	}
+	if replies == nil {
+		replies = make([]models.Message, 0)
+	}
+	return &Thread{Root: root, Replies: replies, Following: following}, nil
+}
+
+// SetThreadFollow makes a user follow or unfollow the thread a message belongs to. An explicit choice
+// is kept when the user replies to the thread later.
+func (m *Manager) SetThreadFollow(ctx context.Context, userID, roomID uuid.UUID, messageID int64, following bool) error {
+	message, err := m.authorizeMessageAction(ctx, userID, roomID, messageID)
+	if err != nil {
+		return err
+	}
+	rootID := message.ID
+	if message.ParentID != nil {
+		rootID = *message.ParentID
+	}
+	if err := m.db.SetThreadFollow(ctx, rootID, userID, following); err != nil {
+		return fmt.Errorf("failed to update thread follow: %w", err)
+	}
+	return nil
+}
+
+// RecordThreadReply updates a thread once a new reply to it is stored. The replier and the author of
+// the root follow the thread, the room gets the thread's new summary, and the other followers who are
+// still members are sent the reply on every node, whether or not they are subscribed to the room.
+func (m *Manager) RecordThreadReply(ctx context.Context, reply *models.Message) error {
+	rootID := *reply.ParentID
+	if err := m.db.AutoFollowThread(ctx, rootID, reply.UserID); err != nil {
+		return fmt.Errorf("failed to follow thread: %w", err)
+	}
+	if err := m.publishThreadUpdate(ctx, reply.RoomID, rootID); err != nil {
+		return err
+	}
+
+	followers, err := m.db.GetThreadFollowers(ctx, rootID)
+	if err != nil {
+		return fmt.Errorf("failed to fetch thread followers: %w", err)
+	}
+	frame := NewRoomFrame(FrameThreadReply, reply.RoomID, reply)
+	for _, followerID := range followers {
+		if followerID == reply.UserID {
+			continue
+		}
+		if err := m.SendToUser(ctx, followerID, frame); err != nil {
+			log.Printf("Error notifying user %s of reply %d: %v", followerID, reply.ID, err)
+		}
+	}
+	return nil
+}
+
+// publishThreadUpdate publishes the reply count and latest reply of a thread to its room on every node.
+func (m *Manager) publishThreadUpdate(ctx context.Context, roomID uuid.UUID, rootID int64) error {
+	summary, err := m.db.GetThreadSummary(ctx, rootID)
+	if err != nil {
+		return fmt.Errorf("failed to summarize thread: %w", err)
+	}
+	data := map[string]interface{}{
+		"message_id":  rootID,
+		"reply_count": summary.ReplyCount,
+	}
+	if summary.ReplyCount > 0 {
+		data["last_reply_id"] = summary.LastReplyID
+		data["last_reply_user_id"] = summary.LastReplyUserID
+		data["last_reply_at"] = summary.LastReplyAt
+	}
+	if err := m.syncEngine.PublishRoomEvent(ctx, roomID, FrameThreadUpdated, data); err != nil {
+		return fmt.Errorf("failed to publish %s event: %w", FrameThreadUpdated, err)
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package rooms
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// tokenExpiringNotice is how long before its token expires that a client is sent a token_expiring frame.
+const tokenExpiringNotice = 2 * time.Minute
+
+// TokenInfo identifies the token a connection was authenticated with.
+type TokenInfo struct {
+	// ID is the token's jti claim; tokens without one cannot be revoked.
+	ID        string
+	ExpiresAt time.Time
+}
+
+// TokenRevocation revokes a token of a user on every node. An empty TokenID revokes all of the user's tokens.
+type TokenRevocation struct {
+	UserID  uuid.UUID `json:"user_id"`
+	TokenID string    `json:"token_id,omitempty"`
+}
+
+// SetTokenValidator sets the validator used for the tokens of reauth frames. This is used for circular dependencies.
+func (m *Manager) SetTokenValidator(tokens TokenValidator) {
+	m.tokens = tokens
+}
+
+// PublishTokenRevocation closes the connections authenticated with a revoked token on this node and
+// every other node. The revocation must already be stored so that the token cannot be used again.
+func (m *Manager) PublishTokenRevocation(ctx context.Context, revocation TokenRevocation) error {
+	m.handleTokenRevocation(revocation)
+	return m.publishBusEvent(ctx, UsersChannel, BusKindTokenRevoked, revocation)
+}
+
+// handleTokenRevocation closes this node's connections authenticated with a revoked token.
+func (m *Manager) handleTokenRevocation(revocation TokenRevocation) {
+	m.connsMu.Lock()
+	var revoked []*Client
+	for conn := range m.conns {
+		client, ok := conn.(*Client)
+		if !ok || client.userID != revocation.UserID {
+			continue
+		}
+		if revocation.TokenID == "" || client.Token().ID == revocation.TokenID {
+			revoked = append(revoked, client)
+		}
+	}
+	m.connsMu.Unlock()
+
+	for _, client := range revoked {
+		client.CloseWith(CloseTokenRevoked, "token revoked")
+	}
+}
+
+// Token returns the token the client is currently authenticated with.
+func (c *Client) Token() TokenInfo {
+	c.tokenMu.Lock()
+	defer c.tokenMu.Unlock()
+	return c.token
+}
+
+// handleReauth replaces the client's token with a fresh one for the same user.
+func (c *Client) handleReauth(ctx context.Context, payload ReauthPayload) (interface{}, error) {
+	if c.manager.tokens == nil {
+		return nil, newProtocolError(ErrCodeUnavailable, "reauthentication is not available")
+	}
+	if payload.Token == "" {
+		return nil, newProtocolError(ErrCodeBadRequest, "token is required")
+	}
+
+	claims, err := c.manager.tokens.ValidateToken(payload.Token)
+	if err != nil {
+		return nil, newProtocolError(ErrCodeUnauthorized, "invalid token")
+	}
+	if claims.UserID != c.userID {
+		return nil, newProtocolError(ErrCodeForbidden, "token belongs to another user")
+	}
+	revoked, err := c.manager.cache.IsTokenRevoked(ctx, claims.ID)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, newProtocolError(ErrCodeUnauthorized, "token has been revoked")
+	}
+
+	token := TokenInfo{ID: claims.ID}
+	if claims.ExpiresAt != nil {
+		token.ExpiresAt = claims.ExpiresAt.Time
+	}
+	c.tokenMu.Lock()
+	c.token = token
+	c.tokenMu.Unlock()
+
+	// Let tokenLoop schedule the new expiry
+	select {
+	case c.tokenRefreshed <- struct{}{}:
+	default:
+	}
+	return TokenExpiryPayload{ExpiresAt: token.ExpiresAt}, nil
+}
+
+// tokenLoop sends the client a token_expiring frame shortly before its token expires, and closes the
+// connection with CloseTokenExpired once it has expired without a reauth.
+func (c *Client) tokenLoop() {
+	var noticeSent time.Time // expiry the client was last warned about
+
+	for {
+		expiresAt := c.Token().ExpiresAt
+		if expiresAt.IsZero() {
+			// A token without expiry never needs refreshing
+			select {
+			case <-c.done:
+				return
+			case <-c.tokenRefreshed:
+				continue
+			}
+		}
+
+		wakeAt := expiresAt.Add(-tokenExpiringNotice)
+		if noticeSent.Equal(expiresAt) {
+			wakeAt = expiresAt
+		}
+		timer := time.NewTimer(time.Until(wakeAt))
+
+		select {
+		case <-c.done:
+			timer.Stop()
+			return
+		case <-c.tokenRefreshed:
+			timer.Stop()
+		case <-timer.C:
+			if !time.Now().Before(expiresAt) {
+				log.Printf("Closing connection of user %s after its token expired", c.userID)
+				c.CloseWith(CloseTokenExpired, "token expired")
+				return
+			}
+			if !noticeSent.Equal(expiresAt) {
+				noticeSent = expiresAt
+				c.queue(&ServerFrame{Version: c.version, Type: FrameTokenExpiring, Payload: TokenExpiryPayload{ExpiresAt: expiresAt}})
+			}
+		}
+	}
+}